@@ -1,7 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/spf13/viper"
+	"github.com/ziyasal/distroxy/internal/pkg/app"
+	"github.com/ziyasal/distroxy/pkg/distrox"
 )
 
 type AppConfig struct {
@@ -10,6 +15,23 @@ type AppConfig struct {
 	// debug or release
 	mode         string
 	pprofEnabled bool
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	metricsEnabled      bool
+	shardMetricsEnabled bool
+
+	auth      AuthConfig
+	tls       app.TLSConfig
+	rateLimit app.RateLimitConfig
+}
+
+type AuthConfig struct {
+	enabled     bool
+	tokenSecret string
+	apiKeys     []app.APIKey
+	clientCerts []app.ClientCert
 }
 
 type CacheConfig struct {
@@ -17,9 +39,46 @@ type CacheConfig struct {
 	maxBytes     int
 	ttlInSeconds int64
 	statsEnabled bool
+	offHeap      bool
+	globalBudget bool
+
+	eventBufferSize int
+
+	latencyStatsEnabled bool
+
+	evictionPolicy  string
+	admissionFilter string
 
 	maxKeySizeInBytes   int64
 	maxValueSizeInBytes int64
+
+	disk       DiskConfig
+	compaction CompactionConfig
+	hotKeys    HotKeysConfig
+	slowLog    SlowLogConfig
+}
+
+type DiskConfig struct {
+	dir                string
+	maxBytes           int64
+	segmentSizeInBytes int64
+	promotionEnabled   bool
+}
+
+type HotKeysConfig struct {
+	topK          int
+	sampleRate    int
+	decayInterval time.Duration
+}
+
+type SlowLogConfig struct {
+	threshold time.Duration
+	maxLen    int
+}
+
+type CompactionConfig struct {
+	interval     time.Duration
+	minDeadRatio float64
 }
 
 type Config struct {
@@ -43,15 +102,95 @@ func loadConfig() (*Config, error) {
 	c.app.port = v.GetInt("app.port")
 	c.app.mode = v.GetString("app.mode")
 	c.app.pprofEnabled = v.GetBool("app.pprof_enabled")
+	c.app.readTimeout = time.Duration(v.GetInt64("app.read_timeout_in_seconds")) * time.Second
+	c.app.writeTimeout = time.Duration(v.GetInt64("app.write_timeout_in_seconds")) * time.Second
+	c.app.metricsEnabled = v.GetBool("app.metrics_enabled")
+	c.app.shardMetricsEnabled = v.GetBool("app.shard_metrics_enabled")
+
+	c.app.auth.enabled = v.GetBool("app.auth.enabled")
+	c.app.auth.tokenSecret = v.GetString("app.auth.token_secret")
+	if err := v.UnmarshalKey("app.auth.api_keys", &c.app.auth.apiKeys); err != nil {
+		return nil, fmt.Errorf("invalid api keys: %w", err)
+	}
+	if err := v.UnmarshalKey("app.auth.client_certs", &c.app.auth.clientCerts); err != nil {
+		return nil, fmt.Errorf("invalid client certs: %w", err)
+	}
+
+	c.app.tls.CertFile = v.GetString("app.tls.cert_file")
+	c.app.tls.KeyFile = v.GetString("app.tls.key_file")
+	c.app.tls.ClientCAFile = v.GetString("app.tls.client_ca_file")
+	reloadInSeconds := v.GetInt64("app.tls.reload_interval_in_seconds")
+	c.app.tls.ReloadInterval = time.Duration(reloadInSeconds) * time.Second
+
+	c.app.rateLimit.ReadRate = v.GetFloat64("app.rate_limit.read_rate")
+	c.app.rateLimit.ReadBurst = v.GetInt("app.rate_limit.read_burst")
+	c.app.rateLimit.WriteRate = v.GetFloat64("app.rate_limit.write_rate")
+	c.app.rateLimit.WriteBurst = v.GetInt("app.rate_limit.write_burst")
+	c.app.rateLimit.MaxInFlight = v.GetInt64("app.rate_limit.max_in_flight")
 
 	// cache
 	c.cache.shards = v.GetInt("cache.shards")
 	c.cache.maxBytes = v.GetInt("cache.max_bytes")
 	c.cache.ttlInSeconds = v.GetInt64("cache.ttl_in_seconds")
 	c.cache.statsEnabled = v.GetBool("cache.stats_enabled")
+	c.cache.latencyStatsEnabled = v.GetBool("cache.latency_stats_enabled")
+	c.cache.offHeap = v.GetBool("cache.off_heap")
+	c.cache.globalBudget = v.GetBool("cache.global_budget")
+	c.cache.eventBufferSize = v.GetInt("cache.event_buffer_size")
+	c.cache.evictionPolicy = v.GetString("cache.eviction_policy")
+	c.cache.admissionFilter = v.GetString("cache.admission_filter")
 
 	c.cache.maxKeySizeInBytes = v.GetInt64("cache.max_key_size_in_bytes")
 	c.cache.maxValueSizeInBytes = v.GetInt64("cache.max_value_size_in_bytes")
 
+	c.cache.disk.dir = v.GetString("cache.disk.dir")
+	c.cache.disk.maxBytes = v.GetInt64("cache.disk.max_bytes")
+	c.cache.disk.segmentSizeInBytes = v.GetInt64("cache.disk.segment_size_in_bytes")
+	c.cache.disk.promotionEnabled = v.GetBool("cache.disk.promotion_enabled")
+
+	intervalInSeconds := v.GetInt64("cache.compaction.interval_in_seconds")
+	c.cache.compaction.interval = time.Duration(intervalInSeconds) * time.Second
+	c.cache.compaction.minDeadRatio = v.GetFloat64("cache.compaction.min_dead_ratio")
+
+	c.cache.hotKeys.topK = v.GetInt("cache.hot_keys.top_k")
+	c.cache.hotKeys.sampleRate = v.GetInt("cache.hot_keys.sample_rate")
+	decayInSeconds := v.GetInt64("cache.hot_keys.decay_interval_in_seconds")
+	c.cache.hotKeys.decayInterval = time.Duration(decayInSeconds) * time.Second
+
+	thresholdInMilliseconds := v.GetInt64("cache.slow_log.threshold_in_milliseconds")
+	c.cache.slowLog.threshold = time.Duration(thresholdInMilliseconds) * time.Millisecond
+	c.cache.slowLog.maxLen = v.GetInt("cache.slow_log.max_len")
+
 	return &c, nil
 }
+
+// newEvictionPolicy returns the policy factory for the configured name, nil is the default FIFO policy
+func newEvictionPolicy(name string) (func() distrox.EvictionPolicy, error) {
+	switch name {
+	case "", "fifo":
+		return nil, nil
+	case "clock":
+		return func() distrox.EvictionPolicy { return distrox.NewClockPolicy(clockReferenceBits) }, nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy: %s", name)
+	}
+}
+
+// newAdmissionFilter returns the filter factory for the configured name, nil disables the filter.
+// The filter of each shard is sized by the entries the shard can hold.
+func newAdmissionFilter(name string, maxBytes int, shards int) (func() distrox.AdmissionFilter, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "tinylfu":
+		var counters int
+		if shards > 0 {
+			counters = maxBytes / shards / tinyLFUEntrySizeInBytes
+		}
+		return func() distrox.AdmissionFilter {
+			return distrox.NewTinyLFU(counters, tinyLFUMinFrequency)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown admission filter: %s", name)
+	}
+}
@@ -21,6 +21,12 @@ const (
 	version = "1.0.0"
 
 	exitWithErr = 1
+
+	clockReferenceBits  = 1 << 16
+	tinyLFUMinFrequency = 3
+	// tinyLFUEntrySizeInBytes is the average entry size the sketch of a shard is sized by,
+	// the sketch has a counter per entry the shard can hold
+	tinyLFUEntrySizeInBytes = 1024
 )
 
 func main() {
@@ -41,6 +47,17 @@ func run() (int, error) {
 		return exitWithErr, fmt.Errorf("couldn't load config: %s", err)
 	}
 
+	newPolicy, err := newEvictionPolicy(config.cache.evictionPolicy)
+	if err != nil {
+		return exitWithErr, err
+	}
+
+	newAdmission, err := newAdmissionFilter(config.cache.admissionFilter, config.cache.maxBytes,
+		config.cache.shards)
+	if err != nil {
+		return exitWithErr, err
+	}
+
 	logger := common.NewZeroLogger(config.app.mode)
 	cache, err := distrox.NewCache(
 		distrox.WithMaxBytes(config.cache.maxBytes),
@@ -50,17 +67,46 @@ func run() (int, error) {
 		distrox.WithTTL(config.cache.ttlInSeconds),
 		distrox.WithLogger(logger),
 		distrox.WithStatsEnabled(),
+		distrox.WithLatencyStats(config.cache.latencyStatsEnabled),
+		distrox.WithOffHeap(config.cache.offHeap),
+		distrox.WithGlobalBudget(config.cache.globalBudget),
+		distrox.WithDiskTier(config.cache.disk.dir, config.cache.disk.maxBytes),
+		distrox.WithDiskSegmentSize(config.cache.disk.segmentSizeInBytes),
+		distrox.WithDiskPromotion(config.cache.disk.promotionEnabled),
+		distrox.WithEvictionPolicy(newPolicy),
+		distrox.WithAdmissionFilter(newAdmission),
+		distrox.WithCompaction(config.cache.compaction.interval, config.cache.compaction.minDeadRatio),
+		distrox.WithHotKeys(config.cache.hotKeys.topK, config.cache.hotKeys.sampleRate,
+			config.cache.hotKeys.decayInterval),
+		distrox.WithSlowLog(config.cache.slowLog.threshold, config.cache.slowLog.maxLen),
+		distrox.WithEventBuffer(config.cache.eventBufferSize),
 	)
 	if err != nil {
 		return exitWithErr, err
 	}
 
+	var auth *app.Auth
+	if config.app.auth.enabled {
+		auth, err = app.NewAuth(app.AuthConfig{APIKeys: config.app.auth.apiKeys,
+			ClientCerts: config.app.auth.clientCerts, TokenSecret: config.app.auth.tokenSecret})
+		if err != nil {
+			return exitWithErr, err
+		}
+	}
+
 	logger.Info(fmt.Sprintf("Starting Distrox server(v%s) ...", version))
 
 	srv := app.NewServer(fmt.Sprintf("%s:%d", config.app.host, config.app.port),
 		cache,
+		app.WithAuth(auth),
+		app.WithTLS(config.app.tls),
+		app.WithRateLimit(config.app.rateLimit),
+		app.WithServerReadTimeout(config.app.readTimeout),
+		app.WithServerWriteTimeout(config.app.writeTimeout),
 		app.WithLogger(logger),
 		app.WithPprof(config.app.pprofEnabled),
+		app.WithMetrics(config.app.metricsEnabled),
+		app.WithShardMetrics(config.app.shardMetricsEnabled),
 		app.WithMode(config.app.mode),
 	)
 
@@ -71,11 +117,29 @@ func run() (int, error) {
 		}
 	}()
 
+	if config.app.tls.CertFile != "" {
+		go reloadTLSOnHangup(srv, logger)
+	}
+
 	exitCode := gracefullyShutdown(srv, logger)
 
 	return exitCode, nil
 }
 
+// reloadTLSOnHangup reloads the tls certificates of the server on SIGHUP
+func reloadTLSOnHangup(srv *app.Server, logger common.Logger) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	for range sig {
+		if err := srv.ReloadTLS(); err != nil {
+			logger.Err("tls certificates could not reloaded", err)
+			continue
+		}
+		logger.Info("tls certificates are reloaded.")
+	}
+}
+
 func gracefullyShutdown(srv *app.Server, logger common.Logger) int {
 	sig := make(chan os.Signal, 1)
 	exit := 0
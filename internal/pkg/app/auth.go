@@ -0,0 +1,317 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	apiKeyHeader = "X-Api-Key"
+	bearerPrefix = "Bearer "
+
+	// principalContextKey is the context key of the authenticated credentials
+	principalContextKey = "distrox.principal"
+)
+
+var (
+	errNoCredentials         = errors.New("no credentials")
+	errUnknownAPIKey         = errors.New("unknown api key")
+	errUnknownClient         = errors.New("unknown client certificate identity")
+	errInvalidToken          = errors.New("invalid token")
+	errInvalidTokenSignature = errors.New("invalid token signature")
+	errTokenExpired          = errors.New("token is expired")
+)
+
+// authOp is an operation granted to the credentials
+type authOp uint8
+
+const (
+	// opRead is the GET and HEAD of the keys and the events of them
+	opRead authOp = 1 << iota
+	// opWrite is the PUT of the keys
+	opWrite
+	// opDelete is the DELETE of the keys
+	opDelete
+	// opAdmin is the stats, metrics, pprof and admin endpoints
+	opAdmin
+)
+
+var authOps = map[string]authOp{"read": opRead, "write": opWrite, "delete": opDelete, "admin": opAdmin}
+
+func parseAuthOps(names []string) (authOp, error) {
+	var ops authOp
+	for _, name := range names {
+		op, ok := authOps[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown auth operation: %s", name)
+		}
+		ops |= op
+	}
+
+	return ops, nil
+}
+
+// APIKey is a static key accepted in the X-Api-Key header or as a bearer token. Ops are the operations
+// granted to it (read, write, delete and admin) and Prefixes are the key prefixes they are allowed on,
+// all of the keys without prefixes.
+type APIKey struct {
+	Name     string
+	Key      string
+	Ops      []string
+	Prefixes []string
+}
+
+// ClientCert is the identity of a client certificate verified by mutual TLS, see clientIdentity.
+// Ops and Prefixes are the same as the ones of an APIKey.
+type ClientCert struct {
+	Identity string
+	Ops      []string
+	Prefixes []string
+}
+
+// AuthConfig is the credentials accepted by the server
+type AuthConfig struct {
+	APIKeys []APIKey
+	// ClientCerts are used when a request has no API key or token
+	ClientCerts []ClientCert
+	// TokenSecret is the HMAC-SHA256 secret of the signed bearer tokens, the tokens aren't accepted without it
+	TokenSecret string
+}
+
+// principal is the authenticated credentials
+type principal struct {
+	name     string
+	ops      authOp
+	prefixes []string
+}
+
+func (p *principal) allows(op authOp) bool {
+	return p.ops&op == op
+}
+
+// allowsKey reports whether the key has one of the granted prefixes
+func (p *principal) allowsKey(key []byte) bool {
+	if len(p.prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range p.prefixes {
+		if len(key) >= len(prefix) && string(key[:len(prefix)]) == prefix {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tokenClaims are the claims of a signed bearer token, it's a JWT signed with HS256
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	Ops       []string `json:"ops"`
+	Prefixes  []string `json:"prefixes,omitempty"`
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+}
+
+// Auth authenticates the requests with the static API keys and the signed bearer tokens
+type Auth struct {
+	// api keys are looked up by their hash, so the lookup doesn't depend on the key bytes
+	apiKeys     map[[sha256.Size]byte]*principal
+	clients     map[string]*principal
+	tokenSecret []byte
+	now         func() time.Time
+}
+
+// NewAuth returns the authentication for the config, at least an API key, a client certificate
+// or the token secret is required
+func NewAuth(config AuthConfig) (*Auth, error) {
+	if len(config.APIKeys) == 0 && len(config.ClientCerts) == 0 && config.TokenSecret == "" {
+		return nil, errors.New("auth requires api keys, client certs or a token secret")
+	}
+
+	a := &Auth{apiKeys: make(map[[sha256.Size]byte]*principal, len(config.APIKeys)),
+		clients: make(map[string]*principal, len(config.ClientCerts)), tokenSecret: []byte(config.TokenSecret),
+		now: time.Now}
+
+	for _, k := range config.APIKeys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("empty api key: %s", k.Name)
+		}
+
+		ops, err := parseAuthOps(k.Ops)
+		if err != nil {
+			return nil, fmt.Errorf("api key %s: %w", k.Name, err)
+		}
+
+		h := sha256.Sum256([]byte(k.Key))
+		if _, ok := a.apiKeys[h]; ok {
+			return nil, fmt.Errorf("duplicate api key: %s", k.Name)
+		}
+		a.apiKeys[h] = &principal{name: k.Name, ops: ops, prefixes: k.Prefixes}
+	}
+
+	for _, c := range config.ClientCerts {
+		ops, err := parseAuthOps(c.Ops)
+		if err != nil {
+			return nil, fmt.Errorf("client cert %s: %w", c.Identity, err)
+		}
+
+		if _, ok := a.clients[c.Identity]; ok || c.Identity == "" {
+			return nil, fmt.Errorf("empty or duplicate client cert identity: %s", c.Identity)
+		}
+		a.clients[c.Identity] = &principal{name: c.Identity, ops: ops, prefixes: c.Prefixes}
+	}
+
+	return a, nil
+}
+
+// authenticate returns the credentials of the request, a bearer token with dots is a signed token.
+// The client certificate is used without an API key or a token.
+func (a *Auth) authenticate(r *http.Request) (*principal, error) {
+	credentials := r.Header.Get(apiKeyHeader)
+	if credentials == "" {
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, bearerPrefix) {
+			return a.authenticateClient(r)
+		}
+
+		credentials = strings.TrimSpace(authorization[len(bearerPrefix):])
+		if strings.IndexByte(credentials, '.') >= 0 {
+			return a.verifyToken(credentials)
+		}
+	}
+
+	p, ok := a.apiKeys[sha256.Sum256([]byte(credentials))]
+	if !ok {
+		return nil, errUnknownAPIKey
+	}
+
+	return p, nil
+}
+
+// authenticateClient returns the credentials of the identity of the client certificate
+func (a *Auth) authenticateClient(r *http.Request) (*principal, error) {
+	identity := clientIdentity(r)
+	if identity == "" {
+		return nil, errNoCredentials
+	}
+
+	p, ok := a.clients[identity]
+	if !ok {
+		return nil, errUnknownClient
+	}
+
+	return p, nil
+}
+
+// verifyToken verifies the signature and the validity period of the token and returns its credentials
+func (a *Auth) verifyToken(token string) (*principal, error) {
+	if len(a.tokenSecret) == 0 {
+		return nil, errInvalidToken
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	mac := hmac.New(sha256.New, a.tokenSecret)
+	mac.Write([]byte(token[:len(parts[0])+1+len(parts[1])]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errInvalidTokenSignature
+	}
+
+	var header tokenHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, errInvalidToken
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return nil, errInvalidToken
+	}
+
+	now := a.now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt || claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errTokenExpired
+	}
+
+	ops, err := parseAuthOps(claims.Ops)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	return &principal{name: claims.Subject, ops: ops, prefixes: claims.Prefixes}, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// keyFunc returns the key of the request and its encoding
+type keyFunc func(ctx *gin.Context) (string, string)
+
+// authorize returns the middleware authorizing the op, the key of a keyed route returned by keyOf
+// has to have one of the prefixes granted to the credentials as well, keyOf is nil for the routes
+// without keys. It allows everything without auth.
+func (s *Server) authorize(op authOp, keyOf keyFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if s.auth == nil {
+			return
+		}
+
+		p, err := s.auth.authenticate(ctx.Request)
+		if err != nil {
+			atomic.AddUint64(&s.stats.authFailures, 1)
+			s.logger.Debug(fmt.Sprintf("request could not authenticated: %v", err))
+			ctx.Header("WWW-Authenticate", `Bearer realm="distrox"`)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+
+		if !p.allows(op) || keyOf != nil && !s.keyAllowed(ctx, p, keyOf) {
+			atomic.AddUint64(&s.stats.authDenials, 1)
+			s.logger.Debug(fmt.Sprintf("%s is not allowed to %s %s", p.name, ctx.Request.Method,
+				ctx.Request.URL.Path))
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+
+		ctx.Set(principalContextKey, p)
+	}
+}
+
+// keyAllowed reports whether the key of the request is allowed to the credentials,
+// a key which can't be decoded is left to the handler to be rejected
+func (s *Server) keyAllowed(ctx *gin.Context, p *principal, keyOf keyFunc) bool {
+	key, encoding := keyOf(ctx)
+	keyBuf := s.bpool.Get()
+	defer s.bpool.Put(keyBuf)
+
+	keyBuf, err := decodeKey(keyBuf[:0], key, encoding)
+	return err != nil || p.allowsKey(keyBuf)
+}
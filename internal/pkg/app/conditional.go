@@ -0,0 +1,66 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etag returns the strong entity tag of the entry, it's the quoted hash of the value
+func etag(hash uint64) string {
+	return strconv.Quote(strconv.FormatUint(hash, 16))
+}
+
+// notModified reports whether the conditional request can be answered with 304 Not Modified,
+// If-None-Match takes precedence over If-Modified-Since
+func notModified(r *http.Request, etag string, created time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		return notModifiedSince(ifModifiedSince, created)
+	}
+
+	return false
+}
+
+// rangeApplies reports whether the Range header is served for the If-Range header,
+// the entity tag must match with the strong comparison or the date must be the created time
+func rangeApplies(ifRange, etag string, created time.Time) bool {
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return ifRange == etag
+	}
+
+	t, err := http.ParseTime(ifRange)
+	return err == nil && t.Equal(created)
+}
+
+// etagMatches reports whether one of the entity tags of the If-None-Match header matches the etag,
+// the tags are compared with the weak comparison as If-None-Match requires
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModifiedSince reports whether the entry created at the time isn't modified since
+// the time of the If-Modified-Since header, an invalid time is ignored
+func notModifiedSince(ifModifiedSince string, created time.Time) bool {
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+
+	return !created.After(since)
+}
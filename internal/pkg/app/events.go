@@ -0,0 +1,134 @@
+package app
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ziyasal/distroxy/pkg/distrox"
+)
+
+const (
+	// prefixQuery is the query for the key prefix of the events, it's encoded the same as the keys
+	prefixQuery = "prefix"
+
+	// eventsKeepAliveInterval is the interval of the comments sent to keep the idle streams open
+	eventsKeepAliveInterval = 15 * time.Second
+	// eventsStreamMargin is the time left to the write timeout of the server when a stream is ended,
+	// the streams are ended only when the write deadline of their connection can't be extended
+	eventsStreamMargin = time.Second
+	// eventsRetry is the reconnection delay advised to the clients in milliseconds
+	eventsRetry = 1000
+)
+
+// eventMessage is the data of an event sent to the subscribers
+type eventMessage struct {
+	Type string    `json:"type"`
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+}
+
+// prefixParam returns the key prefix of the events and its encoding
+func prefixParam(ctx *gin.Context) (string, string) {
+	return ctx.Query(prefixQuery), ctx.Query(keyEncodingQuery)
+}
+
+// eventsHandler streams the events of the keys with the prefix as Server-Sent Events named by their type.
+// The write deadline of the connection is extended before each write, so the stream isn't ended by the
+// write timeout of the server while the client reads it. Over HTTP/2 the connection is shared by the
+// streams, so a stream is ended before the write timeout instead and the client reconnects after the
+// advised retry delay, the events published in the meantime are missed. The stream of a client which
+// doesn't keep up with the events is ended by a dropped event.
+func (s *Server) eventsHandler(ctx *gin.Context) {
+	prefix, encoding := prefixParam(ctx)
+	prefixBuf, err := decodeKey(nil, prefix, encoding)
+	if err != nil {
+		s.logger.Debug(err.Error())
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sub := s.cache.Subscribe(prefixBuf)
+	defer sub.Close()
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	// the proxies buffering the responses would hold the events back
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+	_, _ = fmt.Fprintf(ctx.Writer, "retry: %d\n\n", eventsRetry)
+	ctx.Writer.Flush()
+
+	conn, _ := ctx.Request.Context().Value(connKey{}).(net.Conn)
+	if ctx.Request.ProtoMajor != 1 {
+		conn = nil
+	}
+
+	var end <-chan time.Time
+	if s.writeTimeout > 0 && conn == nil {
+		timer := time.NewTimer(eventsStreamDuration(s.writeTimeout))
+		defer timer.Stop()
+		end = timer.C
+	}
+
+	// extend moves the write deadline of the connection before a write
+	extend := func() {
+		if s.writeTimeout > 0 && conn != nil {
+			_ = conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		}
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e := <-sub.Events():
+			extend()
+			ctx.SSEvent(e.Type.String(), newEventMessage(e, encoding))
+		case <-sub.Dropped():
+			extend()
+			// the buffered events are sent before the gap
+			for len(sub.Events()) > 0 {
+				e := <-sub.Events()
+				ctx.SSEvent(e.Type.String(), newEventMessage(e, encoding))
+			}
+			ctx.SSEvent("dropped", gin.H{"error": "events are dropped since the client doesn't keep up"})
+			ctx.Writer.Flush()
+			return
+		case <-keepAlive.C:
+			extend()
+			_, _ = ctx.Writer.WriteString(": keepalive\n\n")
+		case <-end:
+			return
+		case <-s.stopEvents:
+			return
+		case <-ctx.Request.Context().Done():
+			return
+		}
+
+		ctx.Writer.Flush()
+	}
+}
+
+// eventsStreamDuration returns the duration of a stream ended before the write timeout
+func eventsStreamDuration(writeTimeout time.Duration) time.Duration {
+	if writeTimeout > 2*eventsStreamMargin {
+		return writeTimeout - eventsStreamMargin
+	}
+
+	return writeTimeout / 2
+}
+
+// newEventMessage returns the message of the event with the key in the encoding of the request
+func newEventMessage(e distrox.Event, encoding string) eventMessage {
+	key := string(e.Key)
+	if encoding == keyEncodingBase64 {
+		key = base64.RawURLEncoding.EncodeToString(e.Key)
+	}
+
+	return eventMessage{Type: e.Type.String(), Key: key, Time: e.Time}
+}
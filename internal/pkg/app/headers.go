@@ -0,0 +1,79 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// metaHeaderPrefix is the prefix of the user headers stored with the value
+	metaHeaderPrefix = "X-Distrox-Meta-"
+	// maxMetaHeaders is the max number of the user headers stored with the value
+	maxMetaHeaders = 16
+)
+
+// storedHeaders are the request headers stored with the value besides the user headers
+var storedHeaders = []string{"Content-Type", "Content-Encoding"}
+
+// encodeHeaders appends the headers to be stored with the value to buf as "Name: Value\n" lines,
+// it reports false when there are more than maxMetaHeaders user headers.
+func encodeHeaders(buf []byte, h http.Header) ([]byte, bool) {
+	for _, name := range storedHeaders {
+		if v := h.Get(name); v != "" {
+			buf = appendHeader(buf, name, v)
+		}
+	}
+
+	var names []string
+	for name := range h {
+		if strings.HasPrefix(name, metaHeaderPrefix) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) > maxMetaHeaders {
+		return buf, false
+	}
+
+	// the headers are stored in the same order for the same request
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			buf = appendHeader(buf, name, v)
+		}
+	}
+
+	return buf, true
+}
+
+func appendHeader(buf []byte, name, value string) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, ": "...)
+	buf = append(buf, value...)
+	return append(buf, '\n')
+}
+
+// writeHeaders adds the headers stored with the value to h
+func writeHeaders(h http.Header, metadata []byte) {
+	for len(metadata) > 0 {
+		line := metadata
+		if i := bytes.IndexByte(metadata, '\n'); i >= 0 {
+			line, metadata = metadata[:i], metadata[i+1:]
+		} else {
+			metadata = nil
+		}
+
+		if i := bytes.Index(line, []byte(": ")); i > 0 {
+			h.Add(string(line[:i]), string(line[i+2:]))
+		}
+	}
+}
+
+// resetHeaders removes the headers set for the response before an error is returned instead
+func resetHeaders(h http.Header) {
+	for name := range h {
+		delete(h, name)
+	}
+}
@@ -0,0 +1,258 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ziyasal/distroxy/internal/pkg/metrics"
+	"github.com/ziyasal/distroxy/pkg/distrox"
+)
+
+const (
+	metricsPath = "/metrics"
+
+	// metricsContentType is the content type of the Prometheus text exposition format
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// cacheMetric maps a cache stat to a metric
+type cacheMetric struct {
+	name  string
+	help  string
+	typ   string
+	value func(stats *distrox.CacheStats) uint64
+}
+
+var cacheMetrics = []cacheMetric{
+	{"distrox_cache_hits_total", "Number of successfully found keys.", metrics.CounterType,
+		func(s *distrox.CacheStats) uint64 { return s.Hits }},
+	{"distrox_cache_misses_total", "Number of not found keys.", metrics.CounterType,
+		func(s *distrox.CacheStats) uint64 { return s.Misses }},
+	{"distrox_cache_delete_hits_total", "Number of successfully deleted keys.", metrics.CounterType,
+		func(s *distrox.CacheStats) uint64 { return s.DelHits }},
+	{"distrox_cache_delete_misses_total", "Number of deletes of not found keys.", metrics.CounterType,
+		func(s *distrox.CacheStats) uint64 { return s.DelMisses }},
+	{"distrox_cache_collisions_total", "Number of key collisions.", metrics.CounterType,
+		func(s *distrox.CacheStats) uint64 { return s.Collisions }},
+	{"distrox_cache_evictions_total", "Number of entries removed since their block is overwritten.",
+		metrics.CounterType, func(s *distrox.CacheStats) uint64 { return s.Evictions }},
+	{"distrox_cache_expirations_total", "Number of entries found expired.", metrics.CounterType,
+		func(s *distrox.CacheStats) uint64 { return s.Expirations }},
+	{"distrox_cache_fragmented_sets_total", "Number of stored entries which don't fit into a block.",
+		metrics.CounterType, func(s *distrox.CacheStats) uint64 { return s.FragmentedSets }},
+	{"distrox_cache_fragmented_gets_total", "Number of read entries which don't fit into a block.",
+		metrics.CounterType, func(s *distrox.CacheStats) uint64 { return s.FragmentedGets }},
+	{"distrox_cache_fragment_misses_total", "Number of fragmented entries read with a missing fragment.",
+		metrics.CounterType, func(s *distrox.CacheStats) uint64 { return s.FragmentMisses }},
+	{"distrox_cache_hash_failures_total", "Number of fragmented entries read with a value hash mismatch.",
+		metrics.CounterType, func(s *distrox.CacheStats) uint64 { return s.HashFailures }},
+	{"distrox_cache_reinserts_total", "Number of entries re-appended by the eviction policy.",
+		metrics.CounterType, func(s *distrox.CacheStats) uint64 { return s.Reinserts }},
+	{"distrox_cache_admission_rejects_total", "Number of writes refused by the admission filter.",
+		metrics.CounterType, func(s *distrox.CacheStats) uint64 { return s.AdmissionRejects }},
+	{"distrox_cache_compactions_total", "Number of blocks released by the compaction.", metrics.CounterType,
+		func(s *distrox.CacheStats) uint64 { return s.Compactions }},
+	{"distrox_cache_reclaims_total", "Number of blocks reclaimed for the global budget.", metrics.CounterType,
+		func(s *distrox.CacheStats) uint64 { return s.Reclaims }},
+	{"distrox_cache_disk_hits_total", "Number of keys found in the disk tier.", metrics.CounterType,
+		func(s *distrox.CacheStats) uint64 { return s.DiskHits }},
+	{"distrox_cache_entries", "Number of entries in the cache.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.EntriesCount }},
+	{"distrox_cache_bytes", "Size of the cache in bytes.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.CacheBytes }},
+	{"distrox_cache_index_bytes", "Size of the entry indexes in bytes.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.IndexBytes }},
+	{"distrox_cache_capacity_bytes", "Size of the ring buffer blocks in bytes.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.CapacityBytes }},
+	{"distrox_cache_budget_blocks", "Number of blocks of the global budget.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.BudgetBlocks }},
+	{"distrox_cache_off_heap_bytes", "Size of the blocks allocated outside of the Go heap in bytes.",
+		metrics.GaugeType, func(s *distrox.CacheStats) uint64 { return s.OffHeapBytes }},
+	{"distrox_cache_live_bytes", "Size of the entries referenced by the index in bytes.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.LiveBytes }},
+	{"distrox_cache_dead_bytes", "Size of the deleted and overwritten entries in bytes.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.DeadBytes }},
+	{"distrox_cache_disk_bytes", "Size of the disk tier segments in bytes.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.DiskBytes }},
+	{"distrox_cache_disk_segments", "Number of the disk tier segment files.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.DiskSegments }},
+	{"distrox_cache_event_subscribers", "Number of the keyspace event subscribers.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.EventSubscribers }},
+	{"distrox_cache_dropped_subscribers_total", "Number of the event subscribers which don't keep up.",
+		metrics.CounterType, func(s *distrox.CacheStats) uint64 { return s.DroppedSubscribers }},
+	{"distrox_cache_watchers", "Number of the watchers of the keys.", metrics.GaugeType,
+		func(s *distrox.CacheStats) uint64 { return s.Watchers }},
+}
+
+// serverMetric maps a server stat to a metric
+type serverMetric struct {
+	name  string
+	help  string
+	typ   string
+	value func(stats *ServerStats) uint64
+}
+
+var serverMetrics = []serverMetric{
+	{"distrox_http_auth_failures_total", "Number of requests rejected without valid credentials.",
+		metrics.CounterType, func(s *ServerStats) uint64 { return s.AuthFailures }},
+	{"distrox_http_auth_denials_total", "Number of requests rejected since the operation is not granted.",
+		metrics.CounterType, func(s *ServerStats) uint64 { return s.AuthDenials }},
+	{"distrox_http_rate_limit_rejects_total", "Number of requests rejected by the rate limit of the client.",
+		metrics.CounterType, func(s *ServerStats) uint64 { return s.RateLimitRejects }},
+	{"distrox_http_in_flight_rejects_total", "Number of requests rejected by the max in-flight requests.",
+		metrics.CounterType, func(s *ServerStats) uint64 { return s.InFlightRejects }},
+}
+
+// shardMetric maps a shard stat to a metric labeled by the shard
+type shardMetric struct {
+	name  string
+	help  string
+	typ   string
+	value func(stats *distrox.ShardStats) uint64
+}
+
+var shardMetrics = []shardMetric{
+	{"distrox_shard_hits_total", "Number of successfully found keys of the shard.", metrics.CounterType,
+		func(s *distrox.ShardStats) uint64 { return s.Hits }},
+	{"distrox_shard_misses_total", "Number of not found keys of the shard.", metrics.CounterType,
+		func(s *distrox.ShardStats) uint64 { return s.Misses }},
+	{"distrox_shard_collisions_total", "Number of key collisions of the shard.", metrics.CounterType,
+		func(s *distrox.ShardStats) uint64 { return s.Collisions }},
+	{"distrox_shard_evictions_total", "Number of entries of the shard evicted by a block overwrite.",
+		metrics.CounterType, func(s *distrox.ShardStats) uint64 { return s.Evictions }},
+	{"distrox_shard_expirations_total", "Number of entries of the shard found expired.", metrics.CounterType,
+		func(s *distrox.ShardStats) uint64 { return s.Expirations }},
+	{"distrox_shard_wraps_total", "Number of times the oldest block of the shard is overwritten.",
+		metrics.CounterType, func(s *distrox.ShardStats) uint64 { return s.Wraps }},
+	{"distrox_shard_entries", "Number of entries in the shard.", metrics.GaugeType,
+		func(s *distrox.ShardStats) uint64 { return s.EntriesCount }},
+	{"distrox_shard_bytes", "Size of the shard in bytes.", metrics.GaugeType,
+		func(s *distrox.ShardStats) uint64 { return s.CacheBytes }},
+	{"distrox_shard_write_cursor", "Position of the next write in the ring buffer of the shard.",
+		metrics.GaugeType, func(s *distrox.ShardStats) uint64 { return s.WriteCursor }},
+}
+
+// httpMetrics holds the request latencies partitioned by the route, method and status
+type httpMetrics struct {
+	latencies *metrics.HistogramVec
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		latencies: metrics.NewHistogramVec("distrox_http_request_duration_seconds",
+			"Latency of the HTTP requests in seconds.", metrics.DefaultBuckets, "route", "method", "status"),
+	}
+}
+
+// middleware observes the latency of the requests
+func (m *httpMetrics) middleware(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+
+	route := ctx.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	status := strconv.Itoa(ctx.Writer.Status())
+	m.latencies.With(route, ctx.Request.Method, status).Observe(time.Since(start).Seconds())
+}
+
+func (s *Server) metricsHandler(ctx *gin.Context) {
+	var b bytes.Buffer
+
+	var stats distrox.CacheStats
+	s.cache.LoadStats(&stats)
+	for _, m := range cacheMetrics {
+		metrics.Family(&b, m.name, m.help, m.typ)
+		metrics.Sample(&b, m.name, float64(m.value(&stats)))
+	}
+
+	if s.shardMetricsEnabled {
+		writeShardMetrics(&b, s.cache.ShardStats(), stats.ShardBlocks)
+	}
+
+	var serverStats ServerStats
+	s.loadStats(&serverStats)
+	for _, m := range serverMetrics {
+		metrics.Family(&b, m.name, m.help, m.typ)
+		metrics.Sample(&b, m.name, float64(m.value(&serverStats)))
+	}
+
+	s.httpMetrics.latencies.WriteCounts(&b, "distrox_http_requests_total", "Number of the HTTP requests.")
+	s.httpMetrics.latencies.Write(&b)
+
+	writeRuntimeMetrics(&b)
+
+	ctx.Data(http.StatusOK, metricsContentType, b.Bytes())
+}
+
+func writeShardMetrics(b *bytes.Buffer, shards []distrox.ShardStats, blocks []uint64) {
+	for _, m := range shardMetrics {
+		metrics.Family(b, m.name, m.help, m.typ)
+		for i := range shards {
+			metrics.Sample(b, m.name, float64(m.value(&shards[i])), shardLabel(i))
+		}
+	}
+
+	// blocks are reported with the global budget only
+	if len(blocks) == 0 {
+		return
+	}
+
+	metrics.Family(b, "distrox_shard_blocks", "Number of blocks used by the shard.", metrics.GaugeType)
+	for i, n := range blocks {
+		metrics.Sample(b, "distrox_shard_blocks", float64(n), shardLabel(i))
+	}
+}
+
+func shardLabel(i int) metrics.Label {
+	return metrics.Label{Name: "shard", Value: strconv.Itoa(i)}
+}
+
+func writeRuntimeMetrics(b *bytes.Buffer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	runtimeMetrics := []struct {
+		name  string
+		help  string
+		typ   string
+		value float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", metrics.GaugeType,
+			float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", metrics.GaugeType,
+			float64(ms.Alloc)},
+		{"go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.",
+			metrics.CounterType, float64(ms.TotalAlloc)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from system.", metrics.GaugeType,
+			float64(ms.Sys)},
+		{"go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", metrics.GaugeType,
+			float64(ms.HeapInuse)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", metrics.GaugeType,
+			float64(ms.HeapObjects)},
+		{"go_memstats_mallocs_total", "Total number of mallocs.", metrics.CounterType,
+			float64(ms.Mallocs)},
+		{"go_memstats_frees_total", "Total number of frees.", metrics.CounterType,
+			float64(ms.Frees)},
+		{"go_memstats_next_gc_bytes", "Number of heap bytes when the next GC will take place.",
+			metrics.GaugeType, float64(ms.NextGC)},
+		{"go_memstats_gc_cycles_total", "Number of completed GC cycles.", metrics.CounterType,
+			float64(ms.NumGC)},
+		{"go_memstats_gc_pause_seconds_total", "Total GC pause duration in seconds.", metrics.CounterType,
+			float64(ms.PauseTotalNs) / float64(time.Second)},
+	}
+
+	for _, m := range runtimeMetrics {
+		metrics.Family(b, m.name, m.help, m.typ)
+		metrics.Sample(b, m.name, m.value)
+	}
+
+	metrics.Family(b, "go_info", "Information about the Go environment.", metrics.GaugeType)
+	metrics.Sample(b, "go_info", 1, metrics.Label{Name: "version", Value: runtime.Version()})
+}
@@ -0,0 +1,187 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ziyasal/distroxy/pkg/distrox"
+)
+
+// maxRanges is the max number of the ranges of a Range header, the header is ignored with more
+const maxRanges = 16
+
+// byteRange is a range of the value bytes
+type byteRange struct {
+	start  int
+	length int
+}
+
+func (r byteRange) contentRange(size int) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses the Range header for the value of the size, the unsatisfiable ranges are skipped.
+// It reports false when the header is invalid, then it must be ignored.
+func parseRange(header string, size int) ([]byteRange, bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, false
+	}
+
+	specs := strings.Split(header[len(prefix):], ",")
+	if len(specs) > maxRanges {
+		return nil, false
+	}
+
+	var ranges []byteRange
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		i := strings.IndexByte(spec, '-')
+		if i < 0 {
+			return nil, false
+		}
+
+		first, last := spec[:i], spec[i+1:]
+		if first == "" {
+			// suffix range, the last n bytes
+			n, err := strconv.Atoi(last)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if n > size {
+				n = size
+			}
+			if n > 0 {
+				ranges = append(ranges, byteRange{start: size - n, length: n})
+			}
+			continue
+		}
+
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, false
+		}
+
+		end := size - 1
+		if last != "" {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, false
+			}
+			if end > size-1 {
+				end = size - 1
+			}
+		}
+
+		if start < size {
+			ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+		}
+	}
+
+	return ranges, true
+}
+
+// serveRanges serves the ranges of the value requested by the Range header with 206 Partial Content,
+// it reports false when the header is invalid so the whole value is served instead. The ranges are read
+// only if the value is not changed since its metadata is read, an ErrEntryChanged is returned otherwise.
+func (s *Server) serveRanges(
+	ctx *gin.Context, keyBuf []byte, meta distrox.EntryMeta, header string) (bool, error) {
+	ranges, ok := parseRange(header, meta.ValueSize)
+	if !ok {
+		return false, nil
+	}
+
+	if len(ranges) == 0 {
+		ctx.Header("Content-Range", fmt.Sprintf("bytes */%d", meta.ValueSize))
+		ctx.Status(http.StatusRequestedRangeNotSatisfiable)
+		return true, nil
+	}
+
+	valBuf := s.bpool.Get()
+	defer s.bpool.Put(valBuf)
+
+	var err error
+	h := ctx.Writer.Header()
+	writeHeaders(h, meta.Metadata)
+	h.Set("Accept-Ranges", "bytes")
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		valBuf, err = s.cache.GetRangeBinWithHash(valBuf[:0], keyBuf, r.start, r.length, meta.Hash)
+		if errors.Is(err, distrox.ErrEntryChanged) {
+			return true, err
+		}
+		if err != nil {
+			s.handleRangeError(ctx, err, meta.ValueSize)
+			return true, nil
+		}
+
+		h.Set("Content-Range", r.contentRange(meta.ValueSize))
+		h.Set("Content-Length", strconv.Itoa(len(valBuf)))
+		ctx.Status(http.StatusPartialContent)
+		if _, err := ctx.Writer.Write(valBuf); err != nil {
+			s.logger.Err("value range could not written to response", err)
+		}
+		return true, nil
+	}
+
+	// the ranges are read before the response is started, so an error can still be returned
+	parts := make([][]byte, len(ranges))
+	for i, r := range ranges {
+		valBuf, err = s.cache.GetRangeBinWithHash(valBuf, keyBuf, r.start, r.length, meta.Hash)
+		if errors.Is(err, distrox.ErrEntryChanged) {
+			return true, err
+		}
+		if err != nil {
+			s.handleRangeError(ctx, err, meta.ValueSize)
+			return true, nil
+		}
+		parts[i] = valBuf[len(valBuf)-r.length:]
+	}
+
+	contentType := h.Get("Content-Type")
+	mw := multipart.NewWriter(ctx.Writer)
+	h.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	ctx.Status(http.StatusPartialContent)
+
+	for i, r := range ranges {
+		partHeader := textproto.MIMEHeader{}
+		if contentType != "" {
+			partHeader.Set("Content-Type", contentType)
+		}
+		partHeader.Set("Content-Range", r.contentRange(meta.ValueSize))
+
+		pw, err := mw.CreatePart(partHeader)
+		if err == nil {
+			_, err = pw.Write(parts[i])
+		}
+		if err != nil {
+			s.logger.Err("value ranges could not written to response", err)
+			return true, nil
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		s.logger.Err("value ranges could not written to response", err)
+	}
+
+	return true, nil
+}
+
+// handleRangeError handles the errors of the range reads, the value might be removed
+// after the ranges are resolved against its size
+func (s *Server) handleRangeError(ctx *gin.Context, err error, size int) {
+	resetHeaders(ctx.Writer.Header())
+	if errors.Is(err, distrox.ErrInvalidRange) {
+		ctx.Writer.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		ctx.Status(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	s.handleError(ctx, err)
+}
@@ -0,0 +1,180 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ziyasal/distroxy/internal/pkg/common"
+)
+
+const (
+	// rateLimiterShards is the number of the bucket maps, so the clients don't contend on a single lock
+	rateLimiterShards = 64
+	// bucketSweepInterval is the interval the full buckets of the idle clients are removed
+	bucketSweepInterval = time.Minute
+)
+
+// RateLimitConfig is the limits of the requests, 0 rate or max in-flight disables the limit
+type RateLimitConfig struct {
+	// ReadRate is the number of the reads per second of a client, ReadBurst is the max number of them at once
+	ReadRate  float64
+	ReadBurst int
+	// WriteRate is the number of the writes and deletes per second of a client, WriteBurst is the max number
+	// of them at once
+	WriteRate  float64
+	WriteBurst int
+	// MaxInFlight is the max number of the requests served at the same time
+	MaxInFlight int64
+}
+
+// tokenBucket has the tokens of a client, it's refilled at the rate of the limiter
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketShard struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// rateLimiter limits the requests of each client with a token bucket
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	hash   common.Hasher
+	now    func() time.Time
+	shards [rateLimiterShards]bucketShard
+}
+
+// newRateLimiter returns the limiter of the rate and burst, nil for 0 rate
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	l := &rateLimiter{rate: rate, burst: float64(burst), hash: common.NewDefaultHasher(), now: time.Now}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+
+	return l
+}
+
+// allow takes a token of the client, it returns the time until a token is available when there isn't one
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	now := l.now()
+	s := &l.shards[l.hash.HashStr(client)%rateLimiterShards]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > bucketSweepInterval {
+		s.sweep(now, l.rate, l.burst)
+	}
+
+	b, ok := s.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		s.buckets[client] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep removes the buckets which are refilled, they are the same as the new ones
+func (s *bucketShard) sweep(now time.Time, rate, burst float64) {
+	for client, b := range s.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+			delete(s.buckets, client)
+		}
+	}
+	s.lastSweep = now
+}
+
+// limitRate returns the middleware limiting the requests of each client by the limiter, the client is
+// the authenticated credentials, the client certificate identity or the remote IP without them
+func (s *Server) limitRate(l *rateLimiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if l == nil {
+			return
+		}
+
+		client := rateLimitClient(ctx)
+		ok, wait := l.allow(client)
+		if ok {
+			return
+		}
+
+		atomic.AddUint64(&s.stats.rateLimitRejects, 1)
+		s.logger.Debug(fmt.Sprintf("rate limit of %s is exceeded", client))
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+	}
+}
+
+func rateLimitClient(ctx *gin.Context) string {
+	if p, ok := ctx.Get(principalContextKey); ok {
+		return "auth:" + p.(*principal).name
+	}
+
+	if identity := clientIdentity(ctx.Request); identity != "" {
+		return "cert:" + identity
+	}
+
+	// X-Forwarded-For isn't trusted, the client could pick its own bucket
+	host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if err != nil {
+		host = ctx.Request.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// limitInFlight rejects the requests once max in-flight requests are being served
+func (s *Server) limitInFlight(ctx *gin.Context) {
+	if s.maxInFlight <= 0 {
+		return
+	}
+
+	defer atomic.AddInt64(&s.inFlight, -1)
+	if atomic.AddInt64(&s.inFlight, 1) > s.maxInFlight {
+		atomic.AddUint64(&s.stats.inFlightRejects, 1)
+		s.logger.Debug("max in-flight requests are exceeded")
+		ctx.Header("Retry-After", "1")
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is overloaded"})
+		return
+	}
+
+	ctx.Next()
+}
+
+// pauseInFlight stops counting the request as in-flight while it waits, e.g. a long-poll,
+// so the waiting requests don't take the slots of the others. The returned func counts it again.
+func (s *Server) pauseInFlight() func() {
+	if s.maxInFlight <= 0 {
+		return func() {}
+	}
+
+	atomic.AddInt64(&s.inFlight, -1)
+	return func() { atomic.AddInt64(&s.inFlight, 1) }
+}
@@ -1,10 +1,14 @@
 package app
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ziyasal/distroxy/pkg/distrox"
@@ -17,93 +21,272 @@ const (
 	// path to cache.
 	cachePath  = apiBasePath + "kv"
 	statsPath  = apiBasePath + "stats"
+	eventsPath = apiBasePath + "events"
 	healthPath = "/health"
+
+	adminPath    = apiBasePath + "admin"
+	capacityPath = adminPath + "/capacity"
+	shardsPath   = adminPath + "/shards"
+	hotKeysPath  = adminPath + "/hotkeys"
+	slowLogPath  = adminPath + "/slowlog"
 )
 
+// maxEntryReads is the number of times an entry is read for a GET when it's overwritten while it's served
+const maxEntryReads = 3
+
 func (s *Server) newRouter() *gin.Engine {
 	r := gin.Default()
-	r.PUT(cachePath+"/:key", s.putHandler)
-	r.GET(cachePath+"/:key", s.getHandler)
-	r.DELETE(cachePath+"/:key", s.deleteHandler)
+	// the proxies are set once before the requests are served, so the client ip of the requests
+	// is the remote address like the one the rate limiter uses, nil proxies can't fail to parse
+	_ = r.SetTrustedProxies(nil)
+	if s.metricsEnabled {
+		r.Use(s.httpMetrics.middleware)
+	}
 
-	// exposes cache stats, this could be exported as prometheus metrics
-	r.GET(statsPath, s.statsHandler)
+	// health is served regardless of the credentials and the limits
 	r.GET(healthPath, s.healthHandler)
 
+	// the key routes authorize the key prefixes and limit the rate of the client after it's authenticated,
+	// the rest of the routes require admin
+	limited := r.Group("", s.limitInFlight)
+	admin := limited.Group("", s.authorize(opAdmin, nil))
+	if s.metricsEnabled {
+		admin.GET(metricsPath, s.metricsHandler)
+	}
+
+	// the key is the rest of the path, so it can contain slashes
+	readRate, writeRate := s.limitRate(s.readLimiter), s.limitRate(s.writeLimiter)
+	limited.PUT(cachePath+"/*key", s.authorize(opWrite, keyParam), writeRate, s.putHandler)
+	limited.GET(cachePath+"/*key", s.authorize(opRead, keyParam), readRate, s.getHandler)
+	limited.HEAD(cachePath+"/*key", s.authorize(opRead, keyParam), readRate, s.headHandler)
+	limited.DELETE(cachePath+"/*key", s.authorize(opDelete, keyParam), writeRate, s.deleteHandler)
+
+	// the event streams are long-lived, so they aren't counted as in-flight requests
+	r.GET(eventsPath, s.authorize(opRead, prefixParam), readRate, s.eventsHandler)
+
+	// exposes cache stats, they are exported as prometheus metrics on /metrics as well
+	admin.GET(statsPath, s.statsHandler)
+
+	admin.GET(capacityPath, s.capacityHandler)
+	admin.PUT(capacityPath, s.resizeHandler)
+	admin.GET(shardsPath, s.shardsHandler)
+	admin.PUT(shardsPath, s.reshardHandler)
+	admin.GET(hotKeysPath, s.hotKeysHandler)
+	admin.GET(slowLogPath, s.slowLogHandler)
+	admin.DELETE(slowLogPath, s.resetSlowLogHandler)
+
 	return r
 }
 
 func (s *Server) putHandler(ctx *gin.Context) {
-	key := ctx.Param("key")
+	key, encoding := keyParam(ctx)
 	keyBuf := s.bpool.Get()
 	defer s.bpool.Put(keyBuf)
 
-	if ok, msg := validateKey(keyBuf, key, s.cache.MaxKeySizeInBytes); !ok {
+	keyBuf, ok, msg := validateKey(keyBuf[:0], key, encoding, s.cache.MaxKeySizeInBytes)
+	if !ok {
 		s.logger.Debug(fmt.Sprintf("%s - op: %s", msg, ctx.Request.Method))
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": msg})
 		return
 	}
 
-	valueBytes, err := ioutil.ReadAll(ctx.Request.Body)
-	if err != nil {
-		s.logger.Err("An error occurred while value bytes from request: ", err)
-		ctx.JSON(http.StatusInternalServerError,
-			gin.H{"error": "An error occurred while value bytes from request"})
+	// the size of a chunked body is unknown, the max value size is enforced while it's read
+	size := ctx.Request.ContentLength
+	if ok, msg := validateValueSize(size, s.cache.MaxValueSizeInBytes); !ok {
+		s.logger.Debug(msg)
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": msg})
 		return
 	}
 
-	if ok, msg := validateValue(valueBytes, s.cache.MaxValueSizeInBytes); !ok {
+	metaBuf := s.bpool.Get()
+	defer s.bpool.Put(metaBuf)
+
+	metaBuf, ok = encodeHeaders(metaBuf[:0], ctx.Request.Header)
+	if !ok {
+		msg := fmt.Sprintf("more than %d %s* headers", maxMetaHeaders, metaHeaderPrefix)
 		s.logger.Debug(msg)
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": msg})
 		return
 	}
 
-	if err := s.cache.SetBin(keyBuf, valueBytes); err != nil {
+	hash, err := s.cache.SetReaderWithMetaHash(keyBuf, ctx.Request.Body, size, metaBuf)
+	if errors.Is(err, distrox.ErrEntryValueTooBig) {
+		msg := fmt.Sprintf("entry value size is bigger than max value size in bytes:%d",
+			s.cache.MaxValueSizeInBytes)
+		s.logger.Debug(msg)
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	if errors.Is(err, distrox.ErrMetadataTooBig) {
+		s.logger.Debug(err.Error())
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "stored headers are too big"})
+		return
+	}
+	if errors.Is(err, distrox.ErrNotAdmitted) {
+		// the cache is full and the key isn't accessed often enough to push out the others
+		s.logger.Debug(err.Error())
+		ctx.JSON(http.StatusConflict, gin.H{"error": "entry is not admitted, the cache is full"})
+		return
+	}
+	if err != nil {
 		msg := "An error occurred while storing valueBytes to cache"
 		s.logger.Err(msg, err)
 		ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": msg})
 		return
 	}
 
-	s.logger.Printf("stored '%s' in cache.", key)
+	s.logger.Printf("stored %q in cache.", keyBuf)
 
-	// return empty body with location header
+	// return empty body with location and etag headers, the etag is of the value written
+	// by this request even if another writer changed the entry since then
 	ctx.Status(http.StatusCreated)
-	ctx.Header("Location", fmt.Sprintf("%s/%s", cachePath, key))
+	ctx.Header("Location", keyLocation(keyBuf, encoding))
+	ctx.Header("ETag", etag(hash))
 }
 
+// keyParam returns the key of the catch-all key route and its encoding
+func keyParam(ctx *gin.Context) (string, string) {
+	return strings.TrimPrefix(ctx.Param("key"), "/"), ctx.Query(keyEncodingQuery)
+}
+
+// keyLocation returns the path of the key in the encoding of the request
+func keyLocation(key []byte, encoding string) string {
+	if encoding == keyEncodingBase64 {
+		return fmt.Sprintf("%s/%s?%s=%s", cachePath, base64.RawURLEncoding.EncodeToString(key),
+			keyEncodingQuery, keyEncodingBase64)
+	}
+
+	return cachePath + "/" + (&url.URL{Path: string(key)}).EscapedPath()
+}
+
+// getHandler streams the value with the headers stored with it, the conditional and range requests
+// are answered from the metadata of the entry before the value is read
 func (s *Server) getHandler(ctx *gin.Context) {
-	key := ctx.Param("key")
+	key, encoding := keyParam(ctx)
 	keyBuf := s.bpool.Get()
 	defer s.bpool.Put(keyBuf)
 
-	if ok, msg := validateKey(keyBuf, key, s.cache.MaxKeySizeInBytes); !ok {
+	keyBuf, ok, msg := validateKey(keyBuf[:0], key, encoding, s.cache.MaxKeySizeInBytes)
+	if !ok {
 		s.logger.Debug(fmt.Sprintf("%s - op: %s", msg, ctx.Request.Method))
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": msg})
 		return
 	}
-	valBuf := s.bpool.Get()
-	defer s.bpool.Put(valBuf)
 
-	valBuf, err := s.cache.GetBin(valBuf, keyBuf)
+	// a long-poll waits for the entry to change first
+	if ctx.Query(waitQuery) != "" && !s.waitForChange(ctx, keyBuf) {
+		return
+	}
+
+	// the entry is served again when it's overwritten after its metadata is read
+	for attempt := 1; ; attempt++ {
+		err := s.serveEntry(ctx, keyBuf)
+		if !errors.Is(err, distrox.ErrEntryChanged) {
+			return
+		}
+
+		resetHeaders(ctx.Writer.Header())
+		if attempt == maxEntryReads {
+			s.handleError(ctx, err)
+			return
+		}
+	}
+}
+
+// serveEntry serves the entry from its metadata, the value is read only if it's not changed since then,
+// otherwise an ErrEntryChanged is returned before anything is written
+func (s *Server) serveEntry(ctx *gin.Context, keyBuf []byte) error {
+	meta, err := s.cache.MetaBin(keyBuf)
 	if err != nil {
 		s.handleError(ctx, err)
+		return nil
+	}
+
+	tag := etag(meta.Hash)
+	ctx.Header("ETag", tag)
+	ctx.Header("Last-Modified", meta.Created.UTC().Format(http.TimeFormat))
+	if notModified(ctx.Request, tag, meta.Created) {
+		ctx.Status(http.StatusNotModified)
+		return nil
+	}
+
+	rangeHeader := ctx.GetHeader("Range")
+	if rangeHeader != "" && rangeApplies(ctx.GetHeader("If-Range"), tag, meta.Created) {
+		if served, err := s.serveRanges(ctx, keyBuf, meta, rangeHeader); served || err != nil {
+			return err
+		}
+	}
+
+	// the headers stored with the value are replayed
+	writeHeaders(ctx.Writer.Header(), meta.Metadata)
+	ctx.Header("Accept-Ranges", "bytes")
+	ctx.Header("Content-Length", strconv.Itoa(meta.ValueSize))
+	ctx.Status(http.StatusOK)
+
+	if _, err := s.cache.WriteToWithHash(keyBuf, ctx.Writer, meta.Hash); err != nil {
+		if errors.Is(err, distrox.ErrEntryChanged) {
+			return err
+		}
+
+		// the entry might be removed after its metadata is read
+		if !ctx.Writer.Written() {
+			resetHeaders(ctx.Writer.Header())
+			s.handleError(ctx, err)
+			return nil
+		}
+
+		// the response can't be changed once the value is started to be written
+		s.logger.Err("value could not written to response", err)
+		ctx.Abort()
+	}
+
+	return nil
+}
+
+// headHandler serves the metadata of the entry as headers without the value
+func (s *Server) headHandler(ctx *gin.Context) {
+	key, encoding := keyParam(ctx)
+	keyBuf := s.bpool.Get()
+	defer s.bpool.Put(keyBuf)
+
+	keyBuf, ok, msg := validateKey(keyBuf[:0], key, encoding, s.cache.MaxKeySizeInBytes)
+	if !ok {
+		s.logger.Debug(fmt.Sprintf("%s - op: %s", msg, ctx.Request.Method))
+		ctx.Status(http.StatusBadRequest)
 		return
 	}
 
-	_, err = ctx.Writer.Write(valBuf)
+	meta, err := s.cache.MetaBin(keyBuf)
 	if err != nil {
-		ctx.AbortWithStatusJSON(http.StatusInternalServerError,
-			gin.H{"error": "value bytes could not written to response"})
+		s.handleError(ctx, err)
+		return
 	}
+
+	tag := etag(meta.Hash)
+	ctx.Header("ETag", tag)
+	ctx.Header("Last-Modified", meta.Created.UTC().Format(http.TimeFormat))
+	if notModified(ctx.Request, tag, meta.Created) {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+
+	writeHeaders(ctx.Writer.Header(), meta.Metadata)
+	ctx.Header("Accept-Ranges", "bytes")
+	ctx.Header("Content-Length", strconv.Itoa(meta.ValueSize))
+	ctx.Header("Age", strconv.FormatInt(int64(time.Since(meta.Created)/time.Second), 10))
+	ctx.Header("Expires", time.Now().Add(meta.TTL).UTC().Format(http.TimeFormat))
+	ctx.Header("X-Distrox-Ttl", strconv.FormatInt(int64(meta.TTL/time.Second), 10))
+	ctx.Header("X-Distrox-Fragmented", strconv.FormatBool(meta.Fragmented))
+	ctx.Status(http.StatusOK)
 }
 
 func (s *Server) deleteHandler(ctx *gin.Context) {
-	key := ctx.Param("key")
+	key, encoding := keyParam(ctx)
 	keyBuf := s.bpool.Get()
 	defer s.bpool.Put(keyBuf)
 
-	if ok, msg := validateKey(keyBuf, key, s.cache.MaxKeySizeInBytes); !ok {
+	keyBuf, ok, msg := validateKey(keyBuf[:0], key, encoding, s.cache.MaxKeySizeInBytes)
+	if !ok {
 		s.logger.Debug(fmt.Sprintf("%s - op: %s", msg, ctx.Request.Method))
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": msg})
 		return
@@ -119,11 +302,152 @@ func (s *Server) deleteHandler(ctx *gin.Context) {
 	ctx.Status(http.StatusOK)
 }
 
+// statsResponse is the stats of the cache with the stats of the server
+type statsResponse struct {
+	distrox.CacheStats
+	ServerStats
+}
+
+// detailedStatsResponse is the stats response with the details requested by the detail query
+type detailedStatsResponse struct {
+	statsResponse
+	Shards  []distrox.ShardStats            `json:"shards,omitempty"`
+	Latency map[string]distrox.LatencyStats `json:"latency,omitempty"`
+}
+
+// statsHandler serves the cache stats, detail query adds the statistics of each shard (shards)
+// and the latencies of the operations (latency), e.g. ?detail=shards,latency
 func (s *Server) statsHandler(ctx *gin.Context) {
+	var stats statsResponse
+	s.cache.LoadStats(&stats.CacheStats)
+	s.loadStats(&stats.ServerStats)
+
+	detail := ctx.Query("detail")
+	if detail == "" {
+		ctx.JSON(http.StatusOK, stats)
+		return
+	}
+
+	resp := detailedStatsResponse{statsResponse: stats}
+	for _, d := range strings.Split(detail, ",") {
+		switch d {
+		case "shards":
+			resp.Shards = s.cache.ShardStats()
+		case "latency":
+			resp.Latency = s.cache.LatencyStats()
+		default:
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown stats detail: %s", d)})
+			return
+		}
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// capacityRequest is the body of the capacity update request
+type capacityRequest struct {
+	MaxBytes int `json:"max_bytes"`
+}
+
+func (s *Server) capacityHandler(ctx *gin.Context) {
 	var stats distrox.CacheStats
 	s.cache.LoadStats(&stats)
 
-	ctx.JSON(http.StatusOK, stats)
+	ctx.JSON(http.StatusOK, gin.H{
+		"max_bytes":      s.cache.MaxBytes(),
+		"capacity_bytes": stats.CapacityBytes,
+	})
+}
+
+func (s *Server) resizeHandler(ctx *gin.Context) {
+	var req capacityRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		s.logger.Debug(fmt.Sprintf("invalid capacity request: %v", err))
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid capacity request"})
+		return
+	}
+
+	if err := s.cache.Resize(req.MaxBytes); err != nil {
+		s.logger.Debug(fmt.Sprintf("cache could not resized: %v", err))
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.Printf("cache resized to %d bytes.", req.MaxBytes)
+
+	s.capacityHandler(ctx)
+}
+
+// shardsRequest is the body of the shard count update request
+type shardsRequest struct {
+	Count int `json:"count"`
+}
+
+func (s *Server) shardsHandler(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"count":      s.cache.ShardCount(),
+		"resharding": s.cache.Resharding(),
+	})
+}
+
+func (s *Server) reshardHandler(ctx *gin.Context) {
+	var req shardsRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		s.logger.Debug(fmt.Sprintf("invalid shards request: %v", err))
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid shards request"})
+		return
+	}
+
+	err := s.cache.Reshard(req.Count)
+	if errors.Is(err, distrox.ErrReshardInProgress) {
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		s.logger.Debug(fmt.Sprintf("cache could not resharded: %v", err))
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.Printf("cache is resharding to %d shards.", req.Count)
+
+	ctx.Status(http.StatusAccepted)
+}
+
+func (s *Server) hotKeysHandler(ctx *gin.Context) {
+	keys := s.cache.HotKeys()
+	if keys == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "hot key tracking is disabled"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// slowLogHandler serves the slow operations, the newest first. count query limits the number of them.
+func (s *Server) slowLogHandler(ctx *gin.Context) {
+	count := 0
+	if c := ctx.Query("count"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "count must be a positive integer"})
+			return
+		}
+		count = n
+	}
+
+	ops := s.cache.SlowLog(count)
+	if ops == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "slow log is disabled"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"entries": ops})
+}
+
+func (s *Server) resetSlowLogHandler(ctx *gin.Context) {
+	s.cache.ResetSlowLog()
+	ctx.Status(http.StatusOK)
 }
 
 func (s *Server) healthHandler(ctx *gin.Context) {
@@ -138,6 +462,14 @@ func (s *Server) handleError(ctx *gin.Context, err error) {
 		return
 	}
 
+	if errors.Is(err, distrox.ErrEntryChanged) {
+		// the entry is overwritten each time it's read, the client may try again
+		s.logger.Debug(fmt.Sprintf("entry is changed while it's read — %s", ctx.Request.Method))
+		ctx.Header("Retry-After", "1")
+		ctx.Status(http.StatusServiceUnavailable)
+		return
+	}
+
 	s.logger.Err(fmt.Sprintf("an error occurred while performing %s", ctx.Request.Method), err)
 	ctx.Status(http.StatusInternalServerError)
 }
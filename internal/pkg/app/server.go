@@ -2,7 +2,10 @@ package app
 
 import (
 	"context"
+	"errors"
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -26,13 +29,62 @@ type Server struct {
 	readTimeout    time.Duration
 	writeTimeout   time.Duration
 	bpool          common.Pooled
+
+	// shardMetricsEnabled exports the metrics of each shard labeled by the shard
+	shardMetricsEnabled bool
+	httpMetrics         *httpMetrics
+
+	// auth authenticates the requests, nil allows all of them
+	auth  *Auth
+	stats serverStats
+
+	tlsConfig TLSConfig
+	certs     *certReloader
+	stopTLS   chan struct{}
+
+	// the limiters of the reads and the writes of each client, nil disables them
+	readLimiter  *rateLimiter
+	writeLimiter *rateLimiter
+	maxInFlight  int64
+	inFlight     int64
+
+	// stopEvents ends the event streams on shutdown
+	stopEvents chan struct{}
+}
+
+// serverStats are the counters of the server, they are served with the cache stats
+type serverStats struct {
+	authFailures     uint64
+	authDenials      uint64
+	rateLimitRejects uint64
+	inFlightRejects  uint64
+}
+
+// ServerStats are the statistics of the server
+type ServerStats struct {
+	// AuthFailures is the number of requests rejected without valid credentials
+	AuthFailures uint64 `json:"auth_failures"`
+	// AuthDenials is the number of requests rejected since their credentials don't grant them
+	AuthDenials uint64 `json:"auth_denials"`
+	// RateLimitRejects is the number of requests rejected since the rate limit of the client is exceeded
+	RateLimitRejects uint64 `json:"rate_limit_rejects"`
+	// InFlightRejects is the number of requests rejected since max in-flight requests are being served
+	InFlightRejects uint64 `json:"in_flight_rejects"`
+}
+
+func (s *Server) loadStats(stats *ServerStats) {
+	stats.AuthFailures = atomic.LoadUint64(&s.stats.authFailures)
+	stats.AuthDenials = atomic.LoadUint64(&s.stats.authDenials)
+	stats.RateLimitRejects = atomic.LoadUint64(&s.stats.rateLimitRejects)
+	stats.InFlightRejects = atomic.LoadUint64(&s.stats.inFlightRejects)
 }
 
 type serverOption func(*Server)
 
 func NewServer(addr string, c *distrox.Cache, opts ...serverOption) *Server {
 	s := &Server{addr: addr, cache: c, logger: common.NewDefaultLogger(),
-		bpool: common.NewDefaultPooled(0)}
+		bpool: common.NewDefaultPooled(0), httpMetrics: newHTTPMetrics(), readTimeout: defaultServerRWTimeout,
+		writeTimeout: defaultServerRWTimeout, stopEvents: make(chan struct{})}
 
 	for _, opt := range opts {
 		opt(s)
@@ -47,12 +99,51 @@ func WithPprof(enabled bool) serverOption {
 	}
 }
 
+// WithMetrics enables the Prometheus metrics endpoint
+func WithMetrics(enabled bool) serverOption {
+	return func(h *Server) {
+		h.metricsEnabled = enabled
+	}
+}
+
+// WithShardMetrics enables the metrics of each shard, it's a series per shard for each metric
+func WithShardMetrics(enabled bool) serverOption {
+	return func(h *Server) {
+		h.shardMetricsEnabled = enabled
+	}
+}
+
+// WithAuth enables the authentication of the requests, see NewAuth
+func WithAuth(a *Auth) serverOption {
+	return func(h *Server) {
+		h.auth = a
+	}
+}
+
+// WithTLS serves the server over TLS with the certificate files, see TLSConfig
+func WithTLS(config TLSConfig) serverOption {
+	return func(h *Server) {
+		h.tlsConfig = config
+	}
+}
+
+// WithRateLimit limits the requests of each client and the in-flight requests, see RateLimitConfig
+func WithRateLimit(config RateLimitConfig) serverOption {
+	return func(h *Server) {
+		h.readLimiter = newRateLimiter(config.ReadRate, config.ReadBurst)
+		h.writeLimiter = newRateLimiter(config.WriteRate, config.WriteBurst)
+		h.maxInFlight = config.MaxInFlight
+	}
+}
+
 func WithServerReadTimeout(t time.Duration) serverOption {
 	return func(h *Server) {
 		h.readTimeout = t
 	}
 }
 
+// WithServerWriteTimeout sets the write timeout of the responses, 0 disables it.
+// The event streams are ended before it.
 func WithServerWriteTimeout(t time.Duration) serverOption {
 	return func(h *Server) {
 		h.writeTimeout = t
@@ -76,20 +167,50 @@ func WithMode(mode string) serverOption {
 }
 
 func (s *Server) Run() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		s.logger.Err("http server startup failed", err)
+		return err
+	}
+
+	return s.serve(ln)
+}
+
+// serve serves the requests accepted by the listener, over TLS when the certificate files are set
+func (s *Server) serve(ln net.Listener) error {
 	r := s.newRouter()
 
 	if s.pprofEnabled {
-		pprof.Register(r, "dev/pprof")
+		pprof.RouteRegister(r.Group("", s.authorize(opAdmin, nil)), "dev/pprof")
 	}
 
 	s.srv = &http.Server{
-		Addr:         s.addr,
 		Handler:      r,
-		ReadTimeout:  defaultServerRWTimeout,
-		WriteTimeout: defaultServerRWTimeout,
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+		ConnContext:  connContext,
+	}
+
+	var err error
+	if s.tlsConfig.enabled() {
+		if s.certs, err = newCertReloader(s.tlsConfig, s.logger); err != nil {
+			s.logger.Err("http server startup failed", err)
+			_ = ln.Close()
+			return err
+		}
+
+		s.stopTLS = make(chan struct{})
+		if s.tlsConfig.ReloadInterval > 0 {
+			go s.certs.watch(s.stopTLS)
+		}
+
+		s.srv.TLSConfig = s.certs.tlsConfig()
+		err = s.srv.ServeTLS(ln, "", "")
+	} else {
+		err = s.srv.Serve(ln)
 	}
 
-	if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err != nil && err != http.ErrServerClosed {
 		s.logger.Err("http server startup failed", err)
 		return err
 	}
@@ -97,11 +218,38 @@ func (s *Server) Run() error {
 	return nil
 }
 
+// connKey is the request context key of the connection the request is read from
+type connKey struct{}
+
+// connContext adds the connection to the context of its requests,
+// so the event streams can extend its write deadline
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// ReloadTLS reloads the certificate files, the connections already established keep the old certificates
+func (s *Server) ReloadTLS() error {
+	if s.certs == nil {
+		return errors.New("tls is not enabled")
+	}
+
+	return s.certs.reload()
+}
+
 func (s *Server) Shutdown(ctx context.Context) error {
-	err := s.cache.Close()
-	if err != nil {
-		s.logger.Err("Failed to close cache", err)
+	if s.stopTLS != nil {
+		close(s.stopTLS)
+	}
+
+	// the server waits for the open event streams otherwise
+	close(s.stopEvents)
+
+	// the in-flight handlers are drained before the cache memory is released
+	err := s.srv.Shutdown(ctx)
+
+	if e := s.cache.Close(); e != nil {
+		s.logger.Err("Failed to close cache", e)
 	}
 
-	return s.srv.Shutdown(ctx)
+	return err
 }
@@ -1,11 +1,35 @@
 package app
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -61,3 +85,1295 @@ func TestServerPut_Get_Delete_Get(t *testing.T) {
 	defer resp.Body.Close()
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 }
+
+func TestServerResize(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithShards(2), distrox.WithMaxBytes(4*64*1024))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	url := fmt.Sprintf("%s/v1/admin/capacity", ts.URL)
+
+	req, err := http.NewRequest("PUT", url, bytes.NewBufferString(`{"max_bytes": 1048576}`))
+	assert.Nil(t, err)
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"max_bytes": 1048576, "capacity_bytes": 1048576}`, string(body))
+
+	// invalid sizes are rejected and the capacity stays as it is
+	req, err = http.NewRequest("PUT", url, bytes.NewBufferString(`{"max_bytes": 0}`))
+	assert.Nil(t, err)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, 1048576, cache.MaxBytes())
+}
+
+func TestServerReshard(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithShards(2), distrox.WithMaxBytes(4*64*1024))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	url := fmt.Sprintf("%s/v1/admin/shards", ts.URL)
+
+	req, err := http.NewRequest("PUT", url, bytes.NewBufferString(`{"count": 3}`))
+	assert.Nil(t, err)
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	req, err = http.NewRequest("PUT", url, bytes.NewBufferString(`{"count": 4}`))
+	assert.Nil(t, err)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, 4, cache.ShardCount())
+}
+
+func TestServerShardStats(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithShards(2), distrox.WithStatsEnabled())
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Get(fmt.Sprintf("%s/v1/stats?detail=shards", ts.URL))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var stats struct {
+		Hits   uint64               `json:"hits"`
+		Shards []distrox.ShardStats `json:"shards"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, 2, len(stats.Shards))
+}
+
+func TestServerMetrics(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithShards(2), distrox.WithStatsEnabled())
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache,
+		WithMode("debug"), WithMetrics(true), WithShardMetrics(true))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Get(fmt.Sprintf("%s/v1/kv/missing", ts.URL))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = client.Get(fmt.Sprintf("%s/metrics", ts.URL))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body),
+		"# TYPE distrox_cache_misses_total counter\ndistrox_cache_misses_total 1\n")
+	assert.Contains(t, string(body), `distrox_shard_entries{shard="1"} 0`)
+	assert.Contains(t, string(body),
+		`distrox_http_requests_total{route="/v1/kv/*key",method="GET",status="404"} 1`)
+	assert.Contains(t, string(body), "go_goroutines ")
+
+	// the endpoint is not served unless it's enabled
+	ts2 := httptest.NewServer(NewServer("http://unused.host", cache, WithMode("debug")).newRouter())
+	defer ts2.Close()
+
+	resp, err = client.Get(fmt.Sprintf("%s/metrics", ts2.URL))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServerLatencyStats(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithShards(2), distrox.WithLatencyStats(true))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	assert.Nil(t, cache.Set("key", []byte("value")))
+
+	resp, err := client.Get(fmt.Sprintf("%s/v1/stats?detail=shards,latency", ts.URL))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var stats struct {
+		Shards  []distrox.ShardStats            `json:"shards"`
+		Latency map[string]distrox.LatencyStats `json:"latency"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, 2, len(stats.Shards))
+	assert.Equal(t, uint64(1), stats.Latency["set"].Count)
+
+	resp, err = client.Get(fmt.Sprintf("%s/v1/stats?detail=unknown", ts.URL))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServerHotKeys(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithHotKeys(2, 1, time.Minute))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	assert.Nil(t, cache.Set("hot", []byte("value")))
+	for i := 0; i < 10; i++ {
+		_, err = cache.Get("hot")
+		assert.Nil(t, err)
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%s/v1/admin/hotkeys", ts.URL))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var hotKeys struct {
+		Keys []distrox.HotKey `json:"keys"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&hotKeys))
+	assert.Equal(t, 1, len(hotKeys.Keys))
+	assert.Equal(t, "hot", hotKeys.Keys[0].Key)
+	assert.Equal(t, uint64(11), hotKeys.Keys[0].Count)
+}
+
+func TestServerSlowLog(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithSlowLog(time.Nanosecond, 2))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	url := fmt.Sprintf("%s/v1/admin/slowlog", ts.URL)
+
+	assert.Nil(t, cache.Set("key", []byte("value")))
+	_, err = cache.Get("key")
+	assert.Nil(t, err)
+
+	resp, err := client.Get(url + "?count=1")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var slowLog struct {
+		Entries []distrox.SlowOp `json:"entries"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&slowLog))
+	assert.Equal(t, 1, len(slowLog.Entries))
+	assert.Equal(t, "get", slowLog.Entries[0].Op)
+	assert.Equal(t, "key", slowLog.Entries[0].Key)
+	assert.Equal(t, 5, slowLog.Entries[0].ValueSize)
+
+	req, err := http.NewRequest("DELETE", url, nil)
+	assert.Nil(t, err)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 0, len(cache.SlowLog(0)))
+}
+
+func TestServerHead(t *testing.T) {
+	cache, err := distrox.NewCache()
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	assert.Nil(t, cache.Set("key", []byte("hello world!")))
+
+	resp, err := client.Head(fmt.Sprintf("%s/v1/kv/key", ts.URL))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(12), resp.ContentLength)
+	assert.Equal(t, "0", resp.Header.Get("Age"))
+	assert.NotEmpty(t, resp.Header.Get("Expires"))
+	assert.Equal(t, "false", resp.Header.Get("X-Distrox-Fragmented"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Empty(t, body)
+
+	resp, err = client.Head(fmt.Sprintf("%s/v1/kv/missing", ts.URL))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServerNotAdmitted(t *testing.T) {
+	cache, err := distrox.NewCache(
+		distrox.WithShards(1),
+		distrox.WithMaxBytes(128*1024),
+		distrox.WithMaxValueSize(1024*1024),
+		distrox.WithAdmissionFilter(func() distrox.AdmissionFilter { return distrox.NewTinyLFU(1024, 2) }),
+	)
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	// the ring is filled, so new keys have to pass the admission filter
+	value := make([]byte, 1024)
+	for i := 0; i < 200; i++ {
+		_ = cache.Set(fmt.Sprintf("key %d", i), value)
+	}
+
+	for _, tc := range []struct {
+		key   string
+		value []byte
+	}{
+		{"one-hit-wonder", value},
+		// streamed in fragments
+		{"big-one-hit-wonder", bytes.Repeat([]byte("a"), 200*1024)},
+	} {
+		url := fmt.Sprintf("%s/v1/kv/%s", ts.URL, tc.key)
+		req, err := http.NewRequest("PUT", url, bytes.NewReader(tc.value))
+		assert.Nil(t, err)
+
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode, tc.key)
+		assert.Empty(t, resp.Header.Get("Location"), tc.key)
+
+		resp, err = client.Get(url)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, tc.key)
+	}
+}
+
+func TestServerStoredHeaders(t *testing.T) {
+	cache, err := distrox.NewCache()
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	url := fmt.Sprintf("%s/v1/kv/doc", ts.URL)
+
+	req, err := http.NewRequest("PUT", url, bytes.NewBufferString(`{"hello":"world"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "identity")
+	req.Header.Set("X-Distrox-Meta-Owner", "team-a")
+	req.Header.Set("X-Unrelated", "dropped")
+
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	for _, method := range []string{"GET", "HEAD"} {
+		req, err = http.NewRequest(method, url, nil)
+		assert.Nil(t, err)
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "identity", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "team-a", resp.Header.Get("X-Distrox-Meta-Owner"))
+		assert.Empty(t, resp.Header.Get("X-Unrelated"))
+		assert.Equal(t, int64(17), resp.ContentLength)
+	}
+
+	req, err = http.NewRequest("PUT", url, bytes.NewBufferString("value"))
+	assert.Nil(t, err)
+	for i := 0; i <= maxMetaHeaders; i++ {
+		req.Header.Set(fmt.Sprintf("X-Distrox-Meta-Key%d", i), "v")
+	}
+
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServerConditionalGet(t *testing.T) {
+	cache, err := distrox.NewCache()
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	url := fmt.Sprintf("%s/v1/kv/key", ts.URL)
+
+	req, err := http.NewRequest("PUT", url, bytes.NewBufferString("hello world!"))
+	assert.Nil(t, err)
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	get := func(header, value string) *http.Response {
+		req, err := http.NewRequest("GET", url, nil)
+		assert.Nil(t, err)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	resp = get("", "")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp = get("If-None-Match", `"other", `+etag)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Empty(t, body)
+
+	resp = get("If-None-Match", `"other"`)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = get("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp = get("If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the value changes with its etag
+	req, err = http.NewRequest("PUT", url, bytes.NewBufferString("hello again!"))
+	assert.Nil(t, err)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+
+	resp = get("If-None-Match", etag)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServerRange(t *testing.T) {
+	// a few shards, so the fragments of the value don't evict each other
+	cache, err := distrox.NewCache(distrox.WithShards(4), distrox.WithMaxValueSize(1024*1024))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	url := fmt.Sprintf("%s/v1/kv/blob", ts.URL)
+
+	value := make([]byte, 200*1024)
+	for i := range value {
+		value[i] = byte(i % 251)
+	}
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(value))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "image/png")
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	get := func(rangeHeader string) *http.Response {
+		req, err := http.NewRequest("GET", url, nil)
+		assert.Nil(t, err)
+		req.Header.Set("Range", rangeHeader)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	resp = get("bytes=100000-100099")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 100000-100099/204800", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, value[100000:100100], body)
+
+	resp = get("bytes=-100")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 204700-204799/204800", resp.Header.Get("Content-Range"))
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, value[204700:], body)
+
+	resp = get("bytes=0-9, 60000-")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for _, want := range []struct {
+		contentRange string
+		value        []byte
+	}{
+		{"bytes 0-9/204800", value[:10]},
+		{"bytes 60000-204799/204800", value[60000:]},
+	} {
+		part, err := mr.NextPart()
+		assert.Nil(t, err)
+		assert.Equal(t, want.contentRange, part.Header.Get("Content-Range"))
+		assert.Equal(t, "image/png", part.Header.Get("Content-Type"))
+		got, err := ioutil.ReadAll(part)
+		assert.Nil(t, err)
+		assert.Equal(t, want.value, got)
+	}
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	resp = get("bytes=300000-")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	assert.Equal(t, "bytes */204800", resp.Header.Get("Content-Range"))
+
+	// an invalid header is ignored
+	resp = get("items=0-9")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, value, body)
+}
+
+func TestServerStreaming(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithShards(4), distrox.WithMaxValueSize(1024*1024))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	url := fmt.Sprintf("%s/v1/kv/stream", ts.URL)
+
+	value := make([]byte, 500*1024)
+	for i := range value {
+		value[i] = byte(i % 251)
+	}
+
+	// the body is sent chunked, so its size is unknown
+	put := func(body []byte) *http.Response {
+		req, err := http.NewRequest("PUT", url, ioutil.NopCloser(bytes.NewReader(body)))
+		assert.Nil(t, err)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	resp := put(value)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	resp, err = client.Get(url)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	assert.Equal(t, fmt.Sprint(len(value)), resp.Header.Get("Content-Length"))
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, value, body)
+
+	// the range is served only for the current entity tag
+	for ifRange, status := range map[string]int{etag: http.StatusPartialContent, `"other"`: http.StatusOK} {
+		req, err := http.NewRequest("GET", url, nil)
+		assert.Nil(t, err)
+		req.Header.Set("Range", "bytes=0-9")
+		req.Header.Set("If-Range", ifRange)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode)
+	}
+
+	resp = put(make([]byte, 1024*1024))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// the previous value is kept
+	resp, err = client.Get(url)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+}
+
+func TestServerKeyEncoding(t *testing.T) {
+	cache, err := distrox.NewCache()
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	do := func(method, path string, body []byte) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		assert.Nil(t, err)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	// the key contains slashes
+	resp := do("PUT", "/v1/kv/tenant/a/user/5", []byte("user 5"))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/v1/kv/tenant/a/user/5", resp.Header.Get("Location"))
+
+	got, err := cache.Get("tenant/a/user/5")
+	assert.Nil(t, err)
+	assert.Equal(t, "user 5", string(got))
+
+	// the binary key is percent-encoded, the same key is reached with base64
+	binaryKey := []byte{0x00, 0xff, '/', '?', '%', 'k'}
+	resp = do("PUT", "/v1/kv/%00%FF/%3F%25k", []byte("binary"))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/v1/kv/%00%FF/%3F%25k", resp.Header.Get("Location"))
+
+	got, err = cache.GetBin(nil, binaryKey)
+	assert.Nil(t, err)
+	assert.Equal(t, "binary", string(got))
+
+	for _, encoded := range []string{"AP8vPyVr", "AP8vPyVr=="} {
+		resp = do("GET", "/v1/kv/"+encoded+"?key_encoding=base64", nil)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "binary", string(body))
+	}
+
+	resp = do("PUT", "/v1/kv/AP8vPyVr?key_encoding=base64", []byte("binary 2"))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/v1/kv/AP8vPyVr?key_encoding=base64", resp.Header.Get("Location"))
+
+	resp = do("DELETE", "/v1/kv/AP8vPyVr?key_encoding=base64", nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = cache.GetBin(nil, binaryKey)
+	assert.Equal(t, distrox.ErrEntryNotFound, err)
+
+	// the decoded len of the key is validated
+	longKey := make([]byte, cache.MaxKeySizeInBytes)
+	encodedKey := base64.RawURLEncoding.EncodeToString(longKey)
+	for _, path := range []string{
+		"/v1/kv/",
+		"/v1/kv/not*base64?key_encoding=base64",
+		"/v1/kv/key?key_encoding=hex",
+		"/v1/kv/" + encodedKey + "?key_encoding=base64",
+	} {
+		resp = do("PUT", path, []byte("value"))
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+	}
+
+	resp = do("PUT", "/v1/kv/"+encodedKey[:len(encodedKey)-4]+"?key_encoding=base64", []byte("value"))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+// signToken returns the token of the claims signed with HS256
+func signToken(secret string, claims tokenClaims) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	token := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(token))
+	return token + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestServerAuth(t *testing.T) {
+	cache, err := distrox.NewCache()
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	auth, err := NewAuth(AuthConfig{
+		APIKeys: []APIKey{
+			{Name: "admin", Key: "admin-key", Ops: []string{"admin"}},
+			{Name: "tenant-a", Key: "tenant-a-key", Ops: []string{"read", "write"},
+				Prefixes: []string{"tenant/a/"}},
+		},
+		TokenSecret: "secret",
+	})
+	assert.Nil(t, err)
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"), WithAuth(auth))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	do := func(method, path string, header http.Header) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader([]byte("value")))
+		assert.Nil(t, err)
+		for name := range header {
+			req.Header.Set(name, header.Get(name))
+		}
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+	apiKey := func(key string) http.Header { return http.Header{"X-Api-Key": {key}} }
+	bearer := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+
+	tenantToken := signToken("secret", tokenClaims{Subject: "tenant-b", Ops: []string{"read", "delete"},
+		Prefixes: []string{"tenant/b/"}, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		header http.Header
+		status int
+	}{
+		// health doesn't require credentials
+		{"GET", "/health", nil, http.StatusOK},
+
+		{"PUT", "/v1/kv/tenant/a/1", nil, http.StatusUnauthorized},
+		{"PUT", "/v1/kv/tenant/a/1", apiKey("unknown-key"), http.StatusUnauthorized},
+		{"PUT", "/v1/kv/tenant/a/1", apiKey("tenant-a-key"), http.StatusCreated},
+		{"PUT", "/v1/kv/tenant/b/1", bearer("tenant-a-key"), http.StatusForbidden},
+		{"GET", "/v1/kv/tenant/a/1", bearer("tenant-a-key"), http.StatusOK},
+		{"DELETE", "/v1/kv/tenant/a/1", apiKey("tenant-a-key"), http.StatusForbidden},
+		{"GET", "/v1/stats", apiKey("tenant-a-key"), http.StatusForbidden},
+
+		// the prefix is checked against the decoded key
+		{"GET", "/v1/kv/dGVuYW50L2EvMQ?key_encoding=base64", apiKey("tenant-a-key"), http.StatusOK},
+		{"GET", "/v1/kv/dGVuYW50L2IvMQ?key_encoding=base64", apiKey("tenant-a-key"), http.StatusForbidden},
+
+		{"PUT", "/v1/kv/tenant/b/1", bearer(tenantToken), http.StatusForbidden},
+		{"HEAD", "/v1/kv/tenant/b/1", bearer(tenantToken), http.StatusNotFound},
+		{"DELETE", "/v1/kv/tenant/b/1", bearer(tenantToken), http.StatusNotFound},
+		{"GET", "/v1/kv/tenant/a/1", bearer(tenantToken), http.StatusForbidden},
+		{"GET", "/v1/kv/tenant/b/1", bearer(tenantToken[:len(tenantToken)-2]), http.StatusUnauthorized},
+		{"GET", "/v1/kv/tenant/b/1", bearer(signToken("other", tokenClaims{Ops: []string{"read"}})),
+			http.StatusUnauthorized},
+		{"GET", "/v1/kv/tenant/b/1", bearer(signToken("secret", tokenClaims{Ops: []string{"read"},
+			ExpiresAt: time.Now().Add(-time.Minute).Unix()})), http.StatusUnauthorized},
+
+		{"GET", "/v1/admin/capacity", apiKey("admin-key"), http.StatusOK},
+		{"GET", "/v1/kv/tenant/a/1", apiKey("admin-key"), http.StatusForbidden},
+	} {
+		resp := do(tc.method, tc.path, tc.header)
+		defer resp.Body.Close()
+		assert.Equal(t, tc.status, resp.StatusCode, "%s %s", tc.method, tc.path)
+		if tc.status == http.StatusUnauthorized {
+			assert.Equal(t, `Bearer realm="distrox"`, resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+
+	resp := do("GET", "/v1/stats", apiKey("admin-key"))
+	defer resp.Body.Close()
+	var stats ServerStats
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, ServerStats{AuthFailures: 5, AuthDenials: 7}, stats)
+
+	_, err = NewAuth(AuthConfig{APIKeys: []APIKey{{Name: "key", Key: "key", Ops: []string{"root"}}}})
+	assert.NotNil(t, err)
+	_, err = NewAuth(AuthConfig{})
+	assert.NotNil(t, err)
+}
+
+// testCert is a generated certificate with its key
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert generates a certificate signed by the parent, it's self-signed without a parent
+func newTestCert(t *testing.T, cn string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return &testCert{cert: cert, key: key, pem: certPem}
+}
+
+func (c *testCert) writeFiles(t *testing.T, certFile, keyFile string) {
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	assert.Nil(t, ioutil.WriteFile(certFile, c.pem, 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, keyPem, 0600))
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	ca := newTestCert(t, "distrox ca", nil, x509.ExtKeyUsageAny)
+	newTestCert(t, "server 1", ca, x509.ExtKeyUsageServerAuth).writeFiles(t, certFile, keyFile)
+	assert.Nil(t, ioutil.WriteFile(caFile, ca.pem, 0600))
+	client := newTestCert(t, "tenant-a-service", ca, x509.ExtKeyUsageClientAuth)
+	unknownClient := newTestCert(t, "tenant-b-service", ca, x509.ExtKeyUsageClientAuth)
+
+	cache, err := distrox.NewCache()
+	assert.Nil(t, err)
+
+	auth, err := NewAuth(AuthConfig{ClientCerts: []ClientCert{
+		{Identity: "tenant-a-service", Ops: []string{"read", "write"}, Prefixes: []string{"tenant/a/"}},
+	}})
+	assert.Nil(t, err)
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"), WithAuth(auth), WithTLS(TLSConfig{
+		CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ReloadInterval: 10 * time.Millisecond,
+	}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() { _ = srv.serve(ln) }()
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(cert *testCert) *http.Client {
+		config := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{cert.tlsCertificate()}
+		}
+		// a new transport makes a new connection, so the reloaded certificate is used
+		return &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: config}}
+	}
+
+	url := fmt.Sprintf("https://%s/v1/kv/", ln.Addr())
+	put := func(c *http.Client, key string) (*http.Response, error) {
+		req, err := http.NewRequest("PUT", url+key, bytes.NewReader([]byte("value")))
+		assert.Nil(t, err)
+		return c.Do(req)
+	}
+
+	// the identity of the client certificate is authorized
+	resp, err := put(newClient(client), "tenant/a/1")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "server 1", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	resp, err = put(newClient(client), "tenant/b/1")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = put(newClient(unknownClient), "tenant/a/1")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// the client certificate is required
+	_, err = put(newClient(nil), "tenant/a/1")
+	assert.NotNil(t, err)
+
+	// the changed files are reloaded
+	newTestCert(t, "server 2", ca, x509.ExtKeyUsageServerAuth).writeFiles(t, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, future, future))
+
+	assert.Eventually(t, func() bool {
+		resp, err := put(newClient(client), "tenant/a/1")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName == "server 2"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// an invalid file keeps the loaded certificates
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("invalid"), 0600))
+	assert.NotNil(t, srv.ReloadTLS())
+
+	newTestCert(t, "server 3", ca, x509.ExtKeyUsageServerAuth).writeFiles(t, certFile, keyFile)
+	assert.Nil(t, srv.ReloadTLS())
+
+	resp, err = put(newClient(client), "tenant/a/1")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "server 3", resp.TLS.PeerCertificates[0].Subject.CommonName)
+}
+
+func TestServerRateLimit(t *testing.T) {
+	cache, err := distrox.NewCache()
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	auth, err := NewAuth(AuthConfig{APIKeys: []APIKey{
+		{Name: "batch", Key: "batch-key", Ops: []string{"read", "write", "admin"}},
+		{Name: "web", Key: "web-key", Ops: []string{"read", "write", "delete"}},
+		{Name: "upload", Key: "upload-key", Ops: []string{"write"}},
+	}})
+	assert.Nil(t, err)
+
+	// the buckets aren't refilled during the test
+	limits := RateLimitConfig{ReadRate: 0.001, ReadBurst: 2, WriteRate: 0.001, WriteBurst: 1, MaxInFlight: 1}
+	srv := NewServer("http://unused.host", cache, WithMode("debug"), WithAuth(auth), WithRateLimit(limits))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	do := func(method, key string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+"/v1/kv/key", body)
+		assert.Nil(t, err)
+		req.Header.Set("X-Api-Key", key)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	for _, tc := range []struct {
+		method string
+		key    string
+		status int
+	}{
+		{"PUT", "batch-key", http.StatusCreated},
+		{"PUT", "batch-key", http.StatusTooManyRequests},
+		{"GET", "batch-key", http.StatusOK},
+		{"HEAD", "batch-key", http.StatusOK},
+		{"GET", "batch-key", http.StatusTooManyRequests},
+
+		// the buckets are separate for each client
+		{"GET", "web-key", http.StatusOK},
+		{"DELETE", "web-key", http.StatusOK},
+		{"PUT", "web-key", http.StatusTooManyRequests},
+	} {
+		resp := do(tc.method, tc.key, bytes.NewReader([]byte("value")))
+		defer resp.Body.Close()
+		assert.Equal(t, tc.status, resp.StatusCode, "%s %s", tc.method, tc.key)
+		if tc.status == http.StatusTooManyRequests {
+			assert.Equal(t, "1000", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// the body of the write isn't sent, so it's in-flight until the pipe is closed
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, err := http.NewRequest("PUT", ts.URL+"/v1/kv/slow", pr)
+		assert.Nil(t, err)
+		req.Header.Set("X-Api-Key", "upload-key")
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	_, err = pw.Write([]byte("value"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&srv.inFlight) == 1 }, 5*time.Second,
+		time.Millisecond)
+
+	// health isn't limited
+	resp, err := client.Get(ts.URL + "/health")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do("GET", "web-key", nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	assert.Nil(t, pw.Close())
+	<-done
+
+	req, err := http.NewRequest("GET", ts.URL+"/v1/stats", nil)
+	assert.Nil(t, err)
+	req.Header.Set("X-Api-Key", "batch-key")
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	var stats ServerStats
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, ServerStats{RateLimitRejects: 3, InFlightRejects: 1}, stats)
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2, 2)
+	l.now = func() time.Time { return now }
+
+	for _, want := range []bool{true, true, false} {
+		ok, _ := l.allow("client")
+		assert.Equal(t, want, ok)
+	}
+
+	ok, wait := l.allow("client")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.allow("client")
+	assert.True(t, ok)
+
+	// the refilled buckets are removed
+	s := &l.shards[l.hash.HashStr("client")%rateLimiterShards]
+	s.sweep(now.Add(500*time.Millisecond), l.rate, l.burst)
+	assert.Len(t, s.buckets, 1)
+	s.sweep(now.Add(time.Second), l.rate, l.burst)
+	assert.Empty(t, s.buckets)
+
+	assert.Nil(t, newRateLimiter(0, 10))
+}
+
+// readEvent reads the next Server-Sent Event of the stream, the comments and the fields
+// other than the event name and the data are skipped
+func readEvent(t *testing.T, r *bufio.Reader) (string, eventMessage) {
+	var name string
+	var msg eventMessage
+	for {
+		line, err := r.ReadString('\n')
+		if !assert.Nil(t, err) {
+			return name, msg
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return name, msg
+		case strings.HasPrefix(line, "event:"):
+			name = line[len("event:"):]
+		case strings.HasPrefix(line, "data:"):
+			assert.Nil(t, json.Unmarshal([]byte(line[len("data:"):]), &msg))
+		}
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithShards(4))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	auth, err := NewAuth(AuthConfig{APIKeys: []APIKey{{Name: "tenant-a", Key: "tenant-a-key",
+		Ops: []string{"read", "write", "delete"}, Prefixes: []string{"tenant/a/"}}}})
+	assert.Nil(t, err)
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"), WithAuth(auth),
+		WithServerWriteTimeout(3*time.Second))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	do := func(method, path string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader([]byte("value")))
+		assert.Nil(t, err)
+		req.Header.Set("X-Api-Key", "tenant-a-key")
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	// the prefix has to have one of the granted prefixes
+	for path, status := range map[string]int{
+		"/v1/events":                                      http.StatusForbidden,
+		"/v1/events?prefix=tenant/":                       http.StatusForbidden,
+		"/v1/events?prefix=tenant/b/":                     http.StatusForbidden,
+		"/v1/events?prefix=tenant/a/1&key_encoding=plain": http.StatusBadRequest,
+	} {
+		resp := do("GET", path)
+		assert.Equal(t, status, resp.StatusCode, path)
+		_ = resp.Body.Close()
+	}
+
+	// tenant/a/ in base64, the keys of the events are encoded the same
+	resp := do("GET", "/v1/events?prefix=dGVuYW50L2Ev&key_encoding=base64")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	for _, req := range []struct{ method, path string }{
+		{"PUT", "/v1/kv/tenant/a/1"},
+		{"PUT", "/v1/kv/tenant/a/2"},
+		{"DELETE", "/v1/kv/tenant/a/1"},
+	} {
+		r := do(req.method, req.path)
+		_ = r.Body.Close()
+	}
+
+	events := bufio.NewReader(resp.Body)
+	for _, want := range []struct{ name, key string }{
+		{"set", "dGVuYW50L2EvMQ"},
+		{"set", "dGVuYW50L2EvMg"},
+		{"delete", "dGVuYW50L2EvMQ"},
+	} {
+		name, msg := readEvent(t, events)
+		assert.Equal(t, want.name, name)
+		assert.Equal(t, want.name, msg.Type)
+		assert.Equal(t, want.key, msg.Key)
+		assert.False(t, msg.Time.IsZero())
+	}
+
+	var stats distrox.CacheStats
+	cache.LoadStats(&stats)
+	assert.Equal(t, uint64(1), stats.EventSubscribers)
+
+	// the connection isn't in the request context, so the stream is ended before the write timeout
+	start := time.Now()
+	_, err = ioutil.ReadAll(events)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 3*time.Second)
+
+	assert.Eventually(t, func() bool {
+		var stats distrox.CacheStats
+		cache.LoadStats(&stats)
+		return stats.EventSubscribers == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServerEventsOutliveWriteTimeout(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithShards(4))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"), WithServerWriteTimeout(time.Second))
+	ts := httptest.NewUnstartedServer(srv.newRouter())
+	ts.Config.WriteTimeout = time.Second
+	ts.Config.ConnContext = connContext
+	ts.Start()
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(ts.URL + "/v1/events?prefix=key")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the events published after the write timeout are streamed without a reconnect
+	time.Sleep(2500 * time.Millisecond)
+	assert.Nil(t, cache.Set("key 1", []byte("value")))
+
+	name, msg := readEvent(t, bufio.NewReader(resp.Body))
+	assert.Equal(t, "set", name)
+	assert.Equal(t, "key 1", msg.Key)
+}
+
+func TestServerWatch(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithShards(4))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		assert.Nil(t, err)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+	// poll starts the request and waits until it's watching the key
+	poll := func(path string) <-chan *http.Response {
+		responses := make(chan *http.Response, 1)
+		go func() { responses <- do("GET", path, "") }()
+
+		assert.Eventually(t, func() bool {
+			var stats distrox.CacheStats
+			cache.LoadStats(&stats)
+			return stats.Watchers == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		return responses
+	}
+
+	resp := do("GET", "/v1/kv/key?wait=1m5s0", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	// the missing key is waited to appear
+	responses := poll("/v1/kv/key?wait=3s")
+	resp = do("PUT", "/v1/kv/key", "value")
+	_ = resp.Body.Close()
+	tag := resp.Header.Get("ETag")
+
+	resp = <-responses
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "value", string(body))
+	assert.Equal(t, tag, resp.Header.Get("ETag"))
+
+	// the changed entry is served right away
+	resp = do("GET", "/v1/kv/key?wait=3s&version=1234", "")
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the same value doesn't change the version
+	version := strings.Trim(tag, `"`)
+	responses = poll("/v1/kv/key?wait=3s&version=" + version)
+	resp = do("PUT", "/v1/kv/key", "value")
+	_ = resp.Body.Close()
+	resp = do("PUT", "/v1/kv/key", "value 2")
+	_ = resp.Body.Close()
+
+	resp = <-responses
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "value 2", string(body))
+	tag = resp.Header.Get("ETag")
+
+	responses = poll("/v1/kv/key?wait=3s&version=" + url.QueryEscape(tag))
+	resp = do("DELETE", "/v1/kv/key", "")
+	_ = resp.Body.Close()
+	resp = <-responses
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// the unchanged entry is answered with 304 once the wait elapses
+	resp = do("PUT", "/v1/kv/key", "value")
+	_ = resp.Body.Close()
+	resp = do("GET", "/v1/kv/key?wait=100ms&version="+version, "")
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, strconv.Quote(version), resp.Header.Get("ETag"))
+
+	var stats distrox.CacheStats
+	cache.LoadStats(&stats)
+	assert.Empty(t, stats.Watchers)
+}
+
+func TestServerWatchInFlight(t *testing.T) {
+	cache, err := distrox.NewCache(distrox.WithShards(4))
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	srv := NewServer("http://unused.host", cache, WithMode("debug"),
+		WithRateLimit(RateLimitConfig{MaxInFlight: 1}))
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	assert.Nil(t, cache.Set("key", []byte("value")))
+
+	// the long-polls wait for the missing key
+	responses := make(chan *http.Response, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := client.Get(ts.URL + "/v1/kv/missing?wait=3s")
+			assert.Nil(t, err)
+			responses <- resp
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		var stats distrox.CacheStats
+		cache.LoadStats(&stats)
+		return stats.Watchers == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the waiting requests don't take the in-flight slot
+	resp, err := client.Get(ts.URL + "/v1/kv/key")
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Nil(t, cache.Set("missing", []byte("value")))
+	for i := 0; i < 2; i++ {
+		resp := <-responses
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
@@ -0,0 +1,186 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ziyasal/distroxy/internal/pkg/common"
+)
+
+// TLSConfig is the certificate files of the server, the server is served over plaintext without them
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mutual TLS, the client certificates signed by its CAs are required
+	ClientCAFile string
+	// ReloadInterval is the interval the files are checked for changes, 0 disables checking
+	ReloadInterval time.Duration
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+func (c TLSConfig) files() []string {
+	files := []string{c.CertFile, c.KeyFile}
+	if c.ClientCAFile != "" {
+		files = append(files, c.ClientCAFile)
+	}
+
+	return files
+}
+
+// certReloader serves the certificates loaded from the files, a reload replaces them
+// for the new connections only
+type certReloader struct {
+	config TLSConfig
+	logger common.Logger
+
+	// current is the *tls.Config of the loaded certificates
+	current atomic.Value
+
+	// mu serializes the reloads of SIGHUP and the file watcher
+	mu       sync.Mutex
+	modTimes []time.Time
+}
+
+func newCertReloader(config TLSConfig, logger common.Logger) (*certReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("tls requires both cert and key files")
+	}
+
+	r := &certReloader{config: config, logger: logger}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reload loads the certificates from the files, the loaded ones are kept when they are invalid
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes := make([]time.Time, 0, 3)
+	for _, file := range r.config.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	// invalid files are loaded again once they are changed
+	r.modTimes = modTimes
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls certificate could not loaded: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if r.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("client ca could not loaded: %w", err)
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no client ca certificate found in %s", r.config.ClientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.current.Store(config)
+
+	return nil
+}
+
+// tlsConfig returns the server config resolving the loaded certificates for each connection
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.current.Load().(*tls.Config).Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load().(*tls.Config), nil
+		},
+	}
+}
+
+// changed reports whether one of the files is modified since they are loaded
+func (r *certReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, file := range r.config.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// the file might be replaced at the moment, it's checked again later
+			return false
+		}
+		if !info.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch reloads the certificates when the files are changed until stop is closed
+func (r *certReloader) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+
+			if err := r.reload(); err != nil {
+				r.logger.Err("tls certificates could not reloaded", err)
+				continue
+			}
+			r.logger.Info("tls certificates are reloaded.")
+		}
+	}
+}
+
+// clientIdentity returns the identity of the verified client certificate of the request, it's the common name
+// of the subject or the first URI or DNS name of the certificate without it
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	default:
+		return ""
+	}
+}
@@ -1,43 +1,78 @@
 package app
 
 import (
+	"encoding/base64"
 	"fmt"
+	"strings"
 )
 
-func validateKey(keyBuf []byte, key string, max int64) (bool, string) {
+const (
+	// keyEncodingQuery is the query for the encoding of the key in the path, the key is percent-encoded
+	// with the path without it
+	keyEncodingQuery = "key_encoding"
+	// keyEncodingBase64 is the URL safe base64 encoding, the padding is optional
+	keyEncodingBase64 = "base64"
+)
+
+// decodeKey decodes the key with the encoding, appends it to keyBuf and returns it
+func decodeKey(keyBuf []byte, key, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return append(keyBuf, key...), nil
+	case keyEncodingBase64:
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+		if err != nil {
+			return keyBuf, fmt.Errorf("invalid base64 key: %v", err)
+		}
+		return append(keyBuf, decoded...), nil
+	default:
+		return keyBuf, fmt.Errorf("unknown key encoding: %s", encoding)
+	}
+}
+
+// validateKey decodes the key with the encoding, appends it to keyBuf and returns it.
+// The decoded key is validated, so a binary key has the same limits as a text one.
+func validateKey(keyBuf []byte, key, encoding string, max int64) ([]byte, bool, string) {
 	var msg string
-	if key == "" {
+	keyLen := len(keyBuf)
+	keyBuf, err := decodeKey(keyBuf, key, encoding)
+	if err != nil {
+		msg = err.Error()
+		return keyBuf, false, msg
+	}
+
+	if len(keyBuf) == keyLen {
 		msg = "empty key"
-		return false, msg
+		return keyBuf, false, msg
 	}
 
-	keyBuf = append(keyBuf, key...)
-	if int64(len(keyBuf)) < max {
-		return true, ""
+	if int64(len(keyBuf)-keyLen) < max {
+		return keyBuf, true, ""
 	}
 
 	msg = fmt.Sprintf(
 		"entry key size: %d is bigger than max key size in bytes:%d",
-		len(keyBuf), max)
+		len(keyBuf)-keyLen, max)
 
-	return false, msg
+	return keyBuf, false, msg
 }
 
-func validateValue(value []byte, max int64) (bool, string) {
+// validateValueSize validates the size of the value, a negative size is unknown
+// and it's validated while the value is read
+func validateValueSize(size int64, max int64) (bool, string) {
 	var msg string
-	valueLen := len(value)
-	if valueLen == 0 {
+	if size == 0 {
 		msg := "value is empty"
 		return false, msg
 	}
 
-	if int64(valueLen) < max {
+	if size < max {
 		return true, ""
 	}
 
 	msg = fmt.Sprintf(
 		"entry value size: %d is bigger than max value size in bytes:%d",
-		valueLen, max)
+		size, max)
 
 	return false, msg
 }
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// waitQuery is the query for the max duration a GET waits for the version of the entry to change
+	waitQuery = "wait"
+	// versionQuery is the query for the version the entry is compared to, it's the ETag of the entry
+	// with or without the quotes, empty for a missing entry
+	versionQuery = "version"
+
+	// maxWait caps the wait of a GET
+	maxWait = 5 * time.Minute
+)
+
+// entryVersion returns the version of the entry, it's the hash of the value as the ETag,
+// empty for a missing entry
+func (s *Server) entryVersion(key []byte) string {
+	meta, err := s.cache.MetaBin(key)
+	if err != nil {
+		return ""
+	}
+
+	return strconv.FormatUint(meta.Hash, 16)
+}
+
+// waitForChange blocks the GET until the version of the entry differs from the version of the request
+// or the wait elapses, it's bounded by the write timeout of the server. It reports whether the entry
+// is to be served, otherwise the response is written: 304 Not Modified when the wait elapses.
+// A watcher of the key is used while it waits, so the writes don't check the waiting requests,
+// and the request isn't counted as in-flight until it's woken up.
+func (s *Server) waitForChange(ctx *gin.Context, key []byte) bool {
+	wait, err := time.ParseDuration(ctx.Query(waitQuery))
+	if err != nil || wait < 0 {
+		msg := fmt.Sprintf("invalid wait: %s", ctx.Query(waitQuery))
+		s.logger.Debug(msg)
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return false
+	}
+
+	if wait > maxWait {
+		wait = maxWait
+	}
+	if s.writeTimeout > 0 && wait > eventsStreamDuration(s.writeTimeout) {
+		wait = eventsStreamDuration(s.writeTimeout)
+	}
+
+	version := strings.Trim(ctx.Query(versionQuery), `"`)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		// the watcher is created before the version is read, so a change in between isn't missed
+		w := s.cache.NewWatcher(key)
+		if s.entryVersion(key) != version {
+			w.Close()
+			return true
+		}
+
+		resume := s.pauseInFlight()
+		changed := false
+		select {
+		case <-w.Event():
+			changed = true
+		case <-timer.C:
+		case <-s.stopEvents:
+		case <-ctx.Request.Context().Done():
+		}
+		resume()
+
+		if changed {
+			// the version is read again, the value might be set to the same value
+			continue
+		}
+		w.Close()
+
+		// entries expire lazily, so an expired entry doesn't fire the watcher
+		if s.entryVersion(key) != version {
+			return true
+		}
+
+		if version != "" {
+			ctx.Header("ETag", strconv.Quote(version))
+		}
+		ctx.Status(http.StatusNotModified)
+		return false
+	}
+}
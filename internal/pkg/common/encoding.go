@@ -3,9 +3,11 @@ package common
 func EncodeEntry(key []byte, value []byte, timestamp int64, tsBuff *[]byte) [12]byte {
 	var kvLenBuf [12]byte
 
-	blob := *tsBuff
+	// reuse the buffer from its beginning, otherwise the timestamp is appended after the stale bytes
+	blob := (*tsBuff)[:0]
 
 	blob = MarshalUint64(blob, uint64(timestamp))
+	*tsBuff = blob
 
 	copy(kvLenBuf[0:], blob)
 
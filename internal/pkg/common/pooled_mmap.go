@@ -0,0 +1,16 @@
+package common
+
+import "errors"
+
+var ErrOffHeapUnsupported = errors.New("off-heap memory blocks are not supported on this platform")
+
+// OffHeapPooled is a Pooled whose blocks are allocated outside of the Go heap,
+// blocks must not be referenced after the pool is closed.
+type OffHeapPooled interface {
+	Pooled
+
+	// MappedBytes returns the number of bytes currently mapped by the pool
+	MappedBytes() uint64
+	// Close unmaps every block allocated by the pool
+	Close() error
+}
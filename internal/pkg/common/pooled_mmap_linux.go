@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// mmapPooled allocates fixed-size blocks via anonymous mmap so the memory
+// isn't accounted by the GC, released blocks are kept in a free list and
+// only unmapped when the pool is closed.
+type mmapPooled struct {
+	mu        sync.Mutex
+	blockSize int
+	free      [][]byte
+	mapped    [][]byte
+	closed    bool
+
+	mappedBytes uint64
+}
+
+// NewMmapPooled creates an off-heap pool which hands out blockSize-d blocks
+func NewMmapPooled(blockSize int) (OffHeapPooled, error) {
+	if blockSize <= 0 {
+		return nil, syscall.EINVAL
+	}
+
+	return &mmapPooled{blockSize: blockSize}, nil
+}
+
+// Get returns a free block or maps a new one, it panics when the memory could not be mapped
+// the same way as the runtime does when heap allocation fails. Once the pool is closed
+// nothing is mapped anymore, a heap block is returned so a late writer doesn't leak a mapping.
+func (p *mmapPooled) Get() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return make([]byte, 0, p.blockSize)
+	}
+
+	if n := len(p.free); n > 0 {
+		b := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		return b
+	}
+
+	b, err := syscall.Mmap(-1, 0, p.blockSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		panic("off-heap block could not be mapped: " + err.Error())
+	}
+
+	p.mapped = append(p.mapped, b)
+	atomic.AddUint64(&p.mappedBytes, uint64(p.blockSize))
+
+	return b
+}
+
+// Put returns the block to the free list, blocks not allocated by
+// mmap (or put after the pool is closed) are ignored.
+func (p *mmapPooled) Put(b []byte) {
+	if cap(b) != p.blockSize {
+		return
+	}
+
+	p.mu.Lock()
+	if !p.closed {
+		p.free = append(p.free, b[:0])
+	}
+	p.mu.Unlock()
+}
+
+func (p *mmapPooled) MappedBytes() uint64 {
+	return atomic.LoadUint64(&p.mappedBytes)
+}
+
+func (p *mmapPooled) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	var firstErr error
+	for i, b := range p.mapped {
+		if err := syscall.Munmap(b[:cap(b)]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		p.mapped[i] = nil
+	}
+
+	p.mapped = nil
+	p.free = nil
+	atomic.StoreUint64(&p.mappedBytes, 0)
+
+	return firstErr
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+// NewMmapPooled is only supported on linux
+func NewMmapPooled(_ int) (OffHeapPooled, error) {
+	return nil, ErrOffHeapUnsupported
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	cacheLineSize = 64
+	// maxReaderSlots caps the reader slots of a lock, since each shard has its own lock
+	maxReaderSlots = 64
+)
+
+// DistributedRWMutex is a reader-writer lock where readers are counted in cache line
+// padded slots instead of a single shared lock word. A reader takes the slot picked by the hash
+// of the key it reads, so readers of different keys on different CPUs mostly don't contend
+// with each other. Writers are serialized by a mutex, a writer announces itself with
+// the writer flag and waits for the readers of all slots to leave. Readers which see
+// the flag wait on the writer mutex until the writer unlocks, so writers are not starved
+// by a stream of readers and neither side spins.
+type DistributedRWMutex struct {
+	mu     sync.Mutex
+	writer int32
+	// readersLeft wakes up the waiting writer when a reader leaves
+	readersLeft chan struct{}
+
+	slots []readerSlot
+	mask  uint32
+}
+
+type readerSlot struct {
+	readers int64
+	_       [cacheLineSize - 8]byte
+}
+
+// NewDistributedRWMutex returns a lock with a reader slot per logical CPU up to 64
+func NewDistributedRWMutex() *DistributedRWMutex {
+	slots := 1
+	for slots < runtime.GOMAXPROCS(0) && slots < maxReaderSlots {
+		slots <<= 1
+	}
+
+	return &DistributedRWMutex{
+		readersLeft: make(chan struct{}, 1),
+		slots:       make([]readerSlot, slots),
+		mask:        uint32(slots - 1),
+	}
+}
+
+// RLock locks for reading on the slot picked by the hash and returns the slot,
+// RUnlock must be called with the returned slot. The high bits of the hash pick
+// the slot since the low bits pick the shard.
+func (m *DistributedRWMutex) RLock(h uint64) int {
+	slot := int(uint32(h>>32) & m.mask)
+
+	readers := &m.slots[slot].readers
+	for {
+		atomic.AddInt64(readers, 1)
+		if atomic.LoadInt32(&m.writer) == 0 {
+			return slot
+		}
+
+		// back off and wait for the writer to unlock
+		m.leave(readers)
+		m.mu.Lock()
+		m.mu.Unlock()
+	}
+}
+
+// RUnlock undoes a single RLock call with the slot returned by it
+func (m *DistributedRWMutex) RUnlock(slot int) {
+	m.leave(&m.slots[slot].readers)
+}
+
+// leave removes a reader from the slot and wakes up the writer if there is one waiting,
+// the writer sets its flag before it checks the slots, so either it sees the reader left
+// or the reader sees the flag.
+func (m *DistributedRWMutex) leave(readers *int64) {
+	if atomic.AddInt64(readers, -1) == 0 && atomic.LoadInt32(&m.writer) != 0 {
+		select {
+		case m.readersLeft <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Lock locks for writing, it waits for the readers of all slots to leave
+func (m *DistributedRWMutex) Lock() {
+	m.mu.Lock()
+	atomic.StoreInt32(&m.writer, 1)
+
+	for i := range m.slots {
+		for atomic.LoadInt64(&m.slots[i].readers) != 0 {
+			<-m.readersLeft
+		}
+	}
+}
+
+// Unlock unlocks for writing
+func (m *DistributedRWMutex) Unlock() {
+	atomic.StoreInt32(&m.writer, 0)
+	m.mu.Unlock()
+}
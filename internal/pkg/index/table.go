@@ -0,0 +1,319 @@
+package index
+
+const (
+	// MinCapacity is the smallest number of slots of a table
+	MinCapacity = 64
+
+	slotEmpty     = 0
+	slotFull      = 1
+	slotTombstone = 2
+
+	// tables are resized when used (live and tombstone) slots exceed 7/8 of the capacity
+	maxLoadNumerator   = 7
+	maxLoadDenominator = 8
+	// tables are shrunk when live slots drop below 1/8 of the capacity
+	shrinkDenominator = 8
+
+	// migrationStep is the number of slots of the previous table moved by each write while resizing
+	migrationStep = 16
+
+	// fibonacci hashing spreads the keys using the high bits of the product since
+	// the low bits of the keys (hashes) in a shard are the same
+	fibonacciMultiplier = 0x9E3779B97F4A7C15
+)
+
+// Table is an open-addressing hash table from uint64 keys to uint64 values stored in flat slices,
+// so the GC doesn't need to scan it. It's resized incrementally; while resizing, the previous
+// table is kept and writes move a few of its slots to the current table. It shrinks after deletes
+// and the tombstones are cleaned up on delete when possible or by rehashing.
+// Table is not safe for concurrent use, reads can run concurrently without writes.
+type Table struct {
+	cur *table
+	// old is the previous table while resizing, migrated is the next slot of it to be moved
+	old      *table
+	migrated int
+}
+
+type table struct {
+	keys []uint64
+	vals []uint64
+	ctrl []uint8
+
+	mask  uint64
+	shift uint
+
+	live       int
+	tombstones int
+}
+
+// New returns a table with room for at least capacity keys
+func New(capacity int) *Table {
+	return &Table{cur: newTable(capacityFor(capacity))}
+}
+
+// Get returns the value of the key
+func (t *Table) Get(k uint64) (uint64, bool) {
+	if i, ok := t.cur.find(k); ok {
+		return t.cur.vals[i], true
+	}
+
+	if t.old != nil {
+		if i, ok := t.old.find(k); ok {
+			return t.old.vals[i], true
+		}
+	}
+
+	return 0, false
+}
+
+// Put sets the value of the key
+func (t *Table) Put(k, v uint64) {
+	t.migrate()
+
+	if t.old != nil {
+		t.old.remove(k)
+	}
+
+	t.cur.put(k, v)
+	t.resize()
+}
+
+// Delete removes the key, it reports whether the key existed
+func (t *Table) Delete(k uint64) bool {
+	t.migrate()
+
+	deleted := t.cur.remove(k)
+	if t.old != nil && t.old.remove(k) {
+		deleted = true
+	}
+
+	t.resize()
+
+	return deleted
+}
+
+// Len returns the number of keys
+func (t *Table) Len() int {
+	if t.old != nil {
+		return t.cur.live + t.old.live
+	}
+
+	return t.cur.live
+}
+
+// Cap returns the number of slots including the previous table while resizing
+func (t *Table) Cap() int {
+	if t.old != nil {
+		return len(t.cur.ctrl) + len(t.old.ctrl)
+	}
+
+	return len(t.cur.ctrl)
+}
+
+// Bytes returns the memory used by the slots
+func (t *Table) Bytes() uint64 {
+	bytes := t.cur.bytes()
+	if t.old != nil {
+		bytes += t.old.bytes()
+	}
+
+	return bytes
+}
+
+// Range calls fn for each key and value until fn returns false,
+// the table must not be modified while ranging.
+func (t *Table) Range(fn func(k, v uint64) bool) {
+	if !t.cur.each(fn) {
+		return
+	}
+
+	if t.old != nil {
+		t.old.each(fn)
+	}
+}
+
+// Reset removes all keys and releases the slots
+func (t *Table) Reset() {
+	t.cur = newTable(MinCapacity)
+	t.old = nil
+	t.migrated = 0
+}
+
+// migrate moves the next slots of the previous table to the current table
+func (t *Table) migrate() {
+	if t.old == nil {
+		return
+	}
+
+	end := t.migrated + migrationStep
+	if end > len(t.old.ctrl) {
+		end = len(t.old.ctrl)
+	}
+
+	for ; t.migrated < end; t.migrated++ {
+		i := t.migrated
+		if t.old.ctrl[i] != slotFull {
+			continue
+		}
+
+		t.cur.put(t.old.keys[i], t.old.vals[i])
+		t.old.ctrl[i] = slotTombstone
+		t.old.live--
+		t.old.tombstones++
+	}
+
+	if t.migrated == len(t.old.ctrl) {
+		t.old = nil
+		t.migrated = 0
+	}
+}
+
+// resize starts resizing when the current table is too full or too empty,
+// the slots are rehashed in the same size when most of the used slots are tombstones.
+func (t *Table) resize() {
+	capacity := len(t.cur.ctrl)
+	used := t.cur.live + t.cur.tombstones
+
+	if t.old != nil {
+		// the current table is sized to take all keys before the migration completes,
+		// it's completed right away otherwise
+		if used*maxLoadDenominator < capacity*maxLoadNumerator {
+			return
+		}
+
+		for t.old != nil {
+			t.migrate()
+		}
+	}
+
+	newCapacity := capacity
+	switch {
+	case used*maxLoadDenominator >= capacity*maxLoadNumerator:
+		if t.cur.live*2 >= capacity {
+			newCapacity = capacity * 2
+		}
+	case t.cur.live*shrinkDenominator < capacity && capacity > MinCapacity:
+		newCapacity = capacity / 2
+	default:
+		return
+	}
+
+	t.old = t.cur
+	t.cur = newTable(newCapacity)
+	t.migrated = 0
+	t.migrate()
+}
+
+func newTable(capacity int) *table {
+	shift := uint(64)
+	for c := capacity; c > 1; c >>= 1 {
+		shift--
+	}
+
+	return &table{
+		keys:  make([]uint64, capacity),
+		vals:  make([]uint64, capacity),
+		ctrl:  make([]uint8, capacity),
+		mask:  uint64(capacity - 1),
+		shift: shift,
+	}
+}
+
+// capacityFor returns the power of two capacity keeping the keys below the max load
+func capacityFor(keys int) int {
+	capacity := MinCapacity
+	for keys*maxLoadDenominator >= capacity*maxLoadNumerator {
+		capacity <<= 1
+	}
+
+	return capacity
+}
+
+func (t *table) slot(k uint64) uint64 {
+	return (k * fibonacciMultiplier) >> t.shift & t.mask
+}
+
+// find returns the slot of the key
+func (t *table) find(k uint64) (uint64, bool) {
+	for i := t.slot(k); ; i = (i + 1) & t.mask {
+		switch t.ctrl[i] {
+		case slotEmpty:
+			return i, false
+		case slotFull:
+			if t.keys[i] == k {
+				return i, true
+			}
+		}
+	}
+}
+
+// put sets the value of the key reusing the first tombstone on the probe sequence
+func (t *table) put(k, v uint64) {
+	tombstone := -1
+	for i := t.slot(k); ; i = (i + 1) & t.mask {
+		switch t.ctrl[i] {
+		case slotFull:
+			if t.keys[i] == k {
+				t.vals[i] = v
+				return
+			}
+			continue
+		case slotTombstone:
+			if tombstone < 0 {
+				tombstone = int(i)
+			}
+			continue
+		}
+
+		// empty slot, the key doesn't exist
+		if tombstone >= 0 {
+			i = uint64(tombstone)
+			t.tombstones--
+		}
+
+		t.keys[i] = k
+		t.vals[i] = v
+		t.ctrl[i] = slotFull
+		t.live++
+
+		return
+	}
+}
+
+// remove deletes the key, the slot becomes empty when the next slot is empty
+// so the tombstones at the end of a probe sequence are cleaned up.
+func (t *table) remove(k uint64) bool {
+	i, ok := t.find(k)
+	if !ok {
+		return false
+	}
+
+	t.live--
+	if t.ctrl[(i+1)&t.mask] != slotEmpty {
+		t.ctrl[i] = slotTombstone
+		t.tombstones++
+		return true
+	}
+
+	t.ctrl[i] = slotEmpty
+	for i = (i - 1) & t.mask; t.ctrl[i] == slotTombstone; i = (i - 1) & t.mask {
+		t.ctrl[i] = slotEmpty
+		t.tombstones--
+	}
+
+	return true
+}
+
+func (t *table) each(fn func(k, v uint64) bool) bool {
+	for i, c := range t.ctrl {
+		if c == slotFull && !fn(t.keys[i], t.vals[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t *table) bytes() uint64 {
+	return uint64(len(t.keys)*8 + len(t.vals)*8 + len(t.ctrl))
+}
@@ -0,0 +1,99 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// shardKey returns keys with the same low bits like the key hashes of a shard
+func shardKey(i int) uint64 {
+	return uint64(i)<<16 | 0x2a
+}
+
+func TestTable_PutGetDelete(t *testing.T) {
+	tab := New(0)
+
+	const keysCount = 10000
+	for i := 0; i < keysCount; i++ {
+		tab.Put(shardKey(i), uint64(i))
+	}
+	assert.Equal(t, keysCount, tab.Len())
+
+	// overwriting keeps the length
+	tab.Put(shardKey(42), 4242)
+	assert.Equal(t, keysCount, tab.Len())
+
+	for i := 0; i < keysCount; i++ {
+		v, ok := tab.Get(shardKey(i))
+		assert.True(t, ok)
+		if i == 42 {
+			assert.Equal(t, uint64(4242), v)
+			continue
+		}
+		assert.Equal(t, uint64(i), v)
+	}
+
+	_, ok := tab.Get(shardKey(keysCount))
+	assert.False(t, ok)
+
+	for i := 0; i < keysCount; i += 2 {
+		assert.True(t, tab.Delete(shardKey(i)))
+	}
+	assert.False(t, tab.Delete(shardKey(0)))
+	assert.Equal(t, keysCount/2, tab.Len())
+
+	for i := 0; i < keysCount; i++ {
+		_, ok := tab.Get(shardKey(i))
+		assert.Equal(t, i%2 == 1, ok)
+	}
+
+	count := 0
+	tab.Range(func(k, v uint64) bool {
+		assert.Equal(t, uint64(1), v%2)
+		count++
+		return true
+	})
+	assert.Equal(t, keysCount/2, count)
+}
+
+func TestTable_ShrinkAndReset(t *testing.T) {
+	tab := New(0)
+
+	const keysCount = 10000
+	for i := 0; i < keysCount; i++ {
+		tab.Put(shardKey(i), uint64(i))
+	}
+	grown := tab.Bytes()
+
+	for i := 0; i < keysCount-10; i++ {
+		tab.Delete(shardKey(i))
+	}
+	assert.Less(t, tab.Bytes(), grown)
+	assert.Equal(t, 10, tab.Len())
+
+	for i := keysCount - 10; i < keysCount; i++ {
+		v, ok := tab.Get(shardKey(i))
+		assert.True(t, ok)
+		assert.Equal(t, uint64(i), v)
+	}
+
+	tab.Reset()
+	assert.Empty(t, tab.Len())
+	assert.Equal(t, MinCapacity, tab.Cap())
+}
+
+func TestTable_TombstoneCleanup(t *testing.T) {
+	tab := New(0)
+
+	// churn with a constant number of keys doesn't grow the table
+	for i := 0; i < 100000; i++ {
+		tab.Put(shardKey(i), uint64(i))
+		if i >= 32 {
+			tab.Delete(shardKey(i - 32))
+		}
+	}
+
+	assert.Equal(t, 32, tab.Len())
+	assert.LessOrEqual(t, tab.Cap(), 2*2*MinCapacity)
+}
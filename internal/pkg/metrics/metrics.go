@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric types of the Prometheus text exposition format
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+)
+
+// DefaultBuckets are the upper bounds of the latency buckets in seconds
+var DefaultBuckets = []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// Label is a name-value pair of a sample
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Family writes the HELP and TYPE lines of a metric
+func Family(b *bytes.Buffer, name, help, typ string) {
+	b.WriteString("# HELP ")
+	b.WriteString(name)
+	b.WriteByte(' ')
+	b.WriteString(strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	b.WriteString("\n# TYPE ")
+	b.WriteString(name)
+	b.WriteByte(' ')
+	b.WriteString(typ)
+	b.WriteByte('\n')
+}
+
+// Sample writes a sample of a metric with the labels
+func Sample(b *bytes.Buffer, name string, value float64, labels ...Label) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(l.Name)
+			b.WriteString(`="`)
+			b.WriteString(labelValueEscaper.Replace(l.Value))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Histogram counts the observed values in cumulative buckets, it's safe for concurrent use
+type Histogram struct {
+	buckets []float64
+	// counts holds the number of values of each bucket (not cumulative), the last one is +Inf
+	counts []uint64
+	count  uint64
+	// sumBits holds the bits of the float64 sum of the values
+	sumBits uint64
+}
+
+// NewHistogram returns a histogram with the sorted upper bounds of the buckets
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+// Observe adds a value to the histogram
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// Count returns the number of the observed values
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of the observed values
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+// Write writes the bucket, sum and count samples of the histogram
+func (h *Histogram) Write(b *bytes.Buffer, name string, labels ...Label) {
+	bucketLabels := make([]Label, len(labels)+1)
+	copy(bucketLabels, labels)
+
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		le := math.Inf(1)
+		if i < len(h.buckets) {
+			le = h.buckets[i]
+		}
+
+		bucketLabels[len(labels)] = Label{Name: "le", Value: formatFloat(le)}
+		Sample(b, name+"_bucket", float64(cumulative), bucketLabels...)
+	}
+
+	Sample(b, name+"_sum", h.Sum(), labels...)
+	Sample(b, name+"_count", float64(cumulative), labels...)
+}
+
+// HistogramVec is a set of histograms of a metric partitioned by the label values
+type HistogramVec struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	labels    []Label
+	histogram *Histogram
+}
+
+// NewHistogramVec returns a histogram vector of the metric partitioned by the label names
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+}
+
+// With returns the histogram of the label values, values must be given in the order of the label names
+func (v *HistogramVec) With(values ...string) *Histogram {
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s.histogram
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if s, ok = v.series[key]; ok {
+		return s.histogram
+	}
+
+	labels := make([]Label, len(v.labelNames))
+	for i, name := range v.labelNames {
+		labels[i] = Label{Name: name, Value: values[i]}
+	}
+
+	s = &series{labels: labels, histogram: NewHistogram(v.buckets)}
+	v.series[key] = s
+
+	return s.histogram
+}
+
+// Write writes the histograms of the vector
+func (v *HistogramVec) Write(b *bytes.Buffer) {
+	Family(b, v.name, v.help, HistogramType)
+	for _, s := range v.sorted() {
+		s.histogram.Write(b, v.name, s.labels...)
+	}
+}
+
+// WriteCounts writes the number of the observed values of each histogram as a counter
+func (v *HistogramVec) WriteCounts(b *bytes.Buffer, name, help string) {
+	Family(b, name, help, CounterType)
+	for _, s := range v.sorted() {
+		Sample(b, name, float64(s.histogram.Count()), s.labels...)
+	}
+}
+
+// sorted returns the series ordered by the label values, so the output is stable
+func (v *HistogramVec) sorted() []*series {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sorted := make([]*series, len(keys))
+	for i, k := range keys {
+		sorted[i] = v.series[k]
+	}
+	v.mu.RUnlock()
+
+	return sorted
+}
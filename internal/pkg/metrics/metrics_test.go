@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSample(t *testing.T) {
+	var b bytes.Buffer
+	Family(&b, "requests_total", "Number of requests", CounterType)
+	Sample(&b, "requests_total", 3, Label{Name: "path", Value: `/v1/"kv"`})
+	Sample(&b, "requests_total", 1.5)
+
+	want := "# HELP requests_total Number of requests\n" +
+		"# TYPE requests_total counter\n" +
+		"requests_total{path=\"/v1/\\\"kv\\\"\"} 3\n" +
+		"requests_total 1.5\n"
+	assert.Equal(t, want, b.String())
+}
+
+func TestHistogramVec(t *testing.T) {
+	v := NewHistogramVec("latency_seconds", "Latency", []float64{0.1, 1}, "route")
+	v.With("/b").Observe(0.05)
+	v.With("/b").Observe(0.5)
+	v.With("/b").Observe(5)
+	v.With("/a").Observe(1)
+
+	assert.Equal(t, uint64(3), v.With("/b").Count())
+	assert.Equal(t, 5.55, v.With("/b").Sum())
+
+	var b bytes.Buffer
+	v.Write(&b)
+	want := "# HELP latency_seconds Latency\n" +
+		"# TYPE latency_seconds histogram\n" +
+		"latency_seconds_bucket{route=\"/a\",le=\"0.1\"} 0\n" +
+		"latency_seconds_bucket{route=\"/a\",le=\"1\"} 1\n" +
+		"latency_seconds_bucket{route=\"/a\",le=\"+Inf\"} 1\n" +
+		"latency_seconds_sum{route=\"/a\"} 1\n" +
+		"latency_seconds_count{route=\"/a\"} 1\n" +
+		"latency_seconds_bucket{route=\"/b\",le=\"0.1\"} 1\n" +
+		"latency_seconds_bucket{route=\"/b\",le=\"1\"} 2\n" +
+		"latency_seconds_bucket{route=\"/b\",le=\"+Inf\"} 3\n" +
+		"latency_seconds_sum{route=\"/b\"} 5.55\n" +
+		"latency_seconds_count{route=\"/b\"} 3\n"
+	assert.Equal(t, want, b.String())
+
+	b.Reset()
+	v.WriteCounts(&b, "requests_total", "Requests")
+	assert.Contains(t, b.String(), "requests_total{route=\"/b\"} 3\n")
+}
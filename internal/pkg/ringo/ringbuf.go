@@ -3,35 +3,141 @@ package ringo
 import "github.com/ziyasal/distroxy/internal/pkg/common"
 
 // RingBuf is a sized-ring buffer consists of sized blocks.
+// Blocks are written in order, once there is no free block left
+// the oldest written block is overwritten by the next write.
 type RingBuf struct {
 	blocks    [][]byte
 	blockSize uint64
 
 	// writeCursor points to blocks for writing the next slice
 	writeCursor uint64
-	pool        common.Pooled
+	// wraps is a number of times the oldest block is overwritten
+	wraps uint64
+
+	// order holds the indexes of the written blocks from the oldest to the newest,
+	// the last one is the block pointed by the write cursor.
+	order []uint64
+	// free holds the indexes of the blocks which can be written without overwriting any block
+	free []uint64
+	// retired marks the block slots removed by shrinking, they are reused first while growing
+	retired      []bool
+	retiredCount uint64
+
+	pool common.Pooled
 }
 
 func (r *RingBuf) Reset() {
 	blocks := r.blocks
 
 	for i := range blocks {
+		if blocks[i] == nil {
+			continue
+		}
 
 		r.pool.Put(blocks[i])
 		blocks[i] = nil
 	}
 
-	r.writeCursor = 0
+	r.wraps = 0
+
+	// the first block is the current block and the others are written in order
+	r.free = r.free[:0]
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if !r.retired[i] {
+			r.free = append(r.free, uint64(i))
+		}
+	}
+
+	first := r.free[len(r.free)-1]
+	r.free = r.free[:len(r.free)-1]
+	r.order = append(r.order[:0], first)
+	r.writeCursor = first * r.blockSize
 }
 
 func (r *RingBuf) Pos() uint64 {
 	return r.writeCursor
 }
 
+// Wraps returns the number of times the oldest block is overwritten
+func (r *RingBuf) Wraps() uint64 {
+	return r.wraps
+}
+
+// Full reports whether the next block is going to overwrite the oldest block
+func (r *RingBuf) Full() bool {
+	return len(r.free) == 0
+}
+
+// Len returns the number of block slots including the retired ones,
+// block indexes are always smaller than Len.
 func (r *RingBuf) Len() uint64 {
 	return uint64(len(r.blocks))
 }
 
+// Blocks returns the number of blocks which are not retired
+func (r *RingBuf) Blocks() uint64 {
+	return uint64(len(r.blocks)) - r.retiredCount
+}
+
+// Grow adds count free blocks to the ring, retired block slots are reused first
+// so the block indexes stay small.
+func (r *RingBuf) Grow(count uint64) {
+	for i := 0; i < len(r.retired) && count > 0; i++ {
+		if r.retired[i] {
+			r.retired[i] = false
+			r.retiredCount--
+			r.free = append(r.free, uint64(i))
+			count--
+		}
+	}
+
+	for ; count > 0; count-- {
+		r.free = append(r.free, uint64(len(r.blocks)))
+		r.blocks = append(r.blocks, nil)
+		r.retired = append(r.retired, false)
+	}
+}
+
+// NextRetired returns the index of the block to be retired next while shrinking,
+// free blocks are retired first and then the oldest written blocks.
+// ok is false when the block pointed by the write cursor is the only one left.
+func (r *RingBuf) NextRetired() (uint64, bool) {
+	if n := len(r.free); n > 0 {
+		return r.free[n-1], true
+	}
+
+	if len(r.order) > 1 {
+		return r.order[0], true
+	}
+
+	return 0, false
+}
+
+// Retire removes the block from the ring and returns its memory to the pool,
+// the slot isn't written until the ring grows again. The block pointed
+// by the write cursor can't be retired.
+func (r *RingBuf) Retire(index uint64) bool {
+	if index == r.Current() || r.retired[index] {
+		return false
+	}
+
+	var ok bool
+	if r.order, ok = removeIndex(r.order, index); !ok {
+		if r.free, ok = removeIndex(r.free, index); !ok {
+			return false
+		}
+	}
+
+	if r.blocks[index] != nil {
+		r.pool.Put(r.blocks[index])
+		r.blocks[index] = nil
+	}
+	r.retired[index] = true
+	r.retiredCount++
+
+	return true
+}
+
 func (r *RingBuf) BlockSize() uint64 {
 	return r.blockSize
 }
@@ -40,27 +146,77 @@ func (r *RingBuf) Read(index uint64, lowBound uint64, highBound uint64) []byte {
 	return r.blocks[index][lowBound:highBound]
 }
 
+// Block returns the written part of the block at the index
+func (r *RingBuf) Block(index uint64) []byte {
+	return r.blocks[index]
+}
+
+// Current returns the index of the block pointed by the write cursor
+func (r *RingBuf) Current() uint64 {
+	return r.writeCursor / r.blockSize
+}
+
+// Written returns the indexes of the written blocks from the oldest to the newest,
+// the returned slice must not be modified.
+func (r *RingBuf) Written() []uint64 {
+	return r.order
+}
+
+// NextEvicted returns the index of the block which will be overwritten
+// by the next write of the given size, ok is false when no written block is going to be overwritten.
+func (r *RingBuf) NextEvicted(size uint64) (uint64, bool) {
+	_, _, blockIdx, newBlock := r.nextPosition(size)
+	if !newBlock || len(r.free) > 0 || len(r.blocks[blockIdx]) == 0 {
+		return 0, false
+	}
+
+	return blockIdx, true
+}
+
+// Release makes the written block free, so it's written before the oldest block is overwritten.
+// The block pointed by the write cursor can't be released.
+func (r *RingBuf) Release(index uint64) bool {
+	if index == r.Current() {
+		return false
+	}
+
+	var ok bool
+	if r.order, ok = removeIndex(r.order, index); !ok {
+		return false
+	}
+
+	r.blocks[index] = r.blocks[index][:0]
+	r.free = append(r.free, index)
+
+	return true
+}
+
+// removeIndex removes the block index from the list keeping the order of the others
+func removeIndex(list []uint64, index uint64) ([]uint64, bool) {
+	for i, idx := range list {
+		if idx == index {
+			return append(list[:i], list[i+1:]...), true
+		}
+	}
+
+	return list, false
+}
+
 func (r *RingBuf) Write(blobs ...[]byte) uint64 {
 	var blobLen uint64
 	for _, b := range blobs {
 		blobLen += uint64(len(b))
 	}
 
-	currentPosition := r.Pos()
-	nextPosition := currentPosition + blobLen
-	blockIdx := currentPosition / r.blockSize
-	newBlockIndex := nextPosition / r.blockSize
-
-	if newBlockIndex > blockIdx {
-		if newBlockIndex >= r.Len() {
-			currentPosition = 0
-			nextPosition = blobLen
-			blockIdx = 0
+	currentPosition, nextPosition, blockIdx, newBlock := r.nextPosition(blobLen)
+	if newBlock {
+		if n := len(r.free); n > 0 {
+			r.free = r.free[:n-1]
 		} else {
-			currentPosition = newBlockIndex * r.blockSize
-			nextPosition = currentPosition + blobLen
-			blockIdx = newBlockIndex
+			r.order = r.order[1:]
+			r.wraps++
 		}
+		r.order = append(r.order, blockIdx)
 
 		// reset block
 		r.blocks[blockIdx] = r.blocks[blockIdx][:0]
@@ -68,8 +224,7 @@ func (r *RingBuf) Write(blobs ...[]byte) uint64 {
 
 	block := r.blocks[blockIdx]
 	if block == nil {
-		block := r.pool.Get()
-		block = block[:0]
+		block = r.pool.Get()[:0]
 	}
 	for _, b := range blobs {
 		block = append(block, b...)
@@ -82,6 +237,28 @@ func (r *RingBuf) Write(blobs ...[]byte) uint64 {
 	return currentPosition
 }
 
+// nextPosition computes where the next blob of the size will be written,
+// newBlock is true when the blob doesn't fit into the current block.
+// A free block is used as the next block if there is any, otherwise the oldest block is used.
+func (r *RingBuf) nextPosition(size uint64) (current, next, blockIdx uint64, newBlock bool) {
+	current = r.Pos()
+	next = current + size
+	blockIdx = current / r.blockSize
+
+	if next/r.blockSize <= blockIdx {
+		return current, next, blockIdx, false
+	}
+
+	if n := len(r.free); n > 0 {
+		blockIdx = r.free[n-1]
+	} else {
+		blockIdx = r.order[0]
+	}
+
+	current = blockIdx * r.blockSize
+	return current, current + size, blockIdx, true
+}
+
 func (r *RingBuf) Cap() uint64 {
 	var c uint64
 	for _, block := range r.blocks {
@@ -91,10 +268,36 @@ func (r *RingBuf) Cap() uint64 {
 	return c
 }
 
+// OffHeapBytes returns bytes allocated outside of the Go heap for the blocks
+func (r *RingBuf) OffHeapBytes() uint64 {
+	if p, ok := r.pool.(common.OffHeapPooled); ok {
+		return p.MappedBytes()
+	}
+
+	return 0
+}
+
+// Close returns the blocks to the pool and releases the pool when it's off-heap,
+// the ring buffer must not be used after it's closed.
+func (r *RingBuf) Close() error {
+	r.Reset()
+
+	if p, ok := r.pool.(common.OffHeapPooled); ok {
+		return p.Close()
+	}
+
+	return nil
+}
+
 func NewRingBuf(blocks uint64, blockSize uint64, pool common.Pooled) *RingBuf {
-	return &RingBuf{
+	r := &RingBuf{
 		blocks:    make([][]byte, blocks),
+		retired:   make([]bool, blocks),
 		blockSize: blockSize,
 		pool:      pool,
 	}
+
+	r.Reset()
+
+	return r
 }
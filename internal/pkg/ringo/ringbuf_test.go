@@ -27,3 +27,95 @@ func TestRingBuf_ReadWrite(t *testing.T) {
 
 	assert.Equal(t, want, got)
 }
+
+func TestRingBuf_OffHeapReadWriteClose(t *testing.T) {
+	pool, err := common.NewMmapPooled(1024)
+	if err == common.ErrOffHeapUnsupported {
+		t.Skip(err)
+	}
+	assert.Nil(t, err)
+
+	r := NewRingBuf(4, 1024, pool)
+
+	want := []byte("hello off-heap world!")
+	pos := r.Write(want)
+	got := r.Read(pos/r.BlockSize(), pos%r.BlockSize(), pos%r.BlockSize()+uint64(len(want)))
+	assert.Equal(t, want, got)
+	assert.Equal(t, uint64(1024), r.OffHeapBytes())
+
+	// blocks are reused from the free list after reset
+	r.Reset()
+	r.Write(want)
+	assert.Equal(t, uint64(1024), r.OffHeapBytes())
+
+	assert.Nil(t, r.Close())
+	assert.Empty(t, r.OffHeapBytes())
+}
+
+func TestRingBuf_Release(t *testing.T) {
+	r := NewRingBuf(3, 1024, common.NewDefaultPooled(1024))
+
+	blob := make([]byte, 1000)
+	r.Write(blob)
+	r.Write(blob)
+	assert.Equal(t, []uint64{0, 1}, r.Written())
+	assert.False(t, r.Full())
+
+	// the block pointed by the write cursor can't be released
+	assert.False(t, r.Release(r.Current()))
+
+	assert.True(t, r.Release(0))
+	assert.Equal(t, []uint64{1}, r.Written())
+	assert.Empty(t, r.Block(0))
+
+	// the released block is written first, then the other free blocks
+	pos := r.Write(blob)
+	assert.Equal(t, uint64(0), pos/r.BlockSize())
+	pos = r.Write(blob)
+	assert.Equal(t, uint64(2), pos/r.BlockSize())
+	assert.True(t, r.Full())
+	assert.Empty(t, r.Wraps())
+
+	_, ok := r.NextEvicted(uint64(len(blob)))
+	assert.True(t, ok)
+
+	pos = r.Write(blob)
+	assert.Equal(t, uint64(1), pos/r.BlockSize())
+	assert.Equal(t, uint64(1), r.Wraps())
+}
+
+func TestRingBuf_GrowRetire(t *testing.T) {
+	r := NewRingBuf(2, 1024, common.NewDefaultPooled(1024))
+
+	blob := make([]byte, 1000)
+	r.Write(blob)
+	r.Write(blob)
+	assert.True(t, r.Full())
+
+	r.Grow(2)
+	assert.Equal(t, uint64(4), r.Blocks())
+	assert.False(t, r.Full())
+
+	// free blocks are retired first, then the oldest written block
+	idx, ok := r.NextRetired()
+	assert.True(t, ok)
+	assert.True(t, r.Retire(idx))
+	idx, ok = r.NextRetired()
+	assert.True(t, ok)
+	assert.True(t, r.Retire(idx))
+	idx, ok = r.NextRetired()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), idx)
+	assert.True(t, r.Retire(idx))
+
+	assert.Equal(t, uint64(1), r.Blocks())
+	assert.Equal(t, []uint64{1}, r.Written())
+	_, ok = r.NextRetired()
+	assert.False(t, ok)
+
+	// retired slots are reused while growing
+	r.Grow(1)
+	assert.Equal(t, uint64(4), r.Len())
+	pos := r.Write(blob)
+	assert.Equal(t, uint64(0), pos/r.BlockSize())
+}
@@ -0,0 +1,144 @@
+package distrox
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// blockBudget is a memory budget shared by the shards, shards borrow blocks from the budget
+// as they need more space and the globally oldest block is reclaimed from its shard once
+// the budget is exhausted, so hot shards can grow while cold shards shrink.
+type blockBudget struct {
+	mu sync.Mutex
+
+	total int64
+	used  int64
+
+	// queue holds the blocks in the order they are started to be written, the oldest first.
+	// Blocks overwritten or released since they are queued are skipped while reclaiming.
+	queue []budgetBlock
+	// pressure is the number of blocks to be reclaimed for the shards which couldn't borrow one
+	pressure int64
+
+	reclaims uint64
+}
+
+type budgetBlock struct {
+	s        *shard
+	blockIdx uint64
+	// gen is the generation of the block when it's started
+	gen uint64
+}
+
+func newBlockBudget(blocks int64) *blockBudget {
+	return &blockBudget{total: blocks}
+}
+
+// acquire borrows a block from the budget for the shard, it returns false when there is none left.
+// The shard overwrites its own oldest block then, the globally oldest block is reclaimed from
+// its shard later unless it belongs to the same shard. The shard lock must be held.
+func (b *blockBudget) acquire(s *shard) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.used < b.total {
+		b.used++
+		return true
+	}
+
+	for len(b.queue) > 0 && b.queue[0].s == s {
+		if s.reclaimable(b.queue[0].blockIdx, b.queue[0].gen) {
+			return false
+		}
+		b.pop()
+	}
+
+	if len(b.queue) > 0 {
+		b.pressure++
+	}
+
+	return false
+}
+
+// take borrows n blocks even if the budget is exhausted, the excess is reclaimed later
+func (b *blockBudget) take(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used += n
+	b.pressurize()
+}
+
+// release returns n blocks to the budget
+func (b *blockBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+}
+
+// resize changes the number of blocks of the budget
+func (b *blockBudget) resize(blocks int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.total = blocks
+	b.pressurize()
+}
+
+// started queues the block which is started to be written by the shard
+func (b *blockBudget) started(s *shard, blockIdx uint64, gen uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.queue = append(b.queue, budgetBlock{s: s, blockIdx: blockIdx, gen: gen})
+}
+
+// relieve reclaims the globally oldest blocks while there is pressure on the budget,
+// it must be called without holding any shard lock since it locks the owner shards.
+func (b *blockBudget) relieve() {
+	for {
+		b.mu.Lock()
+		if b.pressure <= 0 || len(b.queue) == 0 {
+			b.pressure = 0
+			b.mu.Unlock()
+			return
+		}
+
+		oldest := b.pop()
+		b.mu.Unlock()
+
+		if oldest.s.reclaim(oldest.blockIdx, oldest.gen) {
+			b.mu.Lock()
+			b.used--
+			b.pressure--
+			b.mu.Unlock()
+
+			atomic.AddUint64(&b.reclaims, 1)
+		}
+	}
+}
+
+// blocks returns the number of blocks of the budget
+func (b *blockBudget) blocks() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return uint64(b.total)
+}
+
+// pop removes the oldest block from the queue, mu must be held
+func (b *blockBudget) pop() budgetBlock {
+	oldest := b.queue[0]
+	b.queue[0] = budgetBlock{}
+	b.queue = b.queue[1:]
+
+	return oldest
+}
+
+// pressurize sets the pressure when more blocks are borrowed than the budget has, mu must be held
+func (b *blockBudget) pressurize() {
+	if over := b.used - b.total; over > b.pressure {
+		b.pressure = over
+	}
+}
@@ -3,25 +3,35 @@ package distrox
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ziyasal/distroxy/internal/pkg/common"
 )
 
 const (
-	defaultTTL        = int64(30 * time.Minute)
+	defaultTTL        = int64(30 * time.Minute / time.Second)
 	defaultShardCount = 512
 	maxCacheBytes     = 32 * 1024 * 1024
 
 	maxShardSizeInBytes        = 1073741824 // 1 GB
 	defaultMemBlockSizeInBytes = 64 * 1024
 
-	fragmentedEntryKeyLen = 16 // value hash + fragmentIdx
+	fragmentedEntryKeyLen = 24 // fragments id + value len + value hash
+	// fragmentSizeInBytes is the size of the fragments of a fragmented value but the last one
+	fragmentSizeInBytes = defaultValueSizeInBytes - 1
+
+	defaultCompactionMinDeadRatio = 0.5
 )
 
 var (
 	ErrEntryNotFound    = errors.New("entry not found")
 	ErrFragmentNotFound = errors.New("fragment of the value could not found")
+	// ErrNotAdmitted is returned when the admission filter refuses to store a new key
+	ErrNotAdmitted = errors.New("entry is not admitted")
+	// ErrEntryChanged is returned when the value doesn't have the expected hash anymore
+	ErrEntryChanged = errors.New("entry is changed")
 )
 
 type cacheOption func(cache *Cache) error
@@ -29,8 +39,8 @@ type cacheOption func(cache *Cache) error
 // Cache defines a struct to hold kv entries
 type Cache struct {
 	shardCount int
-	shards     []*shard
-	shardMask  uint64
+	// layout holds the current *shardSet, it's replaced while resharding
+	layout atomic.Value
 
 	clock  common.StoppableClock
 	hash   common.Hasher
@@ -39,8 +49,57 @@ type Cache struct {
 	ttlInSeconds int64
 
 	maxCacheBytes int
+	// resizeMu serializes resizes and reshards, shards are locked one by one while resizing
+	resizeMu sync.Mutex
 
 	statsEnabled bool
+	// latencyEnabled records the latencies of the operations
+	latencyEnabled bool
+	// slowLog records the operations slower than its threshold when it's set
+	slowLogThreshold time.Duration
+	slowLogMaxLen    int
+	slowLog          *slowLog
+	// timed measures the duration of the operations for the latency stats and the slow log
+	timed bool
+
+	// hotKeys tracks the top hotKeysK keys when hotKeysK is positive
+	hotKeysK          int
+	hotKeysSampleRate int
+	hotKeysDecay      time.Duration
+	hotKeys           *hotKeys
+
+	// offHeap allocates ring buffer blocks via mmap instead of the Go heap
+	offHeap bool
+
+	// disk tier stores entries evicted from the ring buffers when diskDir is set
+	diskDir             string
+	diskMaxBytes        int64
+	diskSegmentMaxBytes int64
+	diskPromotion       bool
+	disk                *diskTier
+
+	// budget is the memory budget shared by the shards when globalBudget is set
+	globalBudget bool
+	budget       *blockBudget
+
+	// newPolicy and newAdmission create the eviction policy and admission filter of each shard
+	newPolicy    func() EvictionPolicy
+	newAdmission func() AdmissionFilter
+
+	// compaction releases mostly-dead blocks every compactionInterval when it's positive
+	compactionInterval     time.Duration
+	compactionMinDeadRatio float64
+
+	// events publishes the keyspace changes to the subscribers, each of them buffers eventBufferSize events
+	eventBufferSize int
+	events          *eventBus
+
+	// done stops the background jobs (compaction, migration) on close
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
 
 	MaxKeySizeInBytes   int64
 	MaxValueSizeInBytes int64
@@ -60,25 +119,60 @@ func NewCache(opts ...cacheOption) (*Cache, error) {
 		ttlInSeconds:  defaultTTL,
 		statsEnabled:  true,
 
+		diskSegmentMaxBytes: defaultDiskSegmentSizeInBytes,
+
+		compactionMinDeadRatio: defaultCompactionMinDeadRatio,
+
+		eventBufferSize: defaultEventBufferSize,
+
 		MaxKeySizeInBytes:   defaultKeySizeInBytes,
 		MaxValueSizeInBytes: defaultValueSizeInBytes,
 		bpool:               common.NewDefaultPooled(0),
+		done:                make(chan struct{}),
 	}
 
 	// apply options
 	for _, opt := range opts {
 		err := opt(c)
 		if err != nil {
-			return nil, errors.New("cache could not created")
+			return nil, fmt.Errorf("cache could not created: %w", err)
+		}
+	}
+
+	if c.diskDir != "" {
+		disk, err := newDiskTier(c.diskDir, c.diskMaxBytes, c.diskSegmentMaxBytes, c.logger)
+		if err != nil {
+			return nil, err
 		}
+		c.disk = disk
+	}
+
+	if c.slowLogThreshold > 0 {
+		c.slowLog = newSlowLog(c.slowLogThreshold, c.slowLogMaxLen)
+	}
+	c.timed = c.latencyEnabled || c.slowLog != nil
+
+	if c.hotKeysK > 0 {
+		c.hotKeys = newHotKeys(c.hotKeysK, c.hotKeysSampleRate, int64(c.hotKeysDecay/time.Second), c.clock)
+	}
+
+	if c.globalBudget {
+		c.budget = newBlockBudget(c.budgetBlocks(c.maxCacheBytes))
 	}
 
+	c.events = newEventBus(c.eventBufferSize, c.hash)
+
 	// initialize shard related fields
 	err := c.initShards()
 	if err != nil {
 		return nil, err
 	}
 
+	if c.compactionInterval > 0 {
+		c.wg.Add(1)
+		go c.compactPeriodically()
+	}
+
 	return c, nil
 }
 
@@ -93,55 +187,269 @@ func (c *Cache) Set(k string, v []byte) error {
 	return c.SetBin([]byte(k), v)
 }
 
+// SetBin saves entry under the byte array key, once the cache is full the entry
+// might not be stored when an admission filter is set, an ErrNotAdmitted is returned then.
 func (c *Cache) SetBin(key []byte, entry []byte) error {
-	if len(entry) > defaultValueSizeInBytes {
-		return c.setFragmented(key, entry)
+	return c.SetBinWithMeta(key, entry, nil)
+}
+
+// SetBinWithMeta saves entry under the byte array key with the metadata, the metadata is an opaque
+// blob of up to 1KB which is returned by GetBinWithMeta and MetaBin with the entry.
+func (c *Cache) SetBinWithMeta(key []byte, entry []byte, metadata []byte) error {
+	if !c.timed {
+		return c.set(key, entry, metadata)
+	}
+
+	start := time.Now()
+	err := c.set(key, entry, metadata)
+
+	op := opSet
+	if storedValueLen(entry, metadata) > defaultValueSizeInBytes {
+		op = opFragmentedSet
 	}
+	c.observe(op, key, len(entry), start)
 
-	return c.setBin(key, entry, false)
+	return err
+}
+
+func (c *Cache) set(key []byte, entry []byte, metadata []byte) error {
+	if len(metadata) > maxMetadataSizeInBytes {
+		return ErrMetadataTooBig
+	}
+
+	if c.hotKeys != nil {
+		c.hotKeys.sample(key, c.hash)
+	}
+
+	if !c.admit(key) {
+		return ErrNotAdmitted
+	}
+
+	if err := c.setValue(key, entry, metadata); err != nil {
+		return err
+	}
+
+	c.events.publish(EventSet, key)
+	return nil
+}
+
+// setValue stores the value in fragments when it doesn't fit into a block with its metadata
+func (c *Cache) setValue(key []byte, entry []byte, metadata []byte) error {
+	if storedValueLen(entry, metadata) > defaultValueSizeInBytes {
+		return c.setFragmented(key, entry, metadata)
+	}
+
+	if len(metadata) == 0 {
+		return c.setBin(key, entry, 0)
+	}
+
+	valueBuf := c.bpool.Get()
+	defer c.bpool.Put(valueBuf)
+
+	valueBuf = appendMetadata(valueBuf[:0], metadata)
+	valueBuf = append(valueBuf, entry...)
+
+	return c.setBin(key, valueBuf, entryHasMetadata)
 }
 
 // GetBin gets an entry with byte array key,
 // if retBuf is passed entry value can be filled to it
 func (c *Cache) GetBin(retBuf []byte, key []byte) ([]byte, error) {
-	retBuf, isBigEntry, err := c.getBin(retBuf, key)
+	v, _, err := c.GetBinWithMeta(retBuf, key)
+	return v, err
+}
+
+// GetBinWithMeta gets an entry with byte array key and the metadata stored with it,
+// the metadata is nil when the entry is stored without metadata.
+func (c *Cache) GetBinWithMeta(retBuf []byte, key []byte) ([]byte, []byte, error) {
+	if !c.timed {
+		v, metadata, _, err := c.get(retBuf, key)
+		return v, metadata, err
+	}
+
+	start := time.Now()
+	v, metadata, fragmented, err := c.get(retBuf, key)
+
+	// the value is appended to retBuf unless it's fragmented
+	op, valueSize := opGet, len(v)-len(retBuf)
+	if fragmented {
+		op, valueSize = opFragmentedGet, len(v)
+	}
+	if err != nil {
+		valueSize = 0
+	}
+	c.observe(op, key, valueSize, start)
+
+	return v, metadata, err
+}
+
+// get reads the entry and the metadata stored with it and reports whether it's fragmented
+func (c *Cache) get(retBuf []byte, key []byte) ([]byte, []byte, bool, error) {
+	if c.hotKeys != nil {
+		c.hotKeys.sample(key, c.hash)
+	}
+
+	retBufLen := len(retBuf)
+	retBuf, flags, err := c.getBin(retBuf, key)
 
 	if err != nil {
-		return retBuf, err
+		return retBuf, nil, false, err
 	}
 
-	if isBigEntry {
+	var metadata []byte
+	if flags&entryHasMetadata != 0 {
+		m, value, ok := splitMetadata(retBuf[retBufLen:])
+		if !ok {
+			return nil, nil, false, errInvalidMetadata
+		}
+
+		// the metadata is copied since the value is moved over it
+		metadata = append([]byte(nil), m...)
+		retBuf = retBuf[:retBufLen+copy(retBuf[retBufLen:], value)]
+	}
+
+	if flags&entryFragmented != 0 {
+		// fragmented entry stats are counted by the shard of the metadata entry
+		s := c.shardSet().shard(c.hash.Hash(key))
+		if s.statsEnabled {
+			atomic.AddUint64(&s.fragmentedGets, 1)
+		}
+
 		//pass retBuf nil here because it has metadata value to be processed
-		return c.getFragmented(nil, retBuf)
+		retBuf, err = c.getFragmented(nil, retBuf[retBufLen:], s)
+		return retBuf, metadata, true, err
 	}
 
-	return retBuf, nil
+	return retBuf, metadata, false, nil
 }
 
 // CacheStats returns cache's statistics
 func (c *Cache) LoadStats(stats *CacheStats) {
-	for _, shard := range c.shards {
-		shard.loadStats(stats)
+	c.shardSet().each(func(s *shard) {
+		s.loadStats(stats)
+	})
+
+	if c.budget != nil {
+		stats.BudgetBlocks += c.budget.blocks()
+		stats.Reclaims += atomic.LoadUint64(&c.budget.reclaims)
+	}
+
+	if c.disk != nil {
+		stats.DiskBytes += c.disk.bytes()
+		stats.DiskSegments += c.disk.segmentsLen()
+	}
+
+	stats.EventSubscribers += c.events.subscribers()
+	stats.DroppedSubscribers += atomic.LoadUint64(&c.events.droppedSubscribers)
+	stats.Watchers += uint64(atomic.LoadInt32(&c.events.watcherCount))
+}
+
+// ShardStats returns the statistics of each shard entries are written to
+func (c *Cache) ShardStats() []ShardStats {
+	ss := c.shardSet()
+
+	stats := make([]ShardStats, len(ss.shards))
+	for i, s := range ss.shards {
+		stats[i] = s.shardStats()
 	}
+
+	return stats
 }
 
 // Del removes the key
 func (c *Cache) Del(key string) error {
-	hashedKey := c.hash.HashStr(key)
-	return c.shards[hashedKey&c.shardMask].del(hashedKey)
+	if c.timed || c.events.active() {
+		return c.DelBin([]byte(key))
+	}
+
+	return c.del(c.hash.HashStr(key))
 }
 
 // Del removes the key
 func (c *Cache) DelBin(key []byte) error {
-	hashedKey := c.hash.Hash(key)
-	return c.shards[hashedKey&c.shardMask].del(hashedKey)
+	if !c.timed {
+		return c.delBin(key)
+	}
+
+	start := time.Now()
+	err := c.delBin(key)
+	c.observe(opDel, key, 0, start)
+
+	return err
+}
+
+// delBin removes the key and publishes its delete event
+func (c *Cache) delBin(key []byte) error {
+	err := c.del(c.hash.Hash(key))
+	if err == nil {
+		c.events.publish(EventDelete, key)
+	}
+
+	return err
+}
+
+// observe records the duration of the operation since start in the latency
+// histograms of the shard of the key and in the slow log when it's slow
+func (c *Cache) observe(op latencyOp, key []byte, valueSize int, start time.Time) {
+	d := time.Since(start)
+	h := c.hash.Hash(key)
+	ss := c.shardSet()
+
+	if c.latencyEnabled {
+		ss.shard(h).latency.observe(op, d)
+	}
+
+	if c.slowLog != nil && d >= c.slowLog.threshold {
+		c.slowLog.add(SlowOp{
+			Time:      start,
+			Op:        latencyOpNames[op],
+			Key:       string(key),
+			ValueSize: valueSize,
+			Shard:     int(h & ss.mask),
+			Duration:  d,
+		})
+	}
+}
+
+// del removes the key from both layouts while resharding, the previous layout goes first
+// so the migration can't move the entry to the current layout after it's deleted.
+// The shard is retried on the new layout when the layout is replaced after it's loaded.
+func (c *Cache) del(hashedKey uint64) error {
+	ss := c.shardSet()
+
+	var err error
+	removed := false
+	for {
+		if ss.prev != nil && ss.prev.shard(hashedKey).remove(hashedKey) {
+			removed = true
+		}
+
+		if err = ss.shard(hashedKey).del(hashedKey); !errors.Is(err, errShardMigrated) {
+			break
+		}
+		ss = c.nextShardSet(ss)
+	}
+
+	if removed && errors.Is(err, ErrEntryNotFound) {
+		return nil
+	}
+
+	return err
 }
 
 // Reset empties all cache shards
 func (c *Cache) Reset() error {
-	for i := range c.shards {
+	c.shardSet().each(func(s *shard) {
 		// return error from shard
-		c.shards[i].reset()
+		s.reset()
+	})
+
+	if c.hotKeys != nil {
+		c.hotKeys.reset()
+	}
+
+	if c.disk != nil {
+		return c.disk.reset()
 	}
 
 	return nil
@@ -150,175 +458,472 @@ func (c *Cache) Reset() error {
 // Len computes number of entries in cache
 func (c *Cache) Len() uint64 {
 	var length uint64
-	for _, shard := range c.shards {
-		length += shard.len()
-	}
+	c.shardSet().each(func(s *shard) {
+		length += s.len()
+	})
 	return length
 }
 
-// Close is used to signal a shutdown of the cache to ensure cleanup
+// Resize changes the max size of the cache at runtime, shards grow by adding blocks to their
+// ring buffers and shrink by evicting the oldest blocks first. Shards are resized one by one,
+// so only the shard being resized is locked.
+func (c *Cache) Resize(maxBytes int) error {
+	if maxBytes <= 0 {
+		return ErrZeroBytesShardSize
+	}
+
+	shardSizeInBytes := uint64((maxBytes + c.shardCount - 1) / c.shardCount)
+	if shardSizeInBytes >= maxShardSizeInBytes {
+		return fmt.Errorf(
+			"shard size:%d should be smaller than max shard size: %d",
+			shardSizeInBytes, maxShardSizeInBytes)
+	}
+
+	c.resizeMu.Lock()
+	defer c.resizeMu.Unlock()
+
+	if c.budget != nil {
+		c.budget.resize(c.budgetBlocks(maxBytes))
+		c.budget.relieve()
+		c.maxCacheBytes = maxBytes
+
+		return nil
+	}
+
+	// shards of the previous layout are closed once they are migrated
+	blocks := (shardSizeInBytes + defaultMemBlockSizeInBytes - 1) / defaultMemBlockSizeInBytes
+	for _, s := range c.shardSet().shards {
+		s.resize(blocks)
+	}
+
+	c.maxCacheBytes = maxBytes
+
+	return nil
+}
+
+// MaxBytes returns the max size of the cache
+func (c *Cache) MaxBytes() int {
+	c.resizeMu.Lock()
+	defer c.resizeMu.Unlock()
+
+	return c.maxCacheBytes
+}
+
+// Compact compacts a block with at least the configured ratio of dead bytes in each shard
+// and returns the number of compacted blocks. Live entries of the block are rewritten at
+// the head of the ring, so the space of the block can be reused before the oldest block is overwritten.
+func (c *Cache) Compact() int {
+	compacted := 0
+	for _, s := range c.shardSet().shards {
+		if s.compact(c.compactionMinDeadRatio) {
+			compacted++
+		}
+	}
+
+	if c.budget != nil {
+		c.budget.relieve()
+	}
+
+	return compacted
+}
+
+func (c *Cache) compactPeriodically() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.compactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Compact()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Close is used to signal a shutdown of the cache to ensure cleanup, it's safe to call it more than once
 func (c *Cache) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.close()
+	})
+
+	return c.closeErr
+}
+
+func (c *Cache) close() error {
 	c.clock.Stop()
 
-	return nil
+	close(c.done)
+	c.wg.Wait()
+
+	var err error
+	c.shardSet().each(func(s *shard) {
+		if e := s.close(); e != nil && err == nil {
+			err = e
+		}
+	})
+
+	if c.disk != nil {
+		if e := c.disk.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
 }
 
 // initShards initializes shards with computed values
 func (c *Cache) initShards() error {
-	c.shards = make([]*shard, c.shardCount)
-	c.shardMask = uint64(c.shardCount - 1)
+	shards, err := c.newShards(c.shardCount)
+	if err != nil {
+		return err
+	}
 
-	maxBytes := c.maximumShardSizeInBytes()
+	c.layout.Store(newShardSet(shards, nil))
 
-	for i := 0; i < c.shardCount; i++ {
-		s, err := newShard(maxBytes,
-			defaultMemBlockSizeInBytes,
-			c.ttlInSeconds,
-			uint64(maxShardSizeInBytes),
-			c.clock,
-			c.logger,
-			c.statsEnabled)
+	return nil
+}
+
+// newShards creates count shards sharing the max cache size
+func (c *Cache) newShards(count int) ([]*shard, error) {
+	shards := make([]*shard, count)
+
+	cfg := shardConfig{
+		shardSizeInBytes:    uint64((c.maxCacheBytes + count - 1) / count),
+		memBlockSizeInBytes: defaultMemBlockSizeInBytes,
+		maxShardSizeInBytes: maxShardSizeInBytes,
+		ttlInSeconds:        c.ttlInSeconds,
+		clock:               c.clock,
+		logger:              c.logger,
+		hash:                c.hash,
+		statsEnabled:        c.statsEnabled,
+		latencyEnabled:      c.latencyEnabled,
+		offHeap:             c.offHeap,
+		disk:                c.disk,
+		diskPromotion:       c.diskPromotion,
+		newPolicy:           c.newPolicy,
+		newAdmission:        c.newAdmission,
+		budget:              c.budget,
+		events:              c.events,
+	}
+
+	for i := 0; i < count; i++ {
+		s, err := newShard(cfg)
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		c.shards[i] = s
+		shards[i] = s
 	}
 
-	return nil
+	return shards, nil
+}
+
+// budgetBlocks returns the number of blocks of the global budget for the max size
+func (c *Cache) budgetBlocks(maxBytes int) int64 {
+	return int64((maxBytes + defaultMemBlockSizeInBytes - 1) / defaultMemBlockSizeInBytes)
+}
+
+// shardSet returns the current layout of the shards
+func (c *Cache) shardSet() *shardSet {
+	return c.layout.Load().(*shardSet)
+}
+
+// nextShardSet returns the layout which replaces ss once the shards of ss are retired,
+// the shards are retired before the layout is stored, so it waits for the reshard to store it.
+func (c *Cache) nextShardSet(ss *shardSet) *shardSet {
+	if next := c.shardSet(); next != ss {
+		return next
+	}
+
+	c.resizeMu.Lock()
+	defer c.resizeMu.Unlock()
+
+	return c.shardSet()
 }
 
 // setBin private method with more parameters to be used
 // while storing non-fragmented and fragmented entries
-func (c *Cache) setBin(key []byte, entry []byte, fragmented bool) error {
+func (c *Cache) setBin(key []byte, entry []byte, flags uint64) error {
 	hashedKey := c.hash.Hash(key)
-	s := c.shards[hashedKey&c.shardMask]
+	ss := c.shardSet()
 
-	return s.set(key, entry, hashedKey, fragmented)
+	err := ss.shard(hashedKey).set(key, entry, hashedKey, flags)
+	for errors.Is(err, errShardMigrated) {
+		ss = c.nextShardSet(ss)
+		err = ss.shard(hashedKey).set(key, entry, hashedKey, flags)
+	}
+	if err != nil {
+		return err
+	}
+
+	// blocks are reclaimed from the other shards after the shard lock is released
+	if c.budget != nil {
+		c.budget.relieve()
+	}
+
+	// the previous value isn't migrated over the new one but it's removed
+	// so reads don't fall back to it after the new one is evicted
+	if ss.prev != nil {
+		ss.prev.shard(hashedKey).remove(hashedKey)
+	}
+
+	return nil
+}
+
+// admit checks the admission filter of the shard before the key is stored,
+// fragments of the value are stored without the check once the key is admitted.
+func (c *Cache) admit(key []byte) bool {
+	if c.newAdmission == nil {
+		return true
+	}
+
+	hashedKey := c.hash.Hash(key)
+	return c.shardSet().shard(hashedKey).admit(hashedKey)
 }
 
 // setBin private method with more parameters to be used
 // while getting non-fragmented and fragmented entries
-func (c *Cache) getBin(retBuf []byte, key []byte) ([]byte, bool, error) {
+func (c *Cache) getBin(retBuf []byte, key []byte) ([]byte, uint64, error) {
 	hashedKey := c.hash.Hash(key)
-	s := c.shards[hashedKey&c.shardMask]
+	ss := c.shardSet()
+
+	retBuf, flags, err := ss.shard(hashedKey).get(retBuf, key, hashedKey, true)
+	if ss.prev != nil && errors.Is(err, ErrEntryNotFound) {
+		// the entry is not migrated yet or it's migrated after the first lookup
+		retBuf, flags, err = ss.prev.shard(hashedKey).get(retBuf, key, hashedKey, true)
+		if errors.Is(err, ErrEntryNotFound) {
+			retBuf, flags, err = ss.shard(hashedKey).get(retBuf, key, hashedKey, true)
+		}
+	}
 
-	retBuf, fragmented, err := s.get(retBuf, key, hashedKey, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return retBuf, flags, nil
+}
+
+// EntryMeta describes an entry without its value
+type EntryMeta struct {
+	// Created is the time the entry is written, with a second precision
+	Created time.Time
+	// TTL is the remaining time to live of the entry
+	TTL time.Duration
+	// ValueSize is the size of the value in bytes
+	ValueSize int
+	// Fragmented reports whether the value is stored in fragments since it doesn't fit into a block
+	Fragmented bool
+	// Metadata is the metadata stored with the value, nil when the value is stored without metadata
+	Metadata []byte
+	// Hash is the hash of the value, it's the hash of the fragment hashes for a fragmented value
+	Hash uint64
+}
+
+// Meta returns the metadata of the entry and the hash of its value without copying the value,
+// it returns an ErrEntryNotFound when no entry exists for the given key. A missing key is counted
+// as a miss but hits are counted only when the value is read.
+func (c *Cache) Meta(key string) (EntryMeta, error) {
+	return c.MetaBin([]byte(key))
+}
+
+// MetaBin returns the metadata of the entry with byte array key without copying its value
+func (c *Cache) MetaBin(key []byte) (EntryMeta, error) {
+	hashedKey := c.hash.Hash(key)
+	ss := c.shardSet()
+
+	m, err := ss.shard(hashedKey).meta(key, hashedKey)
+	if ss.prev != nil && errors.Is(err, ErrEntryNotFound) {
+		// the entry is not migrated yet or it's migrated after the first lookup
+		m, err = ss.prev.shard(hashedKey).meta(key, hashedKey)
+		if errors.Is(err, ErrEntryNotFound) {
+			m, err = ss.shard(hashedKey).meta(key, hashedKey)
+		}
+	}
 
 	if err != nil {
-		return nil, false, err
+		// a missing key is counted as a miss, hits are counted when the value is read
+		if s := ss.shard(hashedKey); s.statsEnabled {
+			atomic.AddUint64(&s.misses, 1)
+		}
+		return EntryMeta{}, err
 	}
 
-	return retBuf, fragmented, nil
+	age := c.clock.Now() - m.timestamp
+	return EntryMeta{
+		Created:    time.Unix(m.timestamp, 0),
+		TTL:        time.Duration(c.ttlInSeconds-age) * time.Second,
+		ValueSize:  int(m.valueLen),
+		Fragmented: m.fragmented,
+		Metadata:   m.metadata,
+		Hash:       m.hash,
+	}, nil
 }
 
-func (c *Cache) setFragmented(k []byte, v []byte) error {
+func (c *Cache) setFragmented(k []byte, v []byte, metadata []byte) error {
 	if len(k) > defaultKeySizeInBytes {
 		//atomic.AddUint64(&c.bigStats.TooBigKeyErrors, 1)
 		return errors.New("too big key")
 	}
-	valueLen := len(v)
-	valueHash := c.hash.Hash(v)
+	fv := fragmentedValue{id: c.hash.Hash(v), len: uint64(len(v))}
 
 	// Split v into fragments with up to default-value-size each.
 	fragmentBuf := c.bpool.Get()
 	defer c.bpool.Put(fragmentBuf)
 
+	var fragmentHashes []byte
 	var i uint64
 	for len(v) > 0 {
-		fragmentBuf = common.MarshalUint64(fragmentBuf[:0], valueHash)
-		fragmentBuf = common.MarshalUint64(fragmentBuf, i)
+		fragmentBuf = fv.appendFragmentKey(fragmentBuf[:0], i)
 		i++
-		fragmentLen := defaultValueSizeInBytes - 1
+		fragmentLen := fragmentSizeInBytes
 		if len(v) < fragmentLen {
 			fragmentLen = len(v)
 		}
 		fragment := v[:fragmentLen]
 		v = v[fragmentLen:]
+		fragmentHashes = common.MarshalUint64(fragmentHashes, c.hash.Hash(fragment))
 
-		// set as non fragmented - only metadata entry will have this flag set with true
-		err := c.setBin(fragmentBuf, fragment, false)
+		// set as a fragment - only metadata entry will have the fragmented flag set
+		err := c.setBin(fragmentBuf, fragment, entryFragment)
 		if err != nil {
 			return err
 		}
 	}
+	fv.hash = c.hash.Hash(fragmentHashes)
 
-	// write metadata value, which consists of value hash and value len.
-	fragmentBuf = common.MarshalUint64(fragmentBuf[:0], valueHash)
-	fragmentBuf = common.MarshalUint64(fragmentBuf, uint64(valueLen))
+	return c.setFragmentedValue(k, fv, metadata)
+}
+
+// setFragmentedValue writes the metadata value, which consists of fragments id, value len and value hash
+// prefixed by the entry metadata if there is any.
+func (c *Cache) setFragmentedValue(k []byte, fv fragmentedValue, metadata []byte) error {
+	valueBuf := c.bpool.Get()
+	defer c.bpool.Put(valueBuf)
+
+	valueBuf = valueBuf[:0]
+	if len(metadata) > 0 {
+		valueBuf = appendMetadata(valueBuf, metadata)
+	}
+	valueBuf = fv.marshal(valueBuf)
 
-	// set as fragmented - the (meta) entry value consists of value hash and value len
-	// and fragmented entry flag is set to true.
+	// set as fragmented - the (meta) entry value describes the fragments
+	// and fragmented entry flag is set.
 	// Value of this entry will be processed to collect fragments of the actual value
-	err := c.setBin(k, fragmentBuf, true)
+	err := c.setBin(k, valueBuf, entryFragmented|metadataFlags(metadata))
 
 	if err != nil {
 		return err
 	}
 
+	if s := c.shardSet().shard(c.hash.Hash(k)); s.statsEnabled {
+		atomic.AddUint64(&s.fragmentedSets, 1)
+	}
+
 	return nil
 }
 
-func (c *Cache) getFragmented(retBuf []byte, metadataValue []byte) ([]byte, error) {
-	//todo: stats arrangements for fragmented entries
-
-	fragmentKey := c.bpool.Get()
-	defer c.bpool.Put(fragmentKey)
+// fragmentedValue is the metadata value of a fragmented entry
+type fragmentedValue struct {
+	// id addresses the fragments, it's the hash of the value unless the value is streamed
+	id  uint64
+	len uint64
+	// hash is the hash of the hashes of the fragments, so it's verified while the fragments are read
+	hash uint64
+}
 
-	// Read and parse metadata value that consist of actual value hash and actual value len
-	fragmentKey = metadataValue
-	if len(fragmentKey) == 0 {
-		return nil, nil
+func parseFragmentedValue(v []byte) (fragmentedValue, bool) {
+	if len(v) != fragmentedEntryKeyLen {
+		return fragmentedValue{}, false
 	}
-	if len(fragmentKey) != fragmentedEntryKeyLen {
+
+	return fragmentedValue{
+		id:   common.UnmarshalUint64(v),
+		len:  common.UnmarshalUint64(v[8:]),
+		hash: common.UnmarshalUint64(v[16:]),
+	}, true
+}
+
+func (fv fragmentedValue) marshal(buf []byte) []byte {
+	buf = common.MarshalUint64(buf, fv.id)
+	buf = common.MarshalUint64(buf, fv.len)
+	return common.MarshalUint64(buf, fv.hash)
+}
+
+// appendFragmentKey appends the key of the i-th fragment to buf
+func (fv fragmentedValue) appendFragmentKey(buf []byte, i uint64) []byte {
+	buf = common.MarshalUint64(buf, fv.id)
+	return common.MarshalUint64(buf, i)
+}
+
+// getFragmented collects the fragments of the value, misses and hash failures are counted by s
+func (c *Cache) getFragmented(retBuf []byte, metadataValue []byte, s *shard) ([]byte, error) {
+	// Read and parse metadata value that consist of fragments id, actual value len and value hash
+	fv, ok := parseFragmentedValue(metadataValue)
+	if !ok {
 		return nil, nil
 	}
-	valueHash := common.UnmarshalUint64(fragmentKey)
-	valueLen := common.UnmarshalUint64(fragmentKey[8:])
+
+	fragmentKey := c.bpool.Get()
+	defer c.bpool.Put(fragmentKey)
 
 	// Collect the actual value from fragments.
 	retBufLen := len(retBuf)
-	if n := retBufLen + int(valueLen) - cap(retBuf); n > 0 {
+	if n := retBufLen + int(fv.len) - cap(retBuf); n > 0 {
 		retBuf = append(retBuf[:cap(retBuf)], make([]byte, n)...)
 	}
 
 	retBuf = retBuf[:retBufLen]
+	var fragmentHashes []byte
 	var i uint64
-	for uint64(len(retBuf)-retBufLen) < valueLen {
-		fragmentKey = common.MarshalUint64(fragmentKey[:0], valueHash)
-		fragmentKey = common.MarshalUint64(fragmentKey, i)
+	for uint64(len(retBuf)-retBufLen) < fv.len {
+		fragmentKey = fv.appendFragmentKey(fragmentKey[:0], i)
 		i++
 		//ignore "is fragmented" flag because we are collecting fragments
 		fragment, _, err := c.getBin(retBuf, fragmentKey)
 
 		if err != nil {
+			s.countFragmentMiss()
 			c.logger.Err("Fragment of the actual value could not found", err)
 			return nil, err
 		}
 
 		if len(fragment) == len(retBuf) {
+			s.countFragmentMiss()
 			c.logger.Debug("fragment of the actual value could not found")
 			return nil, ErrFragmentNotFound
 		}
+		fragmentHashes = common.MarshalUint64(fragmentHashes, c.hash.Hash(fragment[len(retBuf):]))
 		retBuf = fragment
 	}
 
 	// verify the collected fragments.
 	v := retBuf[retBufLen:]
-	if uint64(len(v)) != valueLen {
-		c.logger.Printf("invalid fragmented entry value len — want: %d got: %d", valueLen, len(v))
-		return nil, fmt.Errorf("invalid fragmented entry value len — want: %d got: %d", valueLen, len(v))
+	if uint64(len(v)) != fv.len {
+		c.logger.Printf("invalid fragmented entry value len — want: %d got: %d", fv.len, len(v))
+		return nil, fmt.Errorf("invalid fragmented entry value len — want: %d got: %d", fv.len, len(v))
 	}
-	h := c.hash.Hash(v)
-	if h != valueHash {
-		return nil, fmt.Errorf("invalid fragmented value hash want: %d got: %d", valueHash, h)
+
+	if err := c.verifyFragments(fv, fragmentHashes, s); err != nil {
+		return nil, err
 	}
 
 	return retBuf, nil
 }
 
-// maximumShardSizeInBytes computes maximum shard size in bytes
-func (c *Cache) maximumShardSizeInBytes() uint64 {
-	return uint64((c.maxCacheBytes + c.shardCount - 1) / c.shardCount)
+// verifyFragments compares the hash of the hashes of the fragments read with the value hash,
+// hash failures are counted by s
+func (c *Cache) verifyFragments(fv fragmentedValue, fragmentHashes []byte, s *shard) error {
+	h := c.hash.Hash(fragmentHashes)
+	if h != fv.hash {
+		if s.statsEnabled {
+			atomic.AddUint64(&s.hashFailures, 1)
+		}
+		return fmt.Errorf("invalid fragmented value hash want: %d got: %d", fv.hash, h)
+	}
+
+	return nil
 }
@@ -1,7 +1,10 @@
 package distrox
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -288,3 +291,163 @@ func BenchmarkDistroxCacheSetGetBin(b *testing.B) {
 		}
 	})
 }
+
+// HIT RATIO
+// keys are drawn from a zipf distribution over a key space bigger than the cache,
+// missed keys are set as a cache-aside client would do.
+func BenchmarkDistroxCacheHitRatio(b *testing.B) {
+	const (
+		keySpace  = 1 << 20
+		valueSize = 256
+		shards    = 16
+		maxBytes  = 16 * 1024 * 1024
+		// the sketch has a counter per entry a shard holds
+		tinyLFUCounters = maxBytes / shards / valueSize
+	)
+
+	for _, workload := range []struct {
+		name string
+		// scanEvery reads a key which is never read again every scanEvery requests, 0 disables it
+		scanEvery int
+	}{
+		{name: "zipf"},
+		{name: "zipf+scan", scanEvery: 2},
+	} {
+		for _, bc := range []struct {
+			name         string
+			newPolicy    func() EvictionPolicy
+			newAdmission func() AdmissionFilter
+		}{
+			{name: "fifo", newPolicy: NewFIFOPolicy},
+			{
+				name:      "clock",
+				newPolicy: func() EvictionPolicy { return NewClockPolicy(defaultClockReferenceBits) },
+			},
+			{
+				name:      "clock+tinylfu",
+				newPolicy: func() EvictionPolicy { return NewClockPolicy(defaultClockReferenceBits) },
+				newAdmission: func() AdmissionFilter {
+					return NewTinyLFU(tinyLFUCounters, defaultTinyLFUMinFreq)
+				},
+			},
+		} {
+			b.Run(workload.name+"/"+bc.name, func(b *testing.B) {
+				c, err := NewCache(
+					WithShards(shards),
+					WithMaxBytes(maxBytes),
+					WithEvictionPolicy(bc.newPolicy),
+					WithAdmissionFilter(bc.newAdmission),
+				)
+				if err != nil {
+					b.Fatalf("could not create cache: %s", err)
+				}
+
+				defer c.Reset()
+				defer c.Close()
+
+				zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.01, 1, keySpace-1)
+				key := make([]byte, 8)
+				value := make([]byte, valueSize)
+				var buf []byte
+				var hits, misses uint64
+				scanKey := uint64(keySpace)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if workload.scanEvery > 0 && i%workload.scanEvery == 0 {
+						key = common.MarshalUint64(key[:0], scanKey)
+						scanKey++
+					} else {
+						key = common.MarshalUint64(key[:0], zipf.Uint64())
+					}
+
+					buf, err = c.GetBin(buf[:0], key)
+					if err == nil && len(buf) > 0 {
+						hits++
+						continue
+					}
+
+					misses++
+					if err := c.SetBin(key, value); err != nil && !errors.Is(err, ErrNotAdmitted) {
+						b.Fatalf("could not set: %s", err)
+					}
+				}
+
+				b.ReportMetric(100*float64(hits)/float64(hits+misses), "hit%")
+			})
+		}
+	}
+}
+
+// benchProcs are the GOMAXPROCS values the read path is measured at
+var benchProcs = []int{1, 2, 4, 8, 16, 32, 64}
+
+func BenchmarkDistroxCacheGetProcs(b *testing.B) {
+	for _, procs := range benchProcs {
+		b.Run(fmt.Sprintf("procs-%d", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+
+			c, err := NewCache(
+				WithMaxBytes(64*1024*1024),
+				WithClock(common.NewCachedClock()),
+			)
+			if err != nil {
+				b.Fatalf("could not create cache: %s", err)
+			}
+
+			defer c.Reset()
+			defer c.Close()
+
+			keys := make([][]byte, 1024)
+			want := []byte("hello world")
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("key %d", i))
+				if err := c.SetBin(keys[i], want); err != nil {
+					b.Fatalf("could not set: %s", err)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var buf []byte
+				var err error
+				i := rand.Intn(len(keys))
+				for pb.Next() {
+					i = (i + 1) % len(keys)
+					buf, err = c.GetBin(buf[:0], keys[i])
+					if err != nil || string(buf) != string(want) {
+						panic(fmt.Errorf("invalid value — got %q; want %q", buf, want))
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkShardReadLock compares the read lock of the shards with sync.RWMutex,
+// run it with -cpu 1,4,16 to see how they scale with the readers of different keys.
+func BenchmarkShardReadLock(b *testing.B) {
+	b.Run("sync", func(b *testing.B) {
+		var m sync.RWMutex
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				m.RLock()
+				m.RUnlock()
+			}
+		})
+	})
+
+	b.Run("distributed", func(b *testing.B) {
+		m := common.NewDistributedRWMutex()
+		b.RunParallel(func(pb *testing.PB) {
+			// each reader goes over its own keys
+			h := rand.Uint64()
+			for pb.Next() {
+				h += 0x9e3779b97f4a7c15
+				m.RUnlock(m.RLock(h))
+			}
+		})
+	})
+}
@@ -68,6 +68,147 @@ func WithStatsEnabled() cacheOption {
 	}
 }
 
+// WithLatencyStats records the latencies of the cache operations in histograms kept per shard,
+// they are served by Cache.LatencyStats. It costs two clock reads and a key hash per operation.
+func WithLatencyStats(enabled bool) cacheOption {
+	return func(c *Cache) error {
+		c.latencyEnabled = enabled
+		return nil
+	}
+}
+
+// WithSlowLog records the last maxLen gets, sets and deletes which take at least threshold,
+// they are served by Cache.SlowLog. 0 threshold disables it.
+func WithSlowLog(threshold time.Duration, maxLen int) cacheOption {
+	return func(c *Cache) error {
+		if threshold < 0 || (threshold > 0 && maxLen <= 0) {
+			return fmt.Errorf("slow log threshold must not be negative and max len must be positive")
+		}
+
+		c.slowLogThreshold = threshold
+		c.slowLogMaxLen = maxLen
+		return nil
+	}
+}
+
+// WithHotKeys tracks the topK most frequently read and written keys, served by Cache.HotKeys.
+// One in sampleRate gets and sets is counted and the counts are halved every decayInterval,
+// so keys which are not hot anymore drop out. topK 0 disables the tracking.
+func WithHotKeys(topK int, sampleRate int, decayInterval time.Duration) cacheOption {
+	return func(c *Cache) error {
+		if topK < 0 || (topK > 0 && sampleRate <= 0) {
+			return fmt.Errorf("hot keys top-k must not be negative and sample rate must be positive")
+		}
+
+		c.hotKeysK = topK
+		c.hotKeysSampleRate = sampleRate
+		c.hotKeysDecay = decayInterval
+		return nil
+	}
+}
+
+// WithEventBuffer sets the number of the keyspace events buffered for each subscriber of Cache.Subscribe,
+// a subscriber is dropped once its buffer is full.
+func WithEventBuffer(size int) cacheOption {
+	return func(c *Cache) error {
+		if size <= 0 {
+			return fmt.Errorf("event buffer size must be positive")
+		}
+
+		c.eventBufferSize = size
+		return nil
+	}
+}
+
+// WithOffHeap allocates ring buffer memory blocks via anonymous mmap,
+// so large caches don't inflate GC heap goals (only supported on linux).
+func WithOffHeap(enabled bool) cacheOption {
+	return func(c *Cache) error {
+		c.offHeap = enabled
+		return nil
+	}
+}
+
+// WithGlobalBudget makes the shards share the max size instead of having an equal part of it,
+// shards borrow blocks from the budget as they need and the globally oldest block is reclaimed
+// from its shard once the budget is exhausted.
+func WithGlobalBudget(enabled bool) cacheOption {
+	return func(c *Cache) error {
+		c.globalBudget = enabled
+		return nil
+	}
+}
+
+// WithDiskTier enables the disk tier when the dir is set, live entries of the ring buffer blocks
+// which are about to be overwritten are appended to segment files in the dir.
+// The oldest segments are removed when the tier exceeds maxBytes.
+func WithDiskTier(dir string, maxBytes int64) cacheOption {
+	return func(c *Cache) error {
+		c.diskDir = dir
+		c.diskMaxBytes = maxBytes
+		return nil
+	}
+}
+
+// WithDiskSegmentSize sets the max size of a disk tier segment file
+func WithDiskSegmentSize(size int64) cacheOption {
+	return func(c *Cache) error {
+		if size <= 0 {
+			return fmt.Errorf("disk segment size must be positive")
+		}
+
+		c.diskSegmentMaxBytes = size
+		return nil
+	}
+}
+
+// WithDiskPromotion writes entries read from the disk tier back to the memory
+func WithDiskPromotion(enabled bool) cacheOption {
+	return func(c *Cache) error {
+		c.diskPromotion = enabled
+		return nil
+	}
+}
+
+// WithEvictionPolicy sets the policy which decides what happens to the live entries of
+// the oldest block when it's overwritten, the policy is created for each shard.
+// By default the oldest block is overwritten regardless of its entries (FIFO).
+func WithEvictionPolicy(newPolicy func() EvictionPolicy) cacheOption {
+	return func(c *Cache) error {
+		c.newPolicy = newPolicy
+		return nil
+	}
+}
+
+// WithAdmissionFilter sets a filter which can refuse to store new keys
+// once the cache is full, the filter is created for each shard.
+func WithAdmissionFilter(newFilter func() AdmissionFilter) cacheOption {
+	return func(c *Cache) error {
+		c.newAdmission = newFilter
+		return nil
+	}
+}
+
+// WithCompaction compacts the shards every interval, live entries of a block are rewritten
+// when at least minDeadRatio of the block is deleted or overwritten entries.
+// Compaction is disabled when the interval is not positive, Compact can still be called
+// and it uses the default ratio then unless a valid one is given.
+func WithCompaction(interval time.Duration, minDeadRatio float64) cacheOption {
+	return func(c *Cache) error {
+		c.compactionInterval = interval
+
+		if minDeadRatio <= 0 || minDeadRatio > 1 {
+			if interval <= 0 {
+				return nil
+			}
+			return fmt.Errorf("compaction dead ratio must be in (0, 1]: %v", minDeadRatio)
+		}
+
+		c.compactionMinDeadRatio = minDeadRatio
+		return nil
+	}
+}
+
 func WithClock(klock common.StoppableClock) cacheOption {
 	return func(c *Cache) error {
 		c.clock = klock
@@ -2,11 +2,21 @@ package distrox
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/ziyasal/distroxy/internal/pkg/common"
 )
 
 func TestCacheWriteAndGet(t *testing.T) {
@@ -133,6 +143,1048 @@ func TestCacheDel(t *testing.T) {
 	assert.Empty(t, stats.Collisions)
 }
 
+func TestCacheOffHeap(t *testing.T) {
+	c, err := NewCache(
+		WithMaxBytes(64*1024*1024),
+		WithOffHeap(true),
+	)
+	if errors.Is(err, common.ErrOffHeapUnsupported) {
+		t.Skip(err)
+	}
+	assert.Nil(t, err)
+
+	defer c.Reset()
+	defer c.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key %d", i)
+		want := []byte(fmt.Sprintf("value %d", i))
+		assert.Nil(t, c.Set(key, want))
+
+		got, err := c.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, string(want), string(got))
+	}
+
+	var stats CacheStats
+	c.LoadStats(&stats)
+	assert.NotEmpty(t, stats.OffHeapBytes)
+	assert.Equal(t, stats.CacheBytes, stats.OffHeapBytes)
+
+	// the mapped blocks are released once, closing again is a no-op
+	assert.Nil(t, c.Close())
+	assert.Nil(t, c.Close())
+}
+
+func TestCacheDiskTier(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := NewCache(
+		WithShards(1),
+		WithMaxBytes(4*defaultMemBlockSizeInBytes),
+		WithDiskTier(dir, 64*1024*1024),
+		WithDiskPromotion(true),
+	)
+	assert.Nil(t, err)
+
+	defer c.Reset()
+	defer c.Close()
+
+	// values don't fit into the ring buffer, so the oldest ones are moved to the disk tier
+	const itemsCount = 1000
+	value := make([]byte, 1024)
+	for i := 0; i < itemsCount; i++ {
+		key := fmt.Sprintf("key %d", i)
+		assert.Nil(t, c.Set(key, append([]byte(key), value...)))
+	}
+
+	for i := 0; i < itemsCount; i++ {
+		key := fmt.Sprintf("key %d", i)
+		got, err := c.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, append([]byte(key), value...), got)
+	}
+
+	var stats CacheStats
+	c.LoadStats(&stats)
+	assert.Equal(t, uint64(itemsCount), stats.Hits)
+	assert.NotEmpty(t, stats.DiskHits)
+	assert.NotEmpty(t, stats.DiskBytes)
+	assert.NotEmpty(t, stats.DiskSegments)
+	assert.Equal(t, uint64(itemsCount), stats.EntriesCount)
+
+	assert.Nil(t, c.Reset())
+	c.LoadStats(&stats)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+diskSegmentFileExt))
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestCacheDiskTierSizeLimit(t *testing.T) {
+	c, err := NewCache(
+		WithShards(1),
+		WithMaxBytes(2*defaultMemBlockSizeInBytes),
+		WithDiskTier(t.TempDir(), 4*defaultMemBlockSizeInBytes),
+		WithDiskSegmentSize(defaultMemBlockSizeInBytes),
+	)
+	assert.Nil(t, err)
+
+	defer c.Reset()
+	defer c.Close()
+
+	const itemsCount = 1000
+	value := make([]byte, 1024)
+	for i := 0; i < itemsCount; i++ {
+		assert.Nil(t, c.Set(fmt.Sprintf("key %d", i), value))
+	}
+
+	// oldest entries are collected with their segments
+	_, err = c.Get("key 0")
+	assert.Equal(t, ErrEntryNotFound, err)
+
+	got, err := c.Get(fmt.Sprintf("key %d", itemsCount-1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+
+	var stats CacheStats
+	c.LoadStats(&stats)
+	assert.True(t, stats.DiskBytes <= 4*defaultMemBlockSizeInBytes,
+		"disk bytes: %d exceeds the limit", stats.DiskBytes)
+}
+
+func TestDiskTierReadsQueuedEntries(t *testing.T) {
+	d, err := newDiskTier(t.TempDir(), 64*1024*1024, defaultDiskSegmentSizeInBytes, common.NilLogger{})
+	assert.Nil(t, err)
+
+	defer d.close()
+
+	// the writer is stopped, so the appended entries stay in the queue
+	d.stopWriter()
+
+	first, err := d.append([]byte("first entries"), 1)
+	assert.Nil(t, err)
+	second, err := d.append([]byte("second entries"), 1)
+	assert.Nil(t, err)
+	assert.Len(t, d.pending, 2)
+
+	buf := make([]byte, len("entries"))
+	assert.Nil(t, d.readAt(buf, second+uint64(len("second "))))
+	assert.Equal(t, "entries", string(buf))
+
+	d.flush()
+	assert.Empty(t, d.pending)
+	assert.Empty(t, d.pendingBytes)
+
+	buf = make([]byte, len("first"))
+	assert.Nil(t, d.readAt(buf, first))
+	assert.Equal(t, "first", string(buf))
+}
+
+func TestCacheClockPolicyKeepsHotEntries(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		newPolicy func() EvictionPolicy
+		kept      bool
+	}{
+		{name: "fifo", newPolicy: NewFIFOPolicy, kept: false},
+		{name: "clock", newPolicy: func() EvictionPolicy { return NewClockPolicy(1024) }, kept: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewCache(
+				WithShards(1),
+				WithMaxBytes(4*defaultMemBlockSizeInBytes),
+				WithEvictionPolicy(tc.newPolicy),
+			)
+			assert.Nil(t, err)
+
+			defer c.Reset()
+			defer c.Close()
+
+			assert.Nil(t, c.Set("hot", []byte("hot value")))
+
+			// write enough to wrap the ring a few times while reading the hot key
+			value := make([]byte, 1024)
+			for i := 0; i < 1000; i++ {
+				assert.Nil(t, c.Set(fmt.Sprintf("key %d", i), value))
+				if i%10 == 0 {
+					_, _ = c.Get("hot")
+				}
+			}
+
+			got, err := c.Get("hot")
+			if !tc.kept {
+				assert.Equal(t, ErrEntryNotFound, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, "hot value", string(got))
+
+			var stats CacheStats
+			c.LoadStats(&stats)
+			assert.NotEmpty(t, stats.Reinserts)
+		})
+	}
+}
+
+func TestCacheTinyLFURejectsOneHitWonders(t *testing.T) {
+	c, err := NewCache(
+		WithShards(1),
+		WithMaxBytes(2*defaultMemBlockSizeInBytes),
+		WithAdmissionFilter(func() AdmissionFilter { return NewTinyLFU(defaultTinyLFUCounters, 2) }),
+	)
+	assert.Nil(t, err)
+
+	defer c.Reset()
+	defer c.Close()
+
+	// writes are admitted until the ring is full
+	value := make([]byte, 1024)
+	for i := 0; i < 200; i++ {
+		if err := c.Set(fmt.Sprintf("key %d", i), value); err != nil {
+			assert.Equal(t, ErrNotAdmitted, err)
+		}
+	}
+
+	var before CacheStats
+	c.LoadStats(&before)
+	assert.NotEmpty(t, before.AdmissionRejects)
+
+	assert.Equal(t, ErrNotAdmitted, c.Set("one-hit-wonder", value))
+	_, err = c.Get("one-hit-wonder")
+	assert.Equal(t, ErrEntryNotFound, err)
+
+	// the key is accessed again, so it's admitted
+	assert.Nil(t, c.Set("one-hit-wonder", value))
+	got, err := c.Get("one-hit-wonder")
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+
+	var stats CacheStats
+	c.LoadStats(&stats)
+	assert.Equal(t, before.AdmissionRejects+1, stats.AdmissionRejects)
+}
+
+func TestCacheCompact(t *testing.T) {
+	c, err := NewCache(
+		WithShards(1),
+		WithMaxBytes(4*defaultMemBlockSizeInBytes),
+	)
+	assert.Nil(t, err)
+
+	defer c.Reset()
+	defer c.Close()
+
+	// fill three blocks and delete most of the entries of them
+	const itemsCount = 180
+	value := make([]byte, 1024)
+	for i := 0; i < itemsCount; i++ {
+		key := fmt.Sprintf("key %d", i)
+		assert.Nil(t, c.Set(key, append([]byte(key), value...)))
+	}
+	for i := 0; i < itemsCount; i++ {
+		if i%10 != 0 {
+			assert.Nil(t, c.Del(fmt.Sprintf("key %d", i)))
+		}
+	}
+
+	var before CacheStats
+	c.LoadStats(&before)
+	assert.NotEmpty(t, before.DeadBytes)
+
+	compacted := 0
+	for c.Compact() > 0 {
+		compacted++
+	}
+	assert.NotEmpty(t, compacted)
+
+	var stats CacheStats
+	c.LoadStats(&stats)
+	assert.Equal(t, before.LiveBytes, stats.LiveBytes)
+	assert.Less(t, stats.DeadBytes, before.DeadBytes)
+	assert.Equal(t, uint64(compacted), stats.Compactions)
+
+	// compacted entries are still readable and keep their place in the index
+	for i := 0; i < itemsCount; i += 10 {
+		key := fmt.Sprintf("key %d", i)
+		got, err := c.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, append([]byte(key), value...), got)
+	}
+	assert.Equal(t, uint64(itemsCount/10), c.Len())
+}
+
+func TestCacheCompactionOption(t *testing.T) {
+	// the ratio isn't used when compaction is disabled
+	c, err := NewCache(WithCompaction(0, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultCompactionMinDeadRatio, c.compactionMinDeadRatio)
+	assert.Nil(t, c.Close())
+
+	_, err = NewCache(WithCompaction(time.Minute, 0))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "compaction dead ratio must be in (0, 1]")
+}
+
+func TestCacheResize(t *testing.T) {
+	c, err := NewCache(
+		WithShards(1),
+		WithMaxBytes(2*defaultMemBlockSizeInBytes),
+	)
+	assert.Nil(t, err)
+
+	defer c.Reset()
+	defer c.Close()
+
+	assert.Nil(t, c.Resize(8*defaultMemBlockSizeInBytes))
+
+	var stats CacheStats
+	c.LoadStats(&stats)
+	assert.Equal(t, uint64(8*defaultMemBlockSizeInBytes), stats.CapacityBytes)
+
+	// entries fit into the grown ring buffer
+	const itemsCount = 400
+	value := make([]byte, 1024)
+	for i := 0; i < itemsCount; i++ {
+		key := fmt.Sprintf("key %d", i)
+		assert.Nil(t, c.Set(key, append([]byte(key), value...)))
+	}
+	assert.Equal(t, uint64(itemsCount), c.Len())
+
+	// the oldest entries are evicted while shrinking
+	assert.Nil(t, c.Resize(2*defaultMemBlockSizeInBytes))
+	stats = CacheStats{}
+	c.LoadStats(&stats)
+	assert.Equal(t, uint64(2*defaultMemBlockSizeInBytes), stats.CapacityBytes)
+	assert.Less(t, c.Len(), uint64(itemsCount))
+
+	_, err = c.Get("key 0")
+	assert.Equal(t, ErrEntryNotFound, err)
+
+	key := fmt.Sprintf("key %d", itemsCount-1)
+	got, err := c.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, append([]byte(key), value...), got)
+
+	assert.Equal(t, ErrZeroBytesShardSize, c.Resize(0))
+}
+
+func TestCacheReshardConcurrentWrites(t *testing.T) {
+	c, err := NewCache(
+		WithShards(4),
+		WithMaxBytes(64*defaultMemBlockSizeInBytes),
+	)
+	assert.Nil(t, err)
+
+	defer c.Reset()
+	defer c.Close()
+
+	const (
+		writers  = 8
+		keys     = 200
+		versions = 20
+	)
+
+	// the writers keep writing their keys while the shards are changed,
+	// every key ends with its last version and every other key is deleted
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for v := 0; v < versions; v++ {
+				for k := 0; k < keys; k++ {
+					key := fmt.Sprintf("key %d-%d", w, k)
+					assert.Nil(t, c.Set(key, []byte(fmt.Sprintf("%s version %d", key, v))))
+					if v == versions-1 && k%2 == 0 {
+						assert.Nil(t, c.Del(key))
+					}
+					if k%16 == 0 {
+						runtime.Gosched()
+					}
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+		default:
+			if err := c.Reshard(2 << (i % 4)); err != nil {
+				assert.Equal(t, ErrReshardInProgress, err)
+				runtime.Gosched()
+			}
+			continue
+		}
+		break
+	}
+
+	for c.Resharding() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for w := 0; w < writers; w++ {
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("key %d-%d", w, k)
+			got, err := c.Get(key)
+			if k%2 == 0 {
+				assert.Equal(t, ErrEntryNotFound, err, key)
+				continue
+			}
+
+			assert.Nil(t, err, key)
+			assert.Equal(t, fmt.Sprintf("%s version %d", key, versions-1), string(got))
+		}
+	}
+}
+
+func TestCacheReshard(t *testing.T) {
+	c, err := NewCache(
+		WithShards(4),
+		WithMaxBytes(64*defaultMemBlockSizeInBytes),
+	)
+	assert.Nil(t, err)
+
+	defer c.Reset()
+	defer c.Close()
+
+	const itemsCount = 10000
+	for i := 0; i < itemsCount; i++ {
+		key := fmt.Sprintf("key %d", i)
+		assert.Nil(t, c.Set(key, []byte(key)))
+	}
+
+	prev := c.shardSet()
+	assert.Nil(t, c.Reshard(16))
+	assert.Equal(t, ErrReshardInProgress, c.Reshard(8))
+
+	// the writers which loaded the previous layout retry on the new one
+	h := c.hash.Hash([]byte("key 0"))
+	assert.Equal(t, errShardMigrated, prev.shard(h).set([]byte("key 0"), []byte("stale"), h, 0))
+	assert.Equal(t, errShardMigrated, prev.shard(h).del(h))
+
+	// entries are readable, writable and deletable while they are migrated
+	for i := 0; i < itemsCount; i++ {
+		key := fmt.Sprintf("key %d", i)
+		switch i % 3 {
+		case 0:
+			got, err := c.Get(key)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(key), got)
+		case 1:
+			assert.Nil(t, c.Set(key, []byte("new "+key)))
+		case 2:
+			assert.Nil(t, c.Del(key))
+		}
+	}
+
+	for c.Resharding() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < itemsCount; i++ {
+		key := fmt.Sprintf("key %d", i)
+		got, err := c.Get(key)
+		switch i % 3 {
+		case 0:
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(key), got)
+		case 1:
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("new "+key), got)
+		case 2:
+			assert.Equal(t, ErrEntryNotFound, err)
+		}
+	}
+
+	assert.Equal(t, uint64(itemsCount-itemsCount/3), c.Len())
+	assert.Len(t, c.shardSet().shards, 16)
+}
+
+func TestCacheGlobalBudget(t *testing.T) {
+	c, err := NewCache(
+		WithShards(2),
+		WithMaxBytes(8*defaultMemBlockSizeInBytes),
+		WithGlobalBudget(true),
+	)
+	assert.Nil(t, err)
+
+	defer c.Reset()
+	defer c.Close()
+
+	// writes keys of the given shard only
+	value := make([]byte, 1024)
+	fill := func(shardIdx uint64, count int) {
+		for i, written := 0, 0; written < count; i++ {
+			key := fmt.Sprintf("key %d", i)
+			if c.hash.HashStr(key)&1 != shardIdx {
+				continue
+			}
+			assert.Nil(t, c.Set(key, value))
+			written++
+		}
+	}
+
+	// the hot shard borrows all blocks left in the budget
+	fill(0, 1000)
+	var stats CacheStats
+	c.LoadStats(&stats)
+	assert.Equal(t, uint64(8), stats.BudgetBlocks)
+	assert.Equal(t, []uint64{7, 1}, stats.ShardBlocks)
+	assert.Empty(t, stats.Reclaims)
+
+	// the oldest blocks of the cold shard are reclaimed once the other shard gets hot
+	fill(1, 1000)
+	stats = CacheStats{}
+	c.LoadStats(&stats)
+	assert.NotEmpty(t, stats.Reclaims)
+	assert.Equal(t, uint64(8), stats.ShardBlocks[0]+stats.ShardBlocks[1])
+	assert.Less(t, stats.ShardBlocks[0], stats.ShardBlocks[1])
+
+	// shrinking the budget reclaims the globally oldest blocks
+	assert.Nil(t, c.Resize(4*defaultMemBlockSizeInBytes))
+	stats = CacheStats{}
+	c.LoadStats(&stats)
+	assert.Equal(t, uint64(4), stats.ShardBlocks[0]+stats.ShardBlocks[1])
+	assert.Equal(t, uint64(4*defaultMemBlockSizeInBytes), stats.CapacityBytes)
+}
+
+func TestCacheShardStats(t *testing.T) {
+	c, err := NewCache(WithShards(4), WithMaxBytes(4*4*64*1024), WithStatsEnabled())
+	assert.Nil(t, err)
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, c.Set(fmt.Sprintf("key %d", i), []byte(fmt.Sprintf("value %d", i))))
+	}
+	_, err = c.Get("key 1")
+	assert.Nil(t, err)
+	_, err = c.Get("missing")
+	assert.Equal(t, ErrEntryNotFound, err)
+
+	big := createValue(3*64*1024, 1)
+	assert.Nil(t, c.SetBin([]byte("big"), big))
+	got, err := c.GetBin(nil, []byte("big"))
+	assert.Nil(t, err)
+	assert.Equal(t, big, got)
+
+	shards := c.ShardStats()
+	assert.Equal(t, 4, len(shards))
+
+	var total ShardStats
+	for _, s := range shards {
+		total.Hits += s.Hits
+		total.Misses += s.Misses
+		total.EntriesCount += s.EntriesCount
+		total.FragmentedSets += s.FragmentedSets
+		total.FragmentedGets += s.FragmentedGets
+		assert.True(t, s.WriteCursor <= s.CacheBytes)
+	}
+
+	stats := CacheStats{}
+	c.LoadStats(&stats)
+	assert.Equal(t, stats.Hits, total.Hits)
+	assert.Equal(t, stats.Misses, total.Misses)
+	assert.Equal(t, stats.EntriesCount, total.EntriesCount)
+	assert.Equal(t, uint64(1), total.FragmentedSets)
+	assert.Equal(t, uint64(1), total.FragmentedGets)
+
+	// overwrite the blocks holding the fragments
+	for i := 0; i < 20000; i++ {
+		assert.Nil(t, c.Set(fmt.Sprintf("filler %d", i), createValue(256, i)))
+	}
+	_, err = c.GetBin(nil, []byte("big"))
+	assert.NotNil(t, err)
+
+	stats = CacheStats{}
+	c.LoadStats(&stats)
+	assert.True(t, stats.Evictions > 0)
+
+	var wraps uint64
+	for _, s := range c.ShardStats() {
+		wraps += s.Wraps
+	}
+	assert.True(t, wraps > 0)
+}
+
+func TestCacheLatencyStats(t *testing.T) {
+	c, err := NewCache(WithShards(4), WithLatencyStats(true))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, c.Set(fmt.Sprintf("key %d", i), []byte("value")))
+		_, err = c.Get(fmt.Sprintf("key %d", i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, c.Del("key 1"))
+	assert.Nil(t, c.SetBin([]byte("big"), createValue(2*64*1024, 1)))
+	_, err = c.GetBin(nil, []byte("big"))
+	assert.Nil(t, err)
+
+	stats := c.LatencyStats()
+	assert.Equal(t, uint64(100), stats["get"].Count)
+	assert.Equal(t, uint64(100), stats["set"].Count)
+	assert.Equal(t, uint64(1), stats["del"].Count)
+	assert.Equal(t, uint64(1), stats["fragmented_get"].Count)
+	assert.Equal(t, uint64(1), stats["fragmented_set"].Count)
+
+	get := stats["get"]
+	assert.True(t, get.P50 > 0)
+	assert.True(t, get.P50 <= get.P90 && get.P90 <= get.P99 && get.P99 <= get.P999)
+	assert.True(t, get.P999 <= get.Max)
+
+	assert.Nil(t, c.Reset())
+	assert.Equal(t, uint64(0), c.LatencyStats()["get"].Count)
+
+	c2, err := NewCache(WithShards(4))
+	assert.Nil(t, err)
+	defer c2.Close()
+	assert.Nil(t, c2.LatencyStats())
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	for _, v := range []uint64{0, 7, 8, 15, 16, 17, 1000, 123456789, 1<<latencyMaxBits - 1} {
+		i := latencyBucket(v)
+		assert.True(t, i < latencyBuckets)
+		assert.True(t, v <= latencyBucketUpper(i), "value %d bucket %d", v, i)
+		if i > 0 {
+			assert.True(t, v > latencyBucketUpper(i-1), "value %d bucket %d", v, i)
+		}
+	}
+
+	var h, merged latencyHistogram
+	for v := uint64(1); v <= 1000; v++ {
+		h.observe(v * 1000)
+	}
+	merged.merge(&h)
+
+	stats := merged.stats()
+	assert.Equal(t, uint64(1000), stats.Count)
+	assert.Equal(t, time.Duration(1000000), stats.Max)
+	// buckets are within 12.5% of the values
+	assert.InDelta(t, 500000, float64(stats.P50), 500000*0.125)
+	assert.InDelta(t, 990000, float64(stats.P99), 990000*0.125)
+}
+
+func TestCacheHotKeys(t *testing.T) {
+	clock := &mockClock{}
+	c, err := NewCache(WithShards(4), WithClock(clock), WithHotKeys(3, 1, time.Minute))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, c.Set(fmt.Sprintf("key %d", i), []byte("value")))
+	}
+	for i := 0; i < 50; i++ {
+		_, _ = c.Get("key 7")
+		if i%2 == 0 {
+			_, _ = c.Get("key 42")
+		}
+		if i%5 == 0 {
+			_, _ = c.Get("key 3")
+		}
+	}
+
+	keys := c.HotKeys()
+	assert.Equal(t, 3, len(keys))
+	assert.Equal(t, "key 7", keys[0].Key)
+	assert.Equal(t, uint64(51), keys[0].Count)
+	assert.Equal(t, "key 42", keys[1].Key)
+	assert.Equal(t, "key 3", keys[2].Key)
+	assert.Equal(t, int(c.hash.HashStr("key 7")&3), keys[0].Shard)
+
+	// counts are halved once the decay interval passes
+	clock.set(60)
+	_, _ = c.Get("key 7")
+	keys = c.HotKeys()
+	assert.Equal(t, "key 7", keys[0].Key)
+	assert.Equal(t, uint64(26), keys[0].Count)
+
+	assert.Nil(t, c.Reset())
+	assert.Equal(t, 0, len(c.HotKeys()))
+
+	_, err = NewCache(WithHotKeys(3, 0, time.Minute))
+	assert.NotNil(t, err)
+}
+
+func TestCacheSlowLog(t *testing.T) {
+	c, err := NewCache(WithShards(4), WithSlowLog(time.Nanosecond, 3))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	long := strings.Repeat("k", 200)
+	assert.Nil(t, c.Set(long, []byte("value")))
+	_, err = c.Get(long)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Del(long))
+	assert.Nil(t, c.SetBin([]byte("big"), createValue(2*64*1024, 1)))
+
+	ops := c.SlowLog(0)
+	assert.Equal(t, 3, len(ops))
+	assert.Equal(t, "fragmented_set", ops[0].Op)
+	assert.Equal(t, 2*64*1024, ops[0].ValueSize)
+	assert.Equal(t, int(c.hash.HashStr("big")&3), ops[0].Shard)
+	assert.Equal(t, "del", ops[1].Op)
+	assert.Equal(t, "get", ops[2].Op)
+	assert.Equal(t, 5, ops[2].ValueSize)
+	assert.Equal(t, strings.Repeat("k", 128)+"... (72 more bytes)", ops[2].Key)
+	assert.True(t, ops[0].ID > ops[1].ID && ops[1].ID > ops[2].ID)
+
+	assert.Equal(t, 1, len(c.SlowLog(1)))
+	c.ResetSlowLog()
+	assert.Equal(t, 0, len(c.SlowLog(0)))
+
+	// fast operations are not recorded
+	c2, err := NewCache(WithShards(4), WithSlowLog(time.Hour, 3))
+	assert.Nil(t, err)
+	defer c2.Close()
+	assert.Nil(t, c2.Set("key", []byte("value")))
+	assert.Equal(t, 0, len(c2.SlowLog(0)))
+}
+
+func TestCacheMeta(t *testing.T) {
+	clock := &mockClock{}
+	clock.set(1000)
+	c, err := NewCache(WithShards(4), WithClock(clock), WithTTL(60))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	assert.Nil(t, c.Set("key", []byte("value")))
+	assert.Nil(t, c.SetBin([]byte("big"), createValue(3*64*1024, 1)))
+	clock.set(1010)
+
+	meta, err := c.Meta("key")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(1000, 0), meta.Created)
+	assert.Equal(t, 50*time.Second, meta.TTL)
+	assert.Equal(t, 5, meta.ValueSize)
+	assert.False(t, meta.Fragmented)
+
+	meta, err = c.MetaBin([]byte("big"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3*64*1024, meta.ValueSize)
+	assert.True(t, meta.Fragmented)
+
+	_, err = c.Meta("missing")
+	assert.Equal(t, ErrEntryNotFound, err)
+
+	clock.set(1061)
+	_, err = c.Meta("key")
+	assert.Equal(t, ErrEntryNotFound, err)
+}
+
+func TestCacheSetWithMeta(t *testing.T) {
+	c, err := NewCache(WithShards(4))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	metadata := []byte("Content-Type: text/plain\n")
+	assert.Nil(t, c.SetWithMeta("key", []byte("value"), metadata))
+	assert.Nil(t, c.Set("plain", []byte("value")))
+
+	v, m, err := c.GetWithMeta("key")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), v)
+	assert.Equal(t, metadata, m)
+
+	// the metadata is stripped and retBuf is kept
+	v, err = c.GetBin([]byte("prefix-"), []byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("prefix-value"), v)
+
+	v, m, err = c.GetWithMeta("plain")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), v)
+	assert.Nil(t, m)
+
+	meta, err := c.Meta("key")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, meta.ValueSize)
+	assert.Equal(t, metadata, meta.Metadata)
+
+	// the value fits into a block only without the metadata
+	big := createValue(defaultValueSizeInBytes-1, 1)
+	assert.Nil(t, c.SetWithMeta("big", big, metadata))
+
+	v, m, err = c.GetWithMeta("big")
+	assert.Nil(t, err)
+	assert.Equal(t, big, v)
+	assert.Equal(t, metadata, m)
+
+	meta, err = c.Meta("big")
+	assert.Nil(t, err)
+	assert.Equal(t, len(big), meta.ValueSize)
+	assert.True(t, meta.Fragmented)
+	assert.Equal(t, metadata, meta.Metadata)
+
+	err = c.SetWithMeta("key", []byte("value"), make([]byte, maxMetadataSizeInBytes+1))
+	assert.Equal(t, ErrMetadataTooBig, err)
+}
+
+func TestCacheGetRange(t *testing.T) {
+	c, err := NewCache(WithShards(4), WithStatsEnabled())
+	assert.Nil(t, err)
+	defer c.Close()
+
+	small := createValue(100, 1)
+	assert.Nil(t, c.SetWithMeta("small", small, []byte("Content-Type: text/plain\n")))
+
+	v, err := c.GetRangeBin([]byte("prefix-"), []byte("small"), 10, 20)
+	assert.Nil(t, err)
+	assert.Equal(t, append([]byte("prefix-"), small[10:30]...), v)
+
+	_, err = c.GetRange("small", 90, 11)
+	assert.Equal(t, ErrInvalidRange, err)
+
+	big := createValue(3*fragmentSizeInBytes+100, 2)
+	assert.Nil(t, c.Set("big", big))
+
+	ranges := []struct{ offset, length, fragments int }{
+		{0, 10, 1},
+		{fragmentSizeInBytes - 5, 10, 2},
+		{fragmentSizeInBytes + 5, fragmentSizeInBytes, 2},
+		{3 * fragmentSizeInBytes, 100, 1},
+		{10, 2*fragmentSizeInBytes + 10, 3},
+		{0, len(big), 4},
+	}
+	for _, r := range ranges {
+		var before, after CacheStats
+		c.LoadStats(&before)
+
+		v, err = c.GetRange("big", r.offset, r.length)
+		assert.Nil(t, err)
+		assert.Equal(t, big[r.offset:r.offset+r.length], v)
+
+		// only the fragments overlapping the range are read with the metadata entry
+		c.LoadStats(&after)
+		assert.Equal(t, uint64(r.fragments+1), after.Hits-before.Hits)
+	}
+
+	v, err = c.GetRange("big", 5, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, v)
+
+	_, err = c.GetRange("big", len(big)-10, 11)
+	assert.Equal(t, ErrInvalidRange, err)
+
+	_, err = c.GetRange("missing", 0, 1)
+	assert.Equal(t, ErrEntryNotFound, err)
+
+	// the range is read only from the value with the expected hash
+	for key, value := range map[string][]byte{"small": small, "big": big} {
+		meta, err := c.Meta(key)
+		assert.Nil(t, err)
+
+		v, err = c.GetRangeBinWithHash(nil, []byte(key), 1, 10, meta.Hash)
+		assert.Nil(t, err)
+		assert.Equal(t, value[1:11], v)
+
+		assert.Nil(t, c.Set(key, value[:len(value)-1]))
+		_, err = c.GetRangeBinWithHash(nil, []byte(key), 1, 10, meta.Hash)
+		assert.Equal(t, ErrEntryChanged, err, key)
+	}
+}
+
+func TestCacheSetReader_WriteTo(t *testing.T) {
+	c, err := NewCache(WithShards(4), WithMaxValueSize(1024*1024))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	small := createValue(100, 1)
+	big := createValue(3*fragmentSizeInBytes+100, 2)
+	metadata := []byte("Content-Type: text/plain\n")
+
+	assert.Nil(t, c.SetReader([]byte("small"), bytes.NewReader(small), int64(len(small))))
+	// the size of the value is unknown
+	assert.Nil(t, c.SetReaderWithMeta([]byte("big"), bytes.NewReader(big), -1, metadata))
+
+	v, err := c.Get("small")
+	assert.Nil(t, err)
+	assert.Equal(t, small, v)
+
+	v, m, err := c.GetWithMeta("big")
+	assert.Nil(t, err)
+	assert.Equal(t, big, v)
+	assert.Equal(t, metadata, m)
+
+	v, err = c.GetRange("big", fragmentSizeInBytes-10, 20)
+	assert.Nil(t, err)
+	assert.Equal(t, big[fragmentSizeInBytes-10:fragmentSizeInBytes+10], v)
+
+	for key, want := range map[string][]byte{"small": small, "big": big} {
+		var buf bytes.Buffer
+		n, err := c.WriteTo([]byte(key), &buf)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(want)), n)
+		assert.Equal(t, want, buf.Bytes())
+	}
+
+	_, err = c.WriteTo([]byte("missing"), ioutil.Discard)
+	assert.Equal(t, ErrEntryNotFound, err)
+
+	// the value is written only if it has the expected hash
+	for key, want := range map[string][]byte{"small": small, "big": big} {
+		meta, err := c.Meta(key)
+		assert.Nil(t, err)
+
+		var buf bytes.Buffer
+		_, err = c.WriteToWithHash([]byte(key), &buf, meta.Hash)
+		assert.Nil(t, err)
+		assert.Equal(t, want, buf.Bytes())
+
+		hash, err := c.SetReaderWithMetaHash([]byte(key), bytes.NewReader(want[1:]), -1, nil)
+		assert.Nil(t, err)
+		buf.Reset()
+		_, err = c.WriteToWithHash([]byte(key), &buf, meta.Hash)
+		assert.Equal(t, ErrEntryChanged, err, key)
+		assert.Empty(t, buf.Bytes())
+
+		// the returned hash is the hash of the stored value
+		meta, err = c.Meta(key)
+		assert.Nil(t, err)
+		assert.Equal(t, meta.Hash, hash, key)
+	}
+
+	// the max value size is enforced while the value is read
+	err = c.SetReader([]byte("huge"), bytes.NewReader(createValue(1024*1024, 3)), -1)
+	assert.Equal(t, ErrEntryValueTooBig, err)
+	err = c.SetReader([]byte("huge"), bytes.NewReader(nil), 1024*1024)
+	assert.Equal(t, ErrEntryValueTooBig, err)
+	_, err = c.Get("huge")
+	assert.Equal(t, ErrEntryNotFound, err)
+
+	err = c.SetReader([]byte("short"), bytes.NewReader(big[:100000]), int64(len(big)))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = c.Get("short")
+	assert.Equal(t, ErrEntryNotFound, err)
+}
+
+func TestCacheSubscribe(t *testing.T) {
+	clock := &mockClock{}
+	clock.set(1000)
+	c, err := NewCache(WithShards(1), WithMaxBytes(4*64*1024), WithClock(clock), WithTTL(60))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	sub := c.Subscribe([]byte("a/"))
+	defer sub.Close()
+
+	assert.Nil(t, c.Set("a/1", []byte("value")))
+	assert.Nil(t, c.Set("b/1", []byte("value")))
+	// the fragments of the value aren't published
+	assert.Nil(t, c.SetBin([]byte("a/big"), createValue(100*1024, 1)))
+	assert.Nil(t, c.SetReader([]byte("a/stream"), bytes.NewReader(createValue(100, 2)), -1))
+	assert.Nil(t, c.Del("a/1"))
+	assert.Equal(t, ErrEntryNotFound, c.Del("a/missing"))
+	assert.Nil(t, c.Del("b/1"))
+	assert.Equal(t, []string{"set a/1", "set a/big", "set a/stream", "delete a/1"}, drainEvents(sub))
+
+	// the expired entry is published once until it's deleted
+	clock.set(1061)
+	for i := 0; i < 2; i++ {
+		_, err = c.Get("a/big")
+		assert.Equal(t, ErrEntryNotFound, err)
+	}
+	assert.Equal(t, []string{"expire a/big"}, drainEvents(sub))
+
+	evictions := c.Subscribe([]byte("c/"))
+	defer evictions.Close()
+
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, c.Set(fmt.Sprintf("c/%d", i), createValue(1024, i)))
+	}
+
+	evicted := 0
+	for _, e := range drainEvents(evictions) {
+		if strings.HasPrefix(e, "evict c/") {
+			evicted++
+		}
+	}
+	assert.True(t, evicted > 0)
+	// the fragments of the expired value are evicted without events
+	assert.Equal(t, []string{"evict a/stream"}, drainEvents(sub))
+
+	// the subscriber which doesn't read the events is dropped instead of blocking the writes
+	for i := 0; i <= defaultEventBufferSize; i++ {
+		assert.Nil(t, c.Set(fmt.Sprintf("a/%d", i), []byte("value")))
+	}
+
+	select {
+	case <-sub.Dropped():
+	default:
+		t.Fatal("slow subscriber is not dropped")
+	}
+	assert.Len(t, drainEvents(sub), defaultEventBufferSize)
+
+	assert.Nil(t, c.Set("a/after", []byte("value")))
+	assert.Empty(t, drainEvents(sub))
+
+	sub.Close()
+	var stats CacheStats
+	c.LoadStats(&stats)
+	assert.Equal(t, uint64(1), stats.EventSubscribers)
+	assert.Equal(t, uint64(1), stats.DroppedSubscribers)
+}
+
+func TestCacheWatch(t *testing.T) {
+	clock := &mockClock{}
+	clock.set(1000)
+	c, err := NewCache(WithShards(4), WithClock(clock), WithTTL(60))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	set := c.Watch(context.Background(), []byte("key"))
+	other := c.NewWatcher([]byte("other"))
+
+	// the watcher fires once
+	assert.Nil(t, c.Set("key", []byte("value")))
+	assert.Nil(t, c.Set("key", []byte("value 2")))
+	e, ok := <-set
+	assert.True(t, ok)
+	assert.Equal(t, EventSet, e.Type)
+	assert.Equal(t, []byte("key"), e.Key)
+	_, ok = <-set
+	assert.False(t, ok)
+
+	deleted := c.Watch(context.Background(), []byte("key"))
+	assert.Nil(t, c.Del("key"))
+	assert.Equal(t, EventDelete, (<-deleted).Type)
+
+	assert.Nil(t, c.Set("other", []byte("value")))
+	clock.set(1061)
+	expired := c.Watch(context.Background(), []byte("other"))
+	_, err = c.Get("other")
+	assert.Equal(t, ErrEntryNotFound, err)
+	assert.Equal(t, EventExpire, (<-expired).Type)
+	assert.Equal(t, EventSet, (<-other.Event()).Type)
+	other.Close()
+
+	// the watcher is removed once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := c.Watch(ctx, []byte("key"))
+	var stats CacheStats
+	c.LoadStats(&stats)
+	assert.Equal(t, uint64(1), stats.Watchers)
+
+	cancel()
+	_, ok = <-canceled
+	assert.False(t, ok)
+
+	stats = CacheStats{}
+	c.LoadStats(&stats)
+	assert.Empty(t, stats.Watchers)
+}
+
 func TestCacheGetSetConcurrently(t *testing.T) {
 	itemsCount := 10000
 	const goroutines = 20
@@ -252,3 +1304,31 @@ func createValue(size, seed int) []byte {
 	}
 	return buf
 }
+
+// drainEvents returns the buffered events of the subscription as "type key"
+func drainEvents(sub *Subscription) []string {
+	var events []string
+	for {
+		select {
+		case e := <-sub.Events():
+			events = append(events, e.Type.String()+" "+string(e.Key))
+		default:
+			return events
+		}
+	}
+}
+
+// mockClock is a clock moved by the tests
+type mockClock struct {
+	now int64
+}
+
+func (c *mockClock) Now() int64 {
+	return atomic.LoadInt64(&c.now)
+}
+
+func (c *mockClock) Stop() {}
+
+func (c *mockClock) set(now int64) {
+	atomic.StoreInt64(&c.now, now)
+}
@@ -0,0 +1,357 @@
+package distrox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ziyasal/distroxy/internal/pkg/common"
+)
+
+const (
+	defaultDiskSegmentSizeInBytes = 64 * 1024 * 1024
+	diskSegmentFileExt            = ".seg"
+
+	// disk location packs segment sequence and offset in the segment
+	diskLocationOffsetBits = 32
+	diskLocationOffsetMask = (1 << diskLocationOffsetBits) - 1
+	// maxDiskSegmentSeq keeps the location below the on-disk entry flag bit
+	maxDiskSegmentSeq = 1<<(diskEntryFlagBit-diskLocationOffsetBits) - 1
+
+	// maxDiskPendingBytes caps the entries queued to be written, the entries are written
+	// by the caller once it's exceeded so a slow disk doesn't grow the queue without a limit
+	maxDiskPendingBytes = 16 * 1024 * 1024
+)
+
+var ErrDiskSegmentNotFound = errors.New("disk segment not found")
+
+// diskTier stores entries evicted from the memory in append-only segment files,
+// the oldest segments are removed when the tier exceeds its size limit and
+// segments without live entries are removed as soon as they are not written anymore.
+// The appended entries are written by a writer goroutine, so the shards don't wait for
+// the disk while they hold their locks, they are read from the queue until they are written.
+type diskTier struct {
+	mu sync.RWMutex
+
+	dir             string
+	maxBytes        int64
+	segmentMaxBytes int64
+
+	// segments are ordered by their sequence, the last one is the active segment
+	segments []*diskSegment
+	nextSeq  uint64
+
+	sizeInBytes int64
+
+	// pending holds the appended entries not written yet in the order they are appended
+	pending      []*diskWrite
+	pendingBytes int64
+	wake         chan struct{}
+	done         chan struct{}
+	wg           sync.WaitGroup
+	closeOnce    sync.Once
+	logger       common.Logger
+}
+
+// diskWrite is a batch of appended entries to be written to the offset of the segment
+type diskWrite struct {
+	segment *diskSegment
+	offset  int64
+	buf     []byte
+}
+
+type diskSegment struct {
+	seq  uint64
+	f    *os.File
+	size int64
+	// live is a number of entries in the segment which are still referenced by shard indexes
+	live int64
+}
+
+func newDiskTier(dir string, maxBytes int64, segmentMaxBytes int64, logger common.Logger) (*diskTier, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("disk tier size must be positive: %d", maxBytes)
+	}
+
+	if segmentMaxBytes > diskLocationOffsetMask {
+		return nil, fmt.Errorf("disk segment size: %d exceeds max segment size: %d",
+			segmentMaxBytes, int64(diskLocationOffsetMask))
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	// entries can't be recovered since the indexes are kept in memory
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+diskSegmentFileExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &diskTier{
+		dir:             dir,
+		maxBytes:        maxBytes,
+		segmentMaxBytes: segmentMaxBytes,
+		wake:            make(chan struct{}, 1),
+		done:            make(chan struct{}),
+		logger:          logger,
+	}
+
+	d.wg.Add(1)
+	go d.writer()
+
+	return d, nil
+}
+
+// append queues encoded entries to be written to the active segment and returns
+// the location of the first byte, entries are never split between segments.
+func (d *diskTier) append(entries []byte, count int64) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	size := int64(len(entries))
+	active := d.activeSegment()
+	if active == nil || active.size+size > d.segmentMaxBytes {
+		var err error
+		active, err = d.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if d.pendingBytes+size > maxDiskPendingBytes {
+		if _, err := active.f.WriteAt(entries, active.size); err != nil {
+			return 0, err
+		}
+	} else {
+		d.pending = append(d.pending, &diskWrite{
+			segment: active,
+			offset:  active.size,
+			buf:     append([]byte(nil), entries...),
+		})
+		d.pendingBytes += size
+
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	location := active.seq<<diskLocationOffsetBits | uint64(active.size)
+	active.size += size
+	active.live += count
+	atomic.AddInt64(&d.sizeInBytes, size)
+
+	d.collect()
+
+	return location, nil
+}
+
+// writer writes the queued entries to the segments until the tier is closed
+func (d *diskTier) writer() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case <-d.wake:
+			d.flush()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// flush writes the queued entries without holding the lock, so the entries can be appended and read
+// meanwhile, they are read from the queue until they are written. The writes of the segments removed
+// in the meantime are dropped.
+func (d *diskTier) flush() {
+	d.mu.RLock()
+	writes := append([]*diskWrite(nil), d.pending...)
+	d.mu.RUnlock()
+
+	for _, w := range writes {
+		if _, err := w.segment.f.WriteAt(w.buf, w.offset); err != nil && !errors.Is(err, os.ErrClosed) {
+			d.logger.Err("entries could not be written to the disk tier", err)
+		}
+	}
+
+	d.mu.Lock()
+	n := copy(d.pending, d.pending[len(writes):])
+	for i := n; i < len(d.pending); i++ {
+		d.pending[i] = nil
+	}
+	d.pending = d.pending[:n]
+	for _, w := range writes {
+		d.pendingBytes -= int64(len(w.buf))
+	}
+	d.mu.Unlock()
+}
+
+// readAt reads len(buf) bytes from the location
+func (d *diskTier) readAt(buf []byte, location uint64) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	segment := d.segment(location >> diskLocationOffsetBits)
+	if segment == nil {
+		return ErrDiskSegmentNotFound
+	}
+
+	offset := int64(location & diskLocationOffsetMask)
+	if offset+int64(len(buf)) > segment.size {
+		return io.ErrUnexpectedEOF
+	}
+
+	// the entries are appended together, so the range is in a single write
+	for _, w := range d.pending {
+		if w.segment == segment && offset >= w.offset && offset+int64(len(buf)) <= w.offset+int64(len(w.buf)) {
+			copy(buf, w.buf[offset-w.offset:])
+			return nil
+		}
+	}
+
+	_, err := segment.f.ReadAt(buf, offset)
+	return err
+}
+
+// release marks an entry in the location as not referenced anymore
+func (d *diskTier) release(location uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	segment := d.segment(location >> diskLocationOffsetBits)
+	if segment == nil {
+		return
+	}
+
+	segment.live--
+	d.collect()
+}
+
+// reset removes all segments
+func (d *diskTier) reset() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var err error
+	for _, segment := range d.segments {
+		if e := segment.remove(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	d.segments = nil
+	atomic.StoreInt64(&d.sizeInBytes, 0)
+
+	return err
+}
+
+// close stops the writer and removes all segments, the queued entries aren't written
+func (d *diskTier) close() error {
+	d.stopWriter()
+	return d.reset()
+}
+
+func (d *diskTier) stopWriter() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+	d.wg.Wait()
+}
+
+// bytes returns the size of the segments on the disk
+func (d *diskTier) bytes() uint64 {
+	return uint64(atomic.LoadInt64(&d.sizeInBytes))
+}
+
+// segmentsLen returns the number of segment files
+func (d *diskTier) segmentsLen() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return uint64(len(d.segments))
+}
+
+func (d *diskTier) activeSegment() *diskSegment {
+	if len(d.segments) == 0 {
+		return nil
+	}
+
+	return d.segments[len(d.segments)-1]
+}
+
+func (d *diskTier) segment(seq uint64) *diskSegment {
+	if len(d.segments) == 0 || seq < d.segments[0].seq {
+		return nil
+	}
+
+	// segments are sorted by sequence but can have gaps after collected
+	for _, segment := range d.segments {
+		if segment.seq == seq {
+			return segment
+		}
+	}
+
+	return nil
+}
+
+func (d *diskTier) rotate() (*diskSegment, error) {
+	if d.nextSeq > maxDiskSegmentSeq {
+		return nil, fmt.Errorf("disk segment sequence exceeds max: %d", maxDiskSegmentSeq)
+	}
+
+	path := filepath.Join(d.dir, fmt.Sprintf("%016x%s", d.nextSeq, diskSegmentFileExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	segment := &diskSegment{seq: d.nextSeq, f: f}
+	d.nextSeq++
+	d.segments = append(d.segments, segment)
+
+	return segment, nil
+}
+
+// collect removes the oldest segments while the tier exceeds its size limit
+// and the segments which don't have any live entry, the active segment is kept.
+func (d *diskTier) collect() {
+	last := len(d.segments) - 1
+	kept := d.segments[:0]
+	size := atomic.LoadInt64(&d.sizeInBytes)
+
+	for i, segment := range d.segments {
+		if i != last && (segment.live <= 0 || size > d.maxBytes) {
+			size -= segment.size
+			_ = segment.remove()
+			continue
+		}
+
+		kept = append(kept, segment)
+	}
+
+	for i := len(kept); i < len(d.segments); i++ {
+		d.segments[i] = nil
+	}
+
+	d.segments = kept
+	atomic.StoreInt64(&d.sizeInBytes, size)
+}
+
+func (s *diskSegment) remove() error {
+	path := s.f.Name()
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,188 @@
+package distrox
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ziyasal/distroxy/internal/pkg/common"
+)
+
+// defaultEventBufferSize is the number of the events buffered for each subscriber
+const defaultEventBufferSize = 1024
+
+// EventType is the type of a keyspace change
+type EventType uint8
+
+const (
+	// EventSet is published when the key is stored
+	EventSet EventType = iota + 1
+	// EventDelete is published when the key is deleted
+	EventDelete
+	// EventExpire is published when the entry is found expired, entries expire lazily
+	// so it's published once the expired entry is read
+	EventExpire
+	// EventEvict is published when the entry is removed since its block is overwritten
+	// or its disk tier segment is removed
+	EventEvict
+)
+
+var eventTypeNames = [...]string{"unknown", "set", "delete", "expire", "evict"}
+
+func (t EventType) String() string {
+	if int(t) >= len(eventTypeNames) {
+		return eventTypeNames[0]
+	}
+
+	return eventTypeNames[t]
+}
+
+// Event is a change of a key
+type Event struct {
+	Type EventType
+	// Key is shared by the subscribers, it must not be modified
+	Key  []byte
+	Time time.Time
+}
+
+// Subscription receives the events of the keys with its prefix
+type Subscription struct {
+	prefix []byte
+	events chan Event
+	bus    *eventBus
+
+	// dropped is closed once the subscriber is dropped
+	dropped     chan struct{}
+	droppedFlag int32
+	closeOnce   sync.Once
+}
+
+// Events returns the channel of the events, it's never closed
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the channel closed when the subscriber is dropped since its buffer is full,
+// no events are sent to it after that and the buffered ones are followed by a gap.
+func (s *Subscription) Dropped() <-chan struct{} {
+	return s.dropped
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		s.bus.unsubscribe(s)
+	})
+}
+
+func (s *Subscription) drop() {
+	if atomic.CompareAndSwapInt32(&s.droppedFlag, 0, 1) {
+		close(s.dropped)
+		atomic.AddUint64(&s.bus.droppedSubscribers, 1)
+	}
+}
+
+// eventBus publishes the keyspace changes to the subscribers without blocking the writers,
+// a subscriber which doesn't keep up is dropped instead
+type eventBus struct {
+	bufferSize int
+	hash       common.Hasher
+
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+	// count is the number of the subscribers, so publishers skip the lock without them
+	count int32
+
+	// watchers are looked up by the key hash, so the publishers don't check each of them
+	watchers     [watcherShards]watcherShard
+	watcherCount int32
+
+	droppedSubscribers uint64
+}
+
+func newEventBus(bufferSize int, hash common.Hasher) *eventBus {
+	b := &eventBus{bufferSize: bufferSize, hash: hash, subs: make(map[*Subscription]struct{})}
+	for i := range b.watchers {
+		b.watchers[i].watchers = make(map[uint64][]*Watcher)
+	}
+
+	return b
+}
+
+func (b *eventBus) active() bool {
+	return b != nil && (atomic.LoadInt32(&b.count) > 0 || atomic.LoadInt32(&b.watcherCount) > 0)
+}
+
+func (b *eventBus) subscribe(prefix []byte) *Subscription {
+	s := &Subscription{
+		prefix:  append([]byte(nil), prefix...),
+		events:  make(chan Event, b.bufferSize),
+		bus:     b,
+		dropped: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	atomic.StoreInt32(&b.count, int32(len(b.subs)))
+	b.mu.Unlock()
+
+	return s
+}
+
+func (b *eventBus) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	delete(b.subs, s)
+	atomic.StoreInt32(&b.count, int32(len(b.subs)))
+	b.mu.Unlock()
+}
+
+// publish sends the event of the key to the subscribers of its prefix and the watchers of the key,
+// the key is copied once it matches. It never blocks, so it's called while the shard lock is held.
+func (b *eventBus) publish(typ EventType, key []byte) {
+	if !b.active() {
+		return
+	}
+
+	var e Event
+	event := func() Event {
+		if e.Type == 0 {
+			e = Event{Type: typ, Key: append([]byte(nil), key...), Time: time.Now()}
+		}
+		return e
+	}
+
+	if atomic.LoadInt32(&b.watcherCount) > 0 {
+		b.fire(key, event)
+	}
+
+	if atomic.LoadInt32(&b.count) == 0 {
+		return
+	}
+
+	b.mu.RLock()
+	for s := range b.subs {
+		if atomic.LoadInt32(&s.droppedFlag) != 0 || !bytes.HasPrefix(key, s.prefix) {
+			continue
+		}
+
+		select {
+		case s.events <- event():
+		default:
+			s.drop()
+		}
+	}
+	b.mu.RUnlock()
+}
+
+func (b *eventBus) subscribers() uint64 {
+	return uint64(atomic.LoadInt32(&b.count))
+}
+
+// Subscribe returns the subscription to the set, delete, expire and evict events of the keys with the prefix,
+// all of the keys for an empty prefix. The events are buffered up to the size set by WithEventBuffer,
+// the subscriber is dropped once its buffer is full, see Subscription.Dropped. It must be closed when
+// it's not used anymore.
+func (c *Cache) Subscribe(prefix []byte) *Subscription {
+	return c.events.subscribe(prefix)
+}
@@ -0,0 +1,261 @@
+package distrox
+
+import (
+	"sync/atomic"
+)
+
+const (
+	defaultClockReferenceBits = 1 << 16
+	defaultTinyLFUCounters    = 1 << 16
+	// a cache-aside miss records both the get and the set of the key
+	defaultTinyLFUMinFreq = 3
+
+	tinyLFUDepth = 4
+	// counters are 4 bits wide like the counters of the TinyLFU paper
+	tinyLFUCounterBits     = 4
+	tinyLFUCountersPerWord = 64 / tinyLFUCounterBits
+	tinyLFUMaxCount        = 1<<tinyLFUCounterBits - 1
+	// tinyLFUHalfMask clears the bit shifted into the top of each counter while halving
+	tinyLFUHalfMask = 0x7777777777777777
+	// tinyLFUSampleFactor is the number of recorded accesses per counter before the counters are halved,
+	// a longer sample saturates the counters with the keys read once and every key gets admitted
+	tinyLFUSampleFactor = 1
+	// tinyLFUDoorkeeperBits is the number of doorkeeper bits per recorded access of the sample,
+	// it keeps the keys accessed once from colliding with the bits of the others
+	tinyLFUDoorkeeperBits = 8
+)
+
+// EvictionPolicy decides what happens to the live entries of the ring buffer block
+// which is going to be overwritten. Policies are created per shard, Touch can be
+// called concurrently while Reinsert and Reset are called under the shard write lock.
+type EvictionPolicy interface {
+	// Touch records a read of the entry
+	Touch(h uint64)
+	// Reinsert reports whether the live entry should be re-appended at the head of the ring
+	// instead of being evicted
+	Reinsert(h uint64) bool
+	// Reset forgets all recorded reads
+	Reset()
+}
+
+// AdmissionFilter decides whether a new entry is stored once the ring buffer is full,
+// filters are created per shard and must be safe for concurrent use.
+type AdmissionFilter interface {
+	// Record records an access (read or write) of the entry
+	Record(h uint64)
+	// Admit reports whether the new entry should replace the oldest entries
+	Admit(h uint64) bool
+	// Reset forgets all recorded accesses
+	Reset()
+}
+
+// fifoPolicy overwrites the oldest block regardless of how hot its entries are
+type fifoPolicy struct{}
+
+// NewFIFOPolicy returns the default eviction policy
+func NewFIFOPolicy() EvictionPolicy {
+	return fifoPolicy{}
+}
+
+func (fifoPolicy) Touch(_ uint64) {
+	// no op
+}
+
+func (fifoPolicy) Reinsert(_ uint64) bool {
+	return false
+}
+
+func (fifoPolicy) Reset() {
+	// no op
+}
+
+// clockPolicy is a second chance (CLOCK) policy, entries read since they are written
+// (or re-appended) are re-appended once at the head instead of being evicted.
+// Reference bits are addressed by the key hash, so colliding keys share a bit.
+type clockPolicy struct {
+	bits []uint64
+	mask uint64
+}
+
+// NewClockPolicy returns a second chance policy with the given number of reference bits,
+// it's rounded up to a power of two.
+func NewClockPolicy(referenceBits int) EvictionPolicy {
+	size := nextPowerOfTwo(referenceBits)
+	if size < 64 {
+		size = 64
+	}
+
+	return &clockPolicy{
+		bits: make([]uint64, size/64),
+		mask: uint64(size - 1),
+	}
+}
+
+func (p *clockPolicy) Touch(h uint64) {
+	setBit(p.bits, h&p.mask)
+}
+
+func (p *clockPolicy) Reinsert(h uint64) bool {
+	return clearBit(p.bits, h&p.mask)
+}
+
+func (p *clockPolicy) Reset() {
+	for i := range p.bits {
+		atomic.StoreUint64(&p.bits[i], 0)
+	}
+}
+
+// tinyLFU is a TinyLFU style admission filter, accesses are counted in a count-min sketch
+// behind a doorkeeper bloom filter so one-hit-wonders don't pollute the counters.
+// Counters are 4 bits wide and packed into words, so the sketch takes 2 bytes per counter column.
+// Counters are halved and the doorkeeper is cleared periodically to keep the frequencies fresh.
+type tinyLFU struct {
+	counters   []uint64
+	doorkeeper []uint64
+	mask       uint64
+	// doorkeeperMask masks the doorkeeper bits, it's sized by the accesses of the sample
+	doorkeeperMask uint64
+
+	minFrequency uint32
+	samples      uint64
+	sampleSize   uint64
+}
+
+// NewTinyLFU returns an admission filter which admits the entries accessed
+// at least minFrequency times recently, counters is rounded up to a power of two.
+// Counters should be about the number of entries a shard holds, the filter takes
+// about 3.25 bytes per counter.
+func NewTinyLFU(counters int, minFrequency uint32) AdmissionFilter {
+	width := nextPowerOfTwo(counters)
+	if width < 64 {
+		width = 64
+	}
+
+	sampleSize := tinyLFUSampleFactor * width
+	doorkeeperBits := nextPowerOfTwo(tinyLFUDoorkeeperBits * sampleSize)
+
+	return &tinyLFU{
+		counters:       make([]uint64, tinyLFUDepth*width/tinyLFUCountersPerWord),
+		doorkeeper:     make([]uint64, doorkeeperBits/64),
+		mask:           uint64(width - 1),
+		doorkeeperMask: uint64(doorkeeperBits - 1),
+		minFrequency:   minFrequency,
+		sampleSize:     uint64(sampleSize),
+	}
+}
+
+func (t *tinyLFU) Record(h uint64) {
+	if atomic.AddUint64(&t.samples, 1)%t.sampleSize == 0 {
+		t.age()
+	}
+
+	// the first access is only recorded by the doorkeeper
+	if !setBit(t.doorkeeper, t.doorkeeperIndex(h)) {
+		return
+	}
+
+	for i := uint64(0); i < tinyLFUDepth; i++ {
+		word, shift := t.counterIndex(h, i)
+		for {
+			w := atomic.LoadUint64(&t.counters[word])
+			if (w>>shift)&tinyLFUMaxCount == tinyLFUMaxCount ||
+				atomic.CompareAndSwapUint64(&t.counters[word], w, w+1<<shift) {
+				break
+			}
+		}
+	}
+}
+
+func (t *tinyLFU) Admit(h uint64) bool {
+	return t.estimate(h) >= t.minFrequency
+}
+
+func (t *tinyLFU) Reset() {
+	for i := range t.counters {
+		atomic.StoreUint64(&t.counters[i], 0)
+	}
+	for i := range t.doorkeeper {
+		atomic.StoreUint64(&t.doorkeeper[i], 0)
+	}
+	atomic.StoreUint64(&t.samples, 0)
+}
+
+// estimate returns the minimum of the counters plus the doorkeeper bit
+func (t *tinyLFU) estimate(h uint64) uint32 {
+	idx := t.doorkeeperIndex(h)
+	if atomic.LoadUint64(&t.doorkeeper[idx/64])&(1<<(idx%64)) == 0 {
+		return 0
+	}
+
+	min := uint32(tinyLFUMaxCount)
+	for i := uint64(0); i < tinyLFUDepth; i++ {
+		word, shift := t.counterIndex(h, i)
+		if c := uint32(atomic.LoadUint64(&t.counters[word])>>shift) & tinyLFUMaxCount; c < min {
+			min = c
+		}
+	}
+
+	return min + 1
+}
+
+// age halves the counters and clears the doorkeeper, concurrent records might be lost
+func (t *tinyLFU) age() {
+	for i := range t.counters {
+		atomic.StoreUint64(&t.counters[i], (atomic.LoadUint64(&t.counters[i])>>1)&tinyLFUHalfMask)
+	}
+	for i := range t.doorkeeper {
+		atomic.StoreUint64(&t.doorkeeper[i], 0)
+	}
+}
+
+// counterIndex uses double hashing to find the counter of the row,
+// it returns the word of the counter and the shift of the counter in the word.
+func (t *tinyLFU) counterIndex(h uint64, row uint64) (uint64, uint64) {
+	h2 := (h >> 32) | 1
+	idx := row*(t.mask+1) + ((h + row*h2) & t.mask)
+	return idx / tinyLFUCountersPerWord, (idx % tinyLFUCountersPerWord) * tinyLFUCounterBits
+}
+
+// doorkeeperIndex mixes the hash, so the doorkeeper bit doesn't follow the counter of the first row
+func (t *tinyLFU) doorkeeperIndex(h uint64) uint64 {
+	return (h * 0x9e3779b97f4a7c15 >> 32) & t.doorkeeperMask
+}
+
+// setBit sets the bit and reports whether it was already set
+func setBit(bits []uint64, idx uint64) bool {
+	word := &bits[idx/64]
+	bit := uint64(1) << (idx % 64)
+	for {
+		old := atomic.LoadUint64(word)
+		if old&bit != 0 {
+			return true
+		}
+		if atomic.CompareAndSwapUint64(word, old, old|bit) {
+			return false
+		}
+	}
+}
+
+// clearBit clears the bit and reports whether it was set
+func clearBit(bits []uint64, idx uint64) bool {
+	word := &bits[idx/64]
+	bit := uint64(1) << (idx % 64)
+	for {
+		old := atomic.LoadUint64(word)
+		if old&bit == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(word, old, old&^bit) {
+			return true
+		}
+	}
+}
+
+func nextPowerOfTwo(n int) int {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+
+	return size
+}
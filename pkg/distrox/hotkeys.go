@@ -0,0 +1,231 @@
+package distrox
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ziyasal/distroxy/internal/pkg/common"
+)
+
+const (
+	hotKeysDepth = 4
+	// hotKeysWidthFactor is the number of sketch counters per row for each tracked key
+	hotKeysWidthFactor = 64
+	hotKeysMinWidth    = 1024
+)
+
+// HotKey is a frequently accessed key
+type HotKey struct {
+	Key string `json:"key"`
+	// Count is the estimated number of accesses since the counts are last decayed
+	Count uint64 `json:"count"`
+	// Shard is the index of the shard of the key
+	Shard int `json:"shard"`
+}
+
+// hotKeys is a streaming top-K tracker, one in sampleRate gets and sets are counted in
+// a count-min sketch and the keys with the highest estimates are kept in a min-heap.
+// The counters and the counts of the heap are halved every decayInSeconds, so keys which
+// are not hot anymore drop out of the heap.
+type hotKeys struct {
+	mu sync.Mutex
+
+	sketch []uint32
+	mask   uint64
+
+	k     int
+	heap  hotKeyHeap
+	index map[uint64]*hotKey
+
+	clock          common.Clock
+	decayInSeconds int64
+	lastDecay      int64
+
+	sampleRate uint64
+	samples    uint64
+}
+
+type hotKey struct {
+	key   string
+	hash  uint64
+	count uint32
+	// pos is the position of the key in the heap
+	pos int
+}
+
+func newHotKeys(k int, sampleRate int, decayInSeconds int64, clock common.Clock) *hotKeys {
+	width := nextPowerOfTwo(k * hotKeysWidthFactor)
+	if width < hotKeysMinWidth {
+		width = hotKeysMinWidth
+	}
+
+	return &hotKeys{
+		sketch:         make([]uint32, hotKeysDepth*width),
+		mask:           uint64(width - 1),
+		k:              k,
+		index:          make(map[uint64]*hotKey, k),
+		clock:          clock,
+		decayInSeconds: decayInSeconds,
+		lastDecay:      clock.Now(),
+		sampleRate:     uint64(sampleRate),
+	}
+}
+
+// sample records an access of the key once in sampleRate calls
+func (t *hotKeys) sample(key []byte, hash common.Hasher) {
+	if atomic.AddUint64(&t.samples, 1)%t.sampleRate != 0 {
+		return
+	}
+
+	t.record(key, hash.Hash(key))
+}
+
+func (t *hotKeys) record(key []byte, h uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now := t.clock.Now(); t.decayInSeconds > 0 && now-t.lastDecay >= t.decayInSeconds {
+		t.decay()
+		t.lastDecay = now
+	}
+
+	estimate := t.increment(h)
+
+	if hk, ok := t.index[h]; ok {
+		hk.count = estimate
+		heap.Fix(&t.heap, hk.pos)
+		return
+	}
+
+	if len(t.heap) < t.k {
+		hk := &hotKey{key: string(key), hash: h, count: estimate}
+		heap.Push(&t.heap, hk)
+		t.index[h] = hk
+		return
+	}
+
+	// the key replaces the coldest tracked key
+	if estimate <= t.heap[0].count {
+		return
+	}
+
+	delete(t.index, t.heap[0].hash)
+	hk := &hotKey{key: string(key), hash: h, count: estimate, pos: 0}
+	t.heap[0] = hk
+	t.index[h] = hk
+	heap.Fix(&t.heap, 0)
+}
+
+// increment increments the counters of the key and returns its estimate, mu must be held
+func (t *hotKeys) increment(h uint64) uint32 {
+	h2 := (h >> 32) | 1
+
+	estimate := ^uint32(0)
+	for row := uint64(0); row < hotKeysDepth; row++ {
+		counter := &t.sketch[row*(t.mask+1)+((h+row*h2)&t.mask)]
+		if *counter < ^uint32(0) {
+			*counter++
+		}
+		if *counter < estimate {
+			estimate = *counter
+		}
+	}
+
+	return estimate
+}
+
+// decay halves the counters and the counts of the heap, mu must be held
+func (t *hotKeys) decay() {
+	for i := range t.sketch {
+		t.sketch[i] /= 2
+	}
+
+	kept := t.heap[:0]
+	for _, hk := range t.heap {
+		hk.count /= 2
+		if hk.count > 0 {
+			hk.pos = len(kept)
+			kept = append(kept, hk)
+			continue
+		}
+		delete(t.index, hk.hash)
+	}
+
+	for i := len(kept); i < len(t.heap); i++ {
+		t.heap[i] = nil
+	}
+
+	t.heap = kept
+	heap.Init(&t.heap)
+}
+
+// top returns the tracked keys ordered by their counts, the highest first
+func (t *hotKeys) top(shard func(h uint64) int) []HotKey {
+	t.mu.Lock()
+	keys := make([]HotKey, len(t.heap))
+	for i, hk := range t.heap {
+		keys[i] = HotKey{Key: hk.key, Count: uint64(hk.count) * t.sampleRate, Shard: shard(hk.hash)}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Count > keys[j].Count
+	})
+
+	return keys
+}
+
+func (t *hotKeys) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.sketch {
+		t.sketch[i] = 0
+	}
+
+	t.heap = nil
+	t.index = make(map[uint64]*hotKey, t.k)
+	t.lastDecay = t.clock.Now()
+}
+
+// hotKeyHeap is a min-heap of the keys by their counts
+type hotKeyHeap []*hotKey
+
+func (h hotKeyHeap) Len() int           { return len(h) }
+func (h hotKeyHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h hotKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *hotKeyHeap) Push(x interface{}) {
+	hk := x.(*hotKey)
+	hk.pos = len(*h)
+	*h = append(*h, hk)
+}
+
+func (h *hotKeyHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return x
+}
+
+// HotKeys returns the most frequently read and written keys ordered by their estimated
+// number of accesses, it's nil unless the hot key tracking is enabled by WithHotKeys.
+func (c *Cache) HotKeys() []HotKey {
+	if c.hotKeys == nil {
+		return nil
+	}
+
+	ss := c.shardSet()
+	return c.hotKeys.top(func(h uint64) int {
+		return int(h & ss.mask)
+	})
+}
@@ -0,0 +1,205 @@
+package distrox
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyOp is a cache operation whose latency is recorded
+type latencyOp int
+
+const (
+	opGet latencyOp = iota
+	opSet
+	opDel
+	opFragmentedGet
+	opFragmentedSet
+	opCount
+)
+
+var latencyOpNames = [opCount]string{"get", "set", "del", "fragmented_get", "fragmented_set"}
+
+const (
+	// latencySubBucketBits is the number of the significant bits of a bucket, each power of two
+	// range is split into 8 buckets, so the recorded values are within 12.5% of the actual ones
+	latencySubBucketBits = 3
+	latencySubBuckets    = 1 << latencySubBucketBits
+	// latencyMaxBits caps the recorded latencies at 2^36ns (~68s)
+	latencyMaxBits = 36
+	latencyBuckets = (latencyMaxBits - latencySubBucketBits + 1) * latencySubBuckets
+)
+
+// LatencyStats stores the latency distribution of a cache operation
+type LatencyStats struct {
+	// Count is a number of the recorded operations
+	Count uint64 `json:"count"`
+	// Mean and Max are the mean and the max latencies in nanoseconds
+	Mean time.Duration `json:"mean"`
+	Max  time.Duration `json:"max"`
+	// P50, P90, P99 and P999 are the latency percentiles in nanoseconds
+	P50  time.Duration `json:"p50"`
+	P90  time.Duration `json:"p90"`
+	P99  time.Duration `json:"p99"`
+	P999 time.Duration `json:"p999"`
+}
+
+// shardLatency holds the latency histograms of the operations of a shard,
+// the histograms of the shards are merged on read.
+type shardLatency struct {
+	histograms [opCount]latencyHistogram
+}
+
+// latencyHistogram is a log-linear (HDR style) histogram of nanoseconds, values below
+// 8ns have their own buckets and each power of two range above is split into 8 buckets.
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64
+	count  uint64
+	sum    uint64
+	max    uint64
+}
+
+func (l *shardLatency) observe(op latencyOp, d time.Duration) {
+	l.histograms[op].observe(uint64(d))
+}
+
+func (l *shardLatency) reset() {
+	for op := range l.histograms {
+		l.histograms[op].reset()
+	}
+}
+
+func (h *latencyHistogram) observe(v uint64) {
+	if v >= 1<<latencyMaxBits {
+		v = 1<<latencyMaxBits - 1
+	}
+
+	atomic.AddUint64(&h.counts[latencyBucket(v)], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, v)
+
+	for {
+		max := atomic.LoadUint64(&h.max)
+		if v <= max || atomic.CompareAndSwapUint64(&h.max, max, v) {
+			return
+		}
+	}
+}
+
+func (h *latencyHistogram) reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+
+	atomic.StoreUint64(&h.count, 0)
+	atomic.StoreUint64(&h.sum, 0)
+	atomic.StoreUint64(&h.max, 0)
+}
+
+// merge adds the values of the histogram o
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	for i := range o.counts {
+		h.counts[i] += atomic.LoadUint64(&o.counts[i])
+	}
+
+	h.count += atomic.LoadUint64(&o.count)
+	h.sum += atomic.LoadUint64(&o.sum)
+	if max := atomic.LoadUint64(&o.max); max > h.max {
+		h.max = max
+	}
+}
+
+// stats returns the distribution of a merged histogram
+func (h *latencyHistogram) stats() LatencyStats {
+	// counts are loaded one by one while the operations are recorded,
+	// so the count is taken from the buckets to keep the percentiles consistent
+	var count uint64
+	for _, n := range h.counts {
+		count += n
+	}
+
+	if count == 0 {
+		return LatencyStats{}
+	}
+
+	return LatencyStats{
+		Count: count,
+		Mean:  time.Duration(h.sum / count),
+		Max:   time.Duration(h.max),
+		P50:   h.percentile(count, 0.5),
+		P90:   h.percentile(count, 0.9),
+		P99:   h.percentile(count, 0.99),
+		P999:  h.percentile(count, 0.999),
+	}
+}
+
+// percentile returns the upper bound of the bucket of the q-th value capped by the max value
+func (h *latencyHistogram) percentile(count uint64, q float64) time.Duration {
+	rank := uint64(q*float64(count) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen < rank {
+			continue
+		}
+
+		if upper := latencyBucketUpper(i); upper < h.max {
+			return time.Duration(upper)
+		}
+		break
+	}
+
+	return time.Duration(h.max)
+}
+
+// latencyBucket returns the bucket of the value, the top 3 bits below the leading bit pick the sub-bucket
+func latencyBucket(v uint64) int {
+	if v < latencySubBuckets {
+		return int(v)
+	}
+
+	exp := bits.Len64(v) - 1
+	shift := exp - latencySubBucketBits
+	sub := int(v>>uint(shift)) & (latencySubBuckets - 1)
+
+	return (shift+1)*latencySubBuckets + sub
+}
+
+// latencyBucketUpper returns the largest value of the bucket
+func latencyBucketUpper(i int) uint64 {
+	if i < latencySubBuckets {
+		return uint64(i)
+	}
+
+	shift := uint(i/latencySubBuckets - 1)
+	sub := uint64(i % latencySubBuckets)
+
+	return (latencySubBuckets+sub+1)<<shift - 1
+}
+
+// LatencyStats returns the latency distribution of each operation (get, set, del,
+// fragmented_get, fragmented_set) merged from the shards, it's nil unless the latency
+// stats are enabled by WithLatencyStats.
+func (c *Cache) LatencyStats() map[string]LatencyStats {
+	if !c.latencyEnabled {
+		return nil
+	}
+
+	var merged [opCount]latencyHistogram
+	c.shardSet().each(func(s *shard) {
+		for op := range merged {
+			merged[op].merge(&s.latency.histograms[op])
+		}
+	})
+
+	stats := make(map[string]LatencyStats, opCount)
+	for op := range merged {
+		stats[latencyOpNames[op]] = merged[op].stats()
+	}
+
+	return stats
+}
@@ -0,0 +1,67 @@
+package distrox
+
+import (
+	"errors"
+)
+
+const (
+	// metadataLenSizeInBytes is the size of the metadata len prefixing the metadata of the value
+	metadataLenSizeInBytes = 2
+	// maxMetadataSizeInBytes is the max size of the metadata stored with a value
+	maxMetadataSizeInBytes = 1024
+)
+
+var (
+	ErrMetadataTooBig = errors.New("entry metadata too big")
+
+	errInvalidMetadata = errors.New("invalid entry metadata")
+)
+
+// SetWithMeta saves entry under the key with the metadata, see SetBinWithMeta
+func (c *Cache) SetWithMeta(k string, v []byte, metadata []byte) error {
+	return c.SetBinWithMeta([]byte(k), v, metadata)
+}
+
+// GetWithMeta reads entry for the key with its metadata, see GetBinWithMeta
+func (c *Cache) GetWithMeta(k string) ([]byte, []byte, error) {
+	return c.GetBinWithMeta(nil, []byte(k))
+}
+
+// storedValueLen returns the len of the value stored with its metadata
+func storedValueLen(value, metadata []byte) int {
+	if len(metadata) == 0 {
+		return len(value)
+	}
+
+	return metadataLenSizeInBytes + len(metadata) + len(value)
+}
+
+// metadataFlags returns the entry flags of the value stored with the metadata
+func metadataFlags(metadata []byte) uint64 {
+	if len(metadata) == 0 {
+		return 0
+	}
+
+	return entryHasMetadata
+}
+
+// appendMetadata appends the metadata prefix [len(metadata)][metadata] of the stored value to buf
+func appendMetadata(buf, metadata []byte) []byte {
+	buf = append(buf, byte(len(metadata)>>byteSize), byte(len(metadata)))
+	return append(buf, metadata...)
+}
+
+// splitMetadata splits the stored value into its metadata and the rest of the value
+func splitMetadata(v []byte) ([]byte, []byte, bool) {
+	if len(v) < metadataLenSizeInBytes {
+		return nil, nil, false
+	}
+
+	metadataLen := int(v[0])<<byteSize | int(v[1])
+	v = v[metadataLenSizeInBytes:]
+	if metadataLen > len(v) {
+		return nil, nil, false
+	}
+
+	return v[:metadataLen], v[metadataLen:], true
+}
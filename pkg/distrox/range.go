@@ -0,0 +1,165 @@
+package distrox
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidRange = errors.New("range exceeds the value")
+
+// GetRange reads length bytes of the value for the key starting from offset, see GetRangeBin
+func (c *Cache) GetRange(k string, offset, length int) ([]byte, error) {
+	return c.GetRangeBin(nil, []byte(k), offset, length)
+}
+
+// GetRangeBin appends length bytes of the value for the byte array key starting from offset to retBuf,
+// only the fragments overlapping the range are read for a fragmented value, so the hash of the value
+// is verified only when the range covers the whole value. It returns an ErrInvalidRange when
+// the range exceeds the value.
+func (c *Cache) GetRangeBin(retBuf []byte, key []byte, offset, length int) ([]byte, error) {
+	return c.getRangeBin(retBuf, key, offset, length, nil)
+}
+
+// GetRangeBinWithHash reads the range like GetRangeBin if the value still has the hash (see EntryMeta.Hash),
+// otherwise it returns an ErrEntryChanged, so the range resolved from the metadata of the entry
+// isn't read from a newer value.
+func (c *Cache) GetRangeBinWithHash(
+	retBuf []byte, key []byte, offset, length int, hash uint64) ([]byte, error) {
+	return c.getRangeBin(retBuf, key, offset, length, &hash)
+}
+
+func (c *Cache) getRangeBin(retBuf []byte, key []byte, offset, length int, hash *uint64) ([]byte, error) {
+	if !c.timed {
+		v, _, err := c.getRange(retBuf, key, offset, length, hash)
+		return v, err
+	}
+
+	start := time.Now()
+	v, fragmented, err := c.getRange(retBuf, key, offset, length, hash)
+
+	op, valueSize := opGet, len(v)-len(retBuf)
+	if fragmented {
+		op = opFragmentedGet
+	}
+	if err != nil {
+		valueSize = 0
+	}
+	c.observe(op, key, valueSize, start)
+
+	return v, err
+}
+
+// getRange reads the range of the value and reports whether the value is fragmented,
+// the hash of the value is checked before the range is read unless hash is nil
+func (c *Cache) getRange(retBuf []byte, key []byte, offset, length int, hash *uint64) ([]byte, bool, error) {
+	if offset < 0 || length < 0 {
+		return retBuf, false, ErrInvalidRange
+	}
+
+	if c.hotKeys != nil {
+		c.hotKeys.sample(key, c.hash)
+	}
+
+	retBufLen := len(retBuf)
+	retBuf, flags, err := c.getBin(retBuf, key)
+	if err != nil {
+		return retBuf, false, err
+	}
+
+	value := retBuf[retBufLen:]
+	if flags&entryHasMetadata != 0 {
+		var ok bool
+		if _, value, ok = splitMetadata(value); !ok {
+			return nil, false, errInvalidMetadata
+		}
+	}
+
+	if flags&entryFragmented == 0 {
+		if hash != nil && c.hash.Hash(value) != *hash {
+			return retBuf[:retBufLen], false, ErrEntryChanged
+		}
+		if offset+length > len(value) {
+			return retBuf[:retBufLen], false, ErrInvalidRange
+		}
+
+		return retBuf[:retBufLen+copy(retBuf[retBufLen:], value[offset:offset+length])], false, nil
+	}
+
+	// fragmented entry stats are counted by the shard of the metadata entry
+	s := c.shardSet().shard(c.hash.Hash(key))
+	if s.statsEnabled {
+		atomic.AddUint64(&s.fragmentedGets, 1)
+	}
+
+	fv, ok := parseFragmentedValue(value)
+	if !ok {
+		return nil, true, fmt.Errorf("invalid fragmented entry value len — want: %d got: %d",
+			fragmentedEntryKeyLen, len(value))
+	}
+
+	if hash != nil && fv.hash != *hash {
+		return retBuf[:retBufLen], true, ErrEntryChanged
+	}
+	if offset+length > int(fv.len) {
+		return retBuf[:retBufLen], true, ErrInvalidRange
+	}
+
+	if offset == 0 && length == int(fv.len) {
+		// the metadata value is marshaled again since the fragments are read over it
+		var metadataValue [fragmentedEntryKeyLen]byte
+		retBuf, err = c.getFragmented(retBuf[:retBufLen], fv.marshal(metadataValue[:0]), s)
+		return retBuf, true, err
+	}
+
+	retBuf, err = c.getFragmentRange(retBuf[:retBufLen], fv, offset, length, s)
+	return retBuf, true, err
+}
+
+// getFragmentRange appends the range of the fragmented value to retBuf reading only the fragments
+// overlapping the range, misses are counted by s
+func (c *Cache) getFragmentRange(
+	retBuf []byte, fv fragmentedValue, offset, length int, s *shard) ([]byte, error) {
+	fragmentKey := c.bpool.Get()
+	defer c.bpool.Put(fragmentKey)
+
+	retBufLen := len(retBuf)
+	end := offset + length
+	for i := offset / fragmentSizeInBytes; len(retBuf)-retBufLen < length; i++ {
+		fragmentKey = fv.appendFragmentKey(fragmentKey[:0], uint64(i))
+
+		fragmentPosition := len(retBuf)
+		fragment, _, err := c.getBin(retBuf, fragmentKey)
+		if err != nil {
+			s.countFragmentMiss()
+			c.logger.Err("Fragment of the actual value could not found", err)
+			return nil, err
+		}
+
+		if len(fragment) == fragmentPosition {
+			s.countFragmentMiss()
+			c.logger.Debug("fragment of the actual value could not found")
+			return nil, ErrFragmentNotFound
+		}
+
+		// the bytes of the fragment out of the range are dropped
+		fragmentOffset := i * fragmentSizeInBytes
+		from, to := 0, len(fragment)-fragmentPosition
+		if offset > fragmentOffset {
+			from = offset - fragmentOffset
+		}
+		if end < fragmentOffset+to {
+			to = end - fragmentOffset
+		}
+		if from >= to {
+			s.countFragmentMiss()
+			return nil, ErrFragmentNotFound
+		}
+
+		n := copy(fragment[fragmentPosition:], fragment[fragmentPosition+from:fragmentPosition+to])
+		retBuf = fragment[:fragmentPosition+n]
+	}
+
+	return retBuf, nil
+}
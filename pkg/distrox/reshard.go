@@ -0,0 +1,123 @@
+package distrox
+
+import (
+	"errors"
+	"fmt"
+)
+
+// migrationBatchSize is the number of entries moved while the shard of the previous layout is locked
+const migrationBatchSize = 256
+
+var ErrReshardInProgress = errors.New("resharding is in progress")
+
+// shardSet is a layout of the shards, keys are mapped to the shards by the hash and the mask.
+// prev holds the previous layout while its entries are migrated, it's nil otherwise.
+type shardSet struct {
+	shards []*shard
+	mask   uint64
+	prev   *shardSet
+}
+
+func newShardSet(shards []*shard, prev *shardSet) *shardSet {
+	return &shardSet{
+		shards: shards,
+		mask:   uint64(len(shards) - 1),
+		prev:   prev,
+	}
+}
+
+// shard returns the shard of the key hash
+func (ss *shardSet) shard(h uint64) *shard {
+	return ss.shards[h&ss.mask]
+}
+
+// each calls fn for the shards of the layout and the previous layout
+func (ss *shardSet) each(fn func(s *shard)) {
+	for _, s := range ss.shards {
+		fn(s)
+	}
+
+	if ss.prev != nil {
+		ss.prev.each(fn)
+	}
+}
+
+// Reshard changes the number of shards of a live cache, count must be a power of two.
+// The new shards are created with the current max size and the entries are migrated
+// in the background a batch at a time, reads fall back to the previous shards and
+// writes go to the new shards until the migration completes. The memory of the previous
+// shards is released once they are migrated, so without the global budget the memory usage
+// can be up to twice the max size meanwhile.
+// The previous shards are retired before the new layout is stored, so the writers which
+// loaded the previous layout retry on the new one instead of writing to a migrated shard.
+func (c *Cache) Reshard(count int) error {
+	if count <= 0 || !isPowerOfTwo(count) {
+		return fmt.Errorf("shard count must be power of two")
+	}
+
+	c.resizeMu.Lock()
+	defer c.resizeMu.Unlock()
+
+	ss := c.shardSet()
+	if ss.prev != nil {
+		return ErrReshardInProgress
+	}
+
+	if count == len(ss.shards) {
+		return nil
+	}
+
+	shards, err := c.newShards(count)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range ss.shards {
+		s.retire()
+	}
+
+	c.shardCount = count
+	c.layout.Store(newShardSet(shards, ss))
+
+	c.wg.Add(1)
+	go c.migrate()
+
+	return nil
+}
+
+// ShardCount returns the number of shards entries are written to
+func (c *Cache) ShardCount() int {
+	return len(c.shardSet().shards)
+}
+
+// Resharding reports whether the entries are being migrated to the new shards
+func (c *Cache) Resharding() bool {
+	return c.shardSet().prev != nil
+}
+
+// migrate moves the entries of the previous layout to the current one and drops
+// the previous layout once it's empty, it stops when the cache is closed.
+func (c *Cache) migrate() {
+	defer c.wg.Done()
+
+	ss := c.shardSet()
+	for _, s := range ss.prev.shards {
+		for s.migrate(migrationBatchSize, ss.shard) > 0 {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+		}
+	}
+
+	c.resizeMu.Lock()
+	c.layout.Store(newShardSet(ss.shards, nil))
+	c.resizeMu.Unlock()
+
+	for _, s := range ss.prev.shards {
+		if err := s.close(); err != nil {
+			c.logger.Err("migrated shard could not closed", err)
+		}
+	}
+}
@@ -7,17 +7,35 @@ import (
 	"sync/atomic"
 
 	"github.com/ziyasal/distroxy/internal/pkg/common"
+	"github.com/ziyasal/distroxy/internal/pkg/index"
 
 	"github.com/ziyasal/distroxy/internal/pkg/ringo"
 )
 
 const (
-	entryIndexBytesSize     = 63 // 1 is used store fragmented entry flag
+	entryIndexBytesSize     = 61 // 3 bits are used to store the entry flags
 	timestampSizeInBytes    = 8
 	entryHeadersSizeInBytes = 12                                    // timestamp + len(k) + len(value)
 	defaultKeySizeInBytes   = 16 * 1024                             // 16kb
 	defaultValueSizeInBytes = (48 * 1024) - entryHeadersSizeInBytes // (48 * 1024) - 12 KB
 	byteSize                = 8
+
+	// diskEntryFlag is set in the entry position when the entry is moved to the disk tier,
+	// the rest of the position is the location of the entry on the disk then.
+	diskEntryFlagBit = 60
+	diskEntryFlag    = uint64(1) << diskEntryFlagBit
+
+	// entryFragmented is set when the value of the entry is the descriptor of its fragments
+	entryFragmented = uint64(1) << 0
+	// entryHasMetadata is set when the value of the entry is prefixed by its metadata
+	entryHasMetadata = uint64(1) << 1
+	// entryFragment is set when the entry is a fragment of a fragmented value, so it's told apart
+	// from the entries of the keys
+	entryFragment = uint64(1) << 2
+
+	// maxExpiredEntries caps the expired entries readers leave to the writers,
+	// the ones found when it's full are left to the next reader.
+	maxExpiredEntries = 64
 )
 
 var (
@@ -26,14 +44,19 @@ var (
 	ErrEntrySizeTooBig  = errors.New("key, value with headers size exceeds chunk size")
 	ErrEntryKeyTooBig   = errors.New("entry key too big")
 	ErrEntryValueTooBig = errors.New("entry value too big")
+
+	// errShardMigrated is returned by the writes to the shards of the previous layout
+	errShardMigrated = errors.New("shard is migrated")
 )
 
 type shard struct {
-	rwMutex sync.RWMutex
+	// rwMutex counts the readers in slots picked by the CPU they run on, so readers
+	// don't contend on a shared lock word
+	rwMutex *common.DistributedRWMutex
 	ring    *ringo.RingBuf
-	// entryIndexes maps hash(k) and fragmented entry flag packed
+	// entryIndexes maps hash(k) and the entry flags packed
 	//together to position of (ts, k, value) pair in chunks.
-	entryIndexes map[uint64]uint64
+	entryIndexes *index.Table
 	// tsBuf used when entry created timestamp is written to headers buffer
 	tsBuf []byte
 
@@ -42,6 +65,49 @@ type shard struct {
 
 	logger common.Logger
 	clock  common.StoppableClock
+	hash   common.Hasher
+
+	// disk is the second tier where live entries of the overwritten blocks are moved to,
+	// it's nil when disk tier is not enabled.
+	disk *diskTier
+	// diskPromotion writes entries read from the disk tier back to the ring buffer
+	diskPromotion bool
+	// spillBuf and spilled are reused while live entries of a block are moved to the disk tier
+	spillBuf []byte
+	spilled  []movedEntry
+
+	// policy decides which live entries of an overwritten block are re-appended
+	policy EvictionPolicy
+	// admission decides whether new entries are stored once the ring buffer is full, it's optional
+	admission AdmissionFilter
+	// reinsertBuf and reinserted hold the live entries to be re-appended after a write
+	reinsertBuf []byte
+	reinserted  []movedEntry
+	// fragmentsID is the fragments id of the value whose fragment is being written, the metadata
+	// entries of the value are kept when the write overwrites their block
+	fragmentsID      uint64
+	writingFragments bool
+
+	// expired holds the entries the readers found expired, they are deleted by the next
+	// writer so readers don't need to take the write lock
+	expiredMu    sync.Mutex
+	expired      []indexedEntry
+	expiredCount int32
+	// migrating holds the batch of entries being migrated while resharding
+	migrating []indexedEntry
+	// migrated is set under the write lock once the shard is in the previous layout,
+	// writes and deletes are refused then so they are applied to the current layout
+	migrated bool
+
+	// blockLive holds the number of bytes of the live entries in each block,
+	// the rest of the written bytes of the block belong to deleted or overwritten entries.
+	blockLive []uint64
+
+	// budget is the global memory budget the blocks are borrowed from, it's nil when
+	// each shard has a fixed number of blocks. blockGen counts the times each block is started
+	// to be written, so the budget can skip the queued blocks which are overwritten since then.
+	budget   *blockBudget
+	blockGen []uint64
 
 	// is a number of successfully found keys
 	hits uint64
@@ -53,36 +119,132 @@ type shard struct {
 	delMisses uint64
 	// collisions is a key collisions counter
 	collisions uint64
+	// diskHits is a number of keys found in the disk tier
+	diskHits uint64
+	// reinserts is a number of entries re-appended by the eviction policy
+	reinserts uint64
+	// admissionRejects is a number of writes refused by the admission filter
+	admissionRejects uint64
+	// compactions is a number of compacted blocks
+	compactions uint64
+	// evictions is a number of entries removed since their block is overwritten
+	evictions uint64
+	// expirations is a number of entries found expired
+	expirations uint64
+	// fragmentedSets and fragmentedGets are numbers of the entries stored in fragments
+	// written and read, their keys are in the shard
+	fragmentedSets uint64
+	fragmentedGets uint64
+	// fragmentMisses is a number of fragmented entries read with a missing fragment
+	fragmentMisses uint64
+	// hashFailures is a number of fragmented entries read with a value hash mismatch
+	hashFailures uint64
+
+	// latency holds the latency histograms of the operations on the keys of the shard when it's enabled
+	latency *shardLatency
+
+	// events publishes the expirations and evictions of the keys, sets and deletes are published by the cache
+	events *eventBus
 }
 
-func newShard(
-	shardSizeInBytes uint64,
-	memBlockSizeInBytes uint64,
-	ttlInSeconds int64,
-	maxShardSizeInBytes uint64,
-	clock common.StoppableClock,
-	logger common.Logger,
-	statsEnabled bool) (*shard, error) {
-	if shardSizeInBytes == 0 {
+// shardConfig holds the parameters shared by all shards of a cache
+type shardConfig struct {
+	shardSizeInBytes    uint64
+	memBlockSizeInBytes uint64
+	maxShardSizeInBytes uint64
+	ttlInSeconds        int64
+
+	clock  common.StoppableClock
+	logger common.Logger
+	hash   common.Hasher
+
+	statsEnabled   bool
+	latencyEnabled bool
+	offHeap        bool
+	disk           *diskTier
+	diskPromotion  bool
+
+	newPolicy    func() EvictionPolicy
+	newAdmission func() AdmissionFilter
+
+	// budget makes the shard start with a single block and borrow the others from the budget
+	budget *blockBudget
+
+	events *eventBus
+}
+
+// indexedEntry is an entry index with its key hash
+type indexedEntry struct {
+	hash     uint64
+	entryIdx uint64
+}
+
+// movedEntry is a live entry of an overwritten block copied to a buffer
+// to be moved to the disk tier or re-appended to the ring buffer
+type movedEntry struct {
+	hash uint64
+	// offset and length of the entry in the buffer
+	offset uint64
+	length uint64
+	// position of the entry in the ring buffer before it's moved
+	position uint64
+	// entry flags of the entry index
+	flags uint64
+}
+
+func newShard(cfg shardConfig) (*shard, error) {
+	if cfg.shardSizeInBytes == 0 {
 		return nil, ErrZeroBytesShardSize
 	}
 
-	if shardSizeInBytes >= maxShardSizeInBytes {
+	if cfg.shardSizeInBytes >= cfg.maxShardSizeInBytes {
 		return nil, fmt.Errorf(
 			"shard size:%d should be smaller than max shard size: %d",
-			shardSizeInBytes, maxShardSizeInBytes)
+			cfg.shardSizeInBytes, cfg.maxShardSizeInBytes)
+	}
+
+	maxMemBlocks := (cfg.shardSizeInBytes + cfg.memBlockSizeInBytes - 1) / cfg.memBlockSizeInBytes
+	if cfg.budget != nil {
+		maxMemBlocks = 1
+		cfg.budget.take(1)
 	}
 
-	maxMemBlocks := (shardSizeInBytes + memBlockSizeInBytes - 1) / memBlockSizeInBytes
+	pool := common.NewDefaultPooled(int(cfg.memBlockSizeInBytes))
+	if cfg.offHeap {
+		p, err := common.NewMmapPooled(int(cfg.memBlockSizeInBytes))
+		if err != nil {
+			return nil, err
+		}
+		pool = p
+	}
 
 	s := &shard{}
-	s.ring = ringo.NewRingBuf(maxMemBlocks, memBlockSizeInBytes, common.NewDefaultPooled(int(memBlockSizeInBytes)))
-	s.entryIndexes = make(map[uint64]uint64)
-	s.logger = logger
+	s.rwMutex = common.NewDistributedRWMutex()
+	s.ring = ringo.NewRingBuf(maxMemBlocks, cfg.memBlockSizeInBytes, pool)
+	s.entryIndexes = index.New(index.MinCapacity)
+	s.blockLive = make([]uint64, maxMemBlocks)
+	s.blockGen = make([]uint64, maxMemBlocks)
+	s.budget = cfg.budget
+	s.logger = cfg.logger
 	s.tsBuf = make([]byte, timestampSizeInBytes)
-	s.clock = clock
-	s.ttlInSeconds = ttlInSeconds
-	s.statsEnabled = statsEnabled
+	s.clock = cfg.clock
+	s.hash = cfg.hash
+	s.ttlInSeconds = cfg.ttlInSeconds
+	s.statsEnabled = cfg.statsEnabled
+	if cfg.latencyEnabled {
+		s.latency = &shardLatency{}
+	}
+	s.disk = cfg.disk
+	s.diskPromotion = cfg.diskPromotion
+	s.events = cfg.events
+
+	s.policy = NewFIFOPolicy()
+	if cfg.newPolicy != nil {
+		s.policy = cfg.newPolicy()
+	}
+	if cfg.newAdmission != nil {
+		s.admission = cfg.newAdmission()
+	}
 
 	s.reset()
 
@@ -90,15 +252,15 @@ func newShard(
 }
 
 // "set" stores entry key and value in the ring buffer it also adds entry metadata to map,
-// the metadata is hash(key) and fragmented entry [1] flag packed together
+// the metadata is hash(key) and the entry flags (fragmented [1], has metadata) packed together
 
 // [1] - default chunk size is 64 kb to have low fragmentation
 // thus entries bigger than defaults divided into smaller parts
 // to fit into the 64kb chunk. The entry then stored with the actual key and the metadata
-// about these parts (`fragmented` is 1 in this case) as value.
-// When the entry requested, `isFragmentedEntry` flag will be used to determine
+// about these parts (`entryFragmented` flag is set in this case) as value.
+// When the entry requested, `entryFragmented` flag will be used to determine
 // whether processing stored value to collect the parts of actual value is required or not.
-func (s *shard) set(k, v []byte, h uint64, fragmented bool) error {
+func (s *shard) set(k, v []byte, h uint64, flags uint64) error {
 	if len(k) >= defaultKeySizeInBytes {
 		return ErrEntryKeyTooBig
 	}
@@ -108,48 +270,195 @@ func (s *shard) set(k, v []byte, h uint64, fragmented bool) error {
 	}
 
 	s.rwMutex.Lock()
-	entryHeadersBuf := common.EncodeEntry(k, v, s.clock.Now(), &s.tsBuf)
+	defer s.rwMutex.Unlock()
+
+	if s.migrated {
+		return errShardMigrated
+	}
+
+	return s.write(k, v, h, flags, s.clock.Now())
+}
+
+// write stores the entry with the given created timestamp, write lock must be held
+func (s *shard) write(k, v []byte, h uint64, flags uint64, timestamp int64) error {
+	s.deleteExpired()
+
+	entryHeadersBuf := common.EncodeEntry(k, v, timestamp, &s.tsBuf)
 
 	entryHeadersLen := uint64(len(entryHeadersBuf) + len(k) + len(v))
 	if entryHeadersLen >= s.ring.BlockSize() {
 		return ErrEntrySizeTooBig
 	}
 
-	currentPosition := s.ring.Write(entryHeadersBuf[:], k, v)
+	// the fragments of a value are addressed by the value hash, so a value set again rewrites
+	// the same fragments and it mustn't push out the metadata entries pointing to them
+	if flags&entryFragment != 0 && len(k) >= 8 {
+		s.fragmentsID, s.writingFragments = common.UnmarshalUint64(k), true
+		defer func() { s.writingFragments = false }()
+	}
 
-	var isBigEntry uint64 = 0
-	if fragmented {
-		isBigEntry = 1
+	s.makeRoom(entryHeadersLen)
+	currentPosition := s.append(entryHeadersLen, entryHeadersBuf[:], k, v)
+
+	if entryIdx, ok := s.entryIndexes.Get(h); ok {
+		s.release(entryIdx)
 	}
 
-	s.entryIndexes[h] = common.PackIntegers(currentPosition, isBigEntry, entryIndexBytesSize)
-	s.rwMutex.Unlock()
+	s.entryIndexes.Put(h, common.PackIntegers(currentPosition, flags, entryIndexBytesSize))
+
+	s.reinsert()
 
 	return nil
 }
 
+// makeRoom evicts the block which is going to be overwritten by the next write of the size,
+// with the global budget the ring grows by a block borrowed from the budget instead if there is any.
+// Write lock must be held.
+func (s *shard) makeRoom(size uint64) {
+	blockIdx, ok := s.ring.NextEvicted(size)
+	if !ok {
+		return
+	}
+
+	if s.budget != nil && s.budget.acquire(s) {
+		s.grow(1)
+		return
+	}
+
+	s.evictBlock(blockIdx)
+}
+
+// append writes the blobs of the entry with the given length to the ring buffer
+// and returns its position, write lock must be held.
+func (s *shard) append(length uint64, blobs ...[]byte) uint64 {
+	position := s.ring.Write(blobs...)
+	blockIdx := position / s.ring.BlockSize()
+	s.blockLive[blockIdx] += length
+
+	if position%s.ring.BlockSize() == 0 {
+		s.blockGen[blockIdx]++
+		if s.budget != nil {
+			s.budget.started(s, blockIdx, s.blockGen[blockIdx])
+		}
+	}
+
+	return position
+}
+
+// grow adds count free blocks to the ring buffer, write lock must be held
+func (s *shard) grow(count uint64) {
+	s.ring.Grow(count)
+	for uint64(len(s.blockLive)) < s.ring.Len() {
+		s.blockLive = append(s.blockLive, 0)
+		s.blockGen = append(s.blockGen, 0)
+	}
+}
+
+// reclaim evicts the block and returns it to the global budget, it returns false
+// when the block is overwritten, released or being written since it's queued.
+func (s *shard) reclaim(blockIdx uint64, gen uint64) bool {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	if !s.reclaimable(blockIdx, gen) {
+		return false
+	}
+
+	s.evictBlock(blockIdx)
+	s.ring.Retire(blockIdx)
+	s.reinsert()
+
+	return true
+}
+
+// reclaimable reports whether the block queued with the generation is still written
+// and not the current block, lock must be held.
+func (s *shard) reclaimable(blockIdx uint64, gen uint64) bool {
+	return s.blockGen[blockIdx] == gen && blockIdx != s.ring.Current() && len(s.ring.Block(blockIdx)) > 0
+}
+
+// reinsert re-appends the entries removed from their blocks to be kept (by the eviction policy or
+// the compaction), appending them can overwrite other blocks so the list can grow while it's processed.
+// Write lock must be held.
+func (s *shard) reinsert() {
+	for i := 0; i < len(s.reinserted); i++ {
+		e := s.reinserted[i]
+
+		// skip the entries written again since their block is overwritten
+		if _, ok := s.entryIndexes.Get(e.hash); ok {
+			continue
+		}
+
+		s.makeRoom(e.length)
+
+		// the created timestamp in the entry headers is kept as it is
+		position := s.append(e.length, s.reinsertBuf[e.offset:e.offset+e.length])
+		s.entryIndexes.Put(e.hash, common.PackIntegers(position, e.flags, entryIndexBytesSize))
+	}
+
+	s.reinsertBuf = s.reinsertBuf[:0]
+	s.reinserted = s.reinserted[:0]
+}
+
+// admit records the write of the key and reports whether the entry should be stored,
+// once the ring buffer is full new keys are stored only if the admission filter admits them.
+func (s *shard) admit(h uint64) bool {
+	if s.admission == nil {
+		return true
+	}
+
+	s.admission.Record(h)
+
+	slot := s.rwMutex.RLock(h)
+	_, exists := s.entryIndexes.Get(h)
+	full := s.ring.Full()
+	s.rwMutex.RUnlock(slot)
+
+	// updates are always admitted otherwise the stale value would be kept
+	if !full || exists || s.admission.Admit(h) {
+		return true
+	}
+
+	if s.statsEnabled {
+		atomic.AddUint64(&s.admissionRejects, 1)
+	}
+
+	return false
+}
+
 //get gets the entry value from shard
-// if appendToRetBuf is true then appends the entry value to the retBuf and returns it
-func (s *shard) get(retBuf, key []byte, hashOfKey uint64, appendToRetBuf bool) ([]byte, bool, error) {
-	s.rwMutex.RLock()
-	entryIdx, exists := s.entryIndexes[hashOfKey]
+// if appendToRetBuf is true then appends the entry value to the retBuf and returns it with the entry flags
+func (s *shard) get(retBuf, key []byte, hashOfKey uint64, appendToRetBuf bool) ([]byte, uint64, error) {
+	if s.admission != nil {
+		s.admission.Record(hashOfKey)
+	}
+
+	slot := s.rwMutex.RLock(hashOfKey)
+	entryIdx, exists := s.entryIndexes.Get(hashOfKey)
 	if !exists {
-		s.rwMutex.RUnlock()
+		s.rwMutex.RUnlock(slot)
 		atomic.AddUint64(&s.misses, 1)
-		return retBuf, false, ErrEntryNotFound
+		return retBuf, 0, ErrEntryNotFound
+	}
+
+	// entryIdx consist of the actual index of the entry value and the entry flags
+	flags, entryPosition := common.UnpackIntegers(entryIdx, entryIndexBytesSize)
+
+	if entryPosition&diskEntryFlag != 0 {
+		// disk reads don't need the shard lock since segments are append-only
+		s.rwMutex.RUnlock(slot)
+		return s.getFromDisk(retBuf, key, hashOfKey, entryIdx, appendToRetBuf)
 	}
 
-	// entryIdx consist of the actual index of the entry value and fragmented entry flag
-	isFragmentedEntry, entryPosition := common.UnpackIntegers(entryIdx, entryIndexBytesSize)
 	entryRingIndex := entryPosition / s.ring.BlockSize()
 
 	if entryRingIndex >= s.ring.Len() {
 		s.logger.Printf(
 			"corrupted data — chunk index: %d bigger chunks in the ring len: %d",
 			entryRingIndex, s.ring.Len())
-		s.rwMutex.RUnlock()
+		s.rwMutex.RUnlock(slot)
 		atomic.AddUint64(&s.misses, 1)
-		return retBuf, false, ErrEntryNotFound
+		return retBuf, 0, ErrEntryNotFound
 	}
 
 	entryPosition %= s.ring.BlockSize()
@@ -157,9 +466,9 @@ func (s *shard) get(retBuf, key []byte, hashOfKey uint64, appendToRetBuf bool) (
 	if entryPosition+entryHeadersSizeInBytes >= s.ring.BlockSize() {
 		s.logger.Printf("corrupted data — entry headers:%d from entry index: exceeds chunk size:%d",
 			entryHeadersSizeInBytes, entryPosition, s.ring.BlockSize())
-		s.rwMutex.RUnlock()
+		s.rwMutex.RUnlock(slot)
 		atomic.AddUint64(&s.misses, 1)
-		return retBuf, false, ErrEntryNotFound
+		return retBuf, 0, ErrEntryNotFound
 	}
 
 	entryHeadersBuf := s.ring.Read(entryRingIndex, entryPosition, entryPosition+entryHeadersSizeInBytes)
@@ -167,19 +476,20 @@ func (s *shard) get(retBuf, key []byte, hashOfKey uint64, appendToRetBuf bool) (
 
 	// Evict on get
 	if (s.clock.Now() - timestamp) > s.ttlInSeconds {
-		s.rwMutex.RUnlock()
+		s.rwMutex.RUnlock(slot)
 
-		// acquire lock to delete the item
-		s.rwMutex.Lock()
-		delete(s.entryIndexes, hashOfKey)
-		s.rwMutex.Unlock()
+		// the entry is deleted by the next writer
+		if s.expire(hashOfKey, entryIdx) {
+			s.notify(EventExpire, key, flags)
+		}
 
 		// increase misses
 		if s.statsEnabled {
 			atomic.AddUint64(&s.misses, 1)
+			atomic.AddUint64(&s.expirations, 1)
 		}
 
-		return retBuf, false, ErrEntryNotFound
+		return retBuf, 0, ErrEntryNotFound
 	}
 
 	// get key and value len back
@@ -191,8 +501,8 @@ func (s *shard) get(retBuf, key []byte, hashOfKey uint64, appendToRetBuf bool) (
 		s.logger.Printf(
 			"corrupted data — entry kv size:%d from the entry index:%d exceeds the chunk size: %d",
 			keyLen+valLen, entryPosition, s.ring.BlockSize())
-		s.rwMutex.RUnlock()
-		return retBuf, false, ErrEntryNotFound
+		s.rwMutex.RUnlock(slot)
+		return retBuf, 0, ErrEntryNotFound
 	}
 
 	keyBytes := s.ring.Read(entryRingIndex, entryPosition, entryPosition+keyLen)
@@ -202,6 +512,7 @@ func (s *shard) get(retBuf, key []byte, hashOfKey uint64, appendToRetBuf bool) (
 			valueBytes := s.ring.Read(entryRingIndex, entryPosition, entryPosition+valLen)
 			retBuf = append(retBuf, valueBytes...)
 		}
+		s.policy.Touch(hashOfKey)
 		if s.statsEnabled {
 			atomic.AddUint64(&s.hits, 1)
 		}
@@ -209,40 +520,653 @@ func (s *shard) get(retBuf, key []byte, hashOfKey uint64, appendToRetBuf bool) (
 		atomic.AddUint64(&s.collisions, 1)
 	}
 
-	s.rwMutex.RUnlock()
-	return retBuf, isFragmentedEntry == 1, nil
+	s.rwMutex.RUnlock(slot)
+	return retBuf, flags, nil
+}
+
+// getFromDisk reads the entry from the disk tier, the entry is promoted
+// back to the ring buffer when disk promotion is enabled.
+func (s *shard) getFromDisk(
+	retBuf, key []byte, hashOfKey, entryIdx uint64, appendToRetBuf bool) ([]byte, uint64, error) {
+	flags, entryPosition := common.UnpackIntegers(entryIdx, entryIndexBytesSize)
+	location := entryPosition &^ diskEntryFlag
+
+	var entryHeadersBuf [entryHeadersSizeInBytes]byte
+	if err := s.disk.readAt(entryHeadersBuf[:], location); err != nil {
+		if !errors.Is(err, ErrDiskSegmentNotFound) {
+			s.logger.Err("entry headers could not be read from the disk tier", err)
+		}
+		return s.diskMiss(retBuf, key, hashOfKey, entryIdx, EventEvict)
+	}
+
+	timestamp := int64(common.UnmarshalUint64(entryHeadersBuf[0:timestampSizeInBytes]))
+	if (s.clock.Now() - timestamp) > s.ttlInSeconds {
+		if s.statsEnabled {
+			atomic.AddUint64(&s.expirations, 1)
+		}
+		return s.diskMiss(retBuf, key, hashOfKey, entryIdx, EventExpire)
+	}
+
+	keyLen := (uint64(entryHeadersBuf[8]) << byteSize) | uint64(entryHeadersBuf[9])
+	valLen := (uint64(entryHeadersBuf[10]) << byteSize) | uint64(entryHeadersBuf[11])
+
+	// read key and value to the end of retBuf then move the value over the key
+	retBufLen := len(retBuf)
+	kvLen := int(keyLen + valLen)
+	if n := retBufLen + kvLen - cap(retBuf); n > 0 {
+		retBuf = append(retBuf[:cap(retBuf)], make([]byte, n)...)
+	}
+	kv := retBuf[retBufLen : retBufLen+kvLen]
+
+	if err := s.disk.readAt(kv, location+entryHeadersSizeInBytes); err != nil {
+		s.logger.Err("entry could not be read from the disk tier", err)
+		return s.diskMiss(retBuf[:retBufLen], key, hashOfKey, entryIdx, EventEvict)
+	}
+
+	if string(key) != string(kv[:keyLen]) {
+		if s.statsEnabled {
+			atomic.AddUint64(&s.collisions, 1)
+		}
+		return retBuf[:retBufLen], flags, nil
+	}
+
+	if s.statsEnabled {
+		atomic.AddUint64(&s.hits, 1)
+		atomic.AddUint64(&s.diskHits, 1)
+	}
+
+	if s.diskPromotion {
+		s.promote(kv[:keyLen], kv[keyLen:], hashOfKey, entryIdx, timestamp)
+	}
+
+	if !appendToRetBuf {
+		return retBuf[:retBufLen], flags, nil
+	}
+
+	copy(kv, kv[keyLen:])
+	return retBuf[:retBufLen+int(valLen)], flags, nil
+}
+
+// diskMiss leaves the index of the entry which is expired or collected from the disk tier
+// to be removed by the next writer, the event of the type is published for it
+func (s *shard) diskMiss(
+	retBuf, key []byte, hashOfKey, entryIdx uint64, typ EventType) ([]byte, uint64, error) {
+	if s.expire(hashOfKey, entryIdx) {
+		flags, _ := common.UnpackIntegers(entryIdx, entryIndexBytesSize)
+		s.notify(typ, key, flags)
+	}
+
+	if s.statsEnabled {
+		atomic.AddUint64(&s.misses, 1)
+	}
+
+	return retBuf, 0, ErrEntryNotFound
+}
+
+// entryMeta is the header of an entry, valueLen of a fragmented entry is the len of the actual value
+// and valueLen of an entry with metadata doesn't include the metadata
+type entryMeta struct {
+	timestamp  int64
+	valueLen   uint64
+	fragmented bool
+	metadata   []byte
+	// hash is the hash of the value, it's the hash of the fragment hashes for a fragmented entry
+	hash uint64
+}
+
+// meta returns the header of the entry with the metadata and the hash of its value without copying
+// the value, the value of a fragmented entry (fragments id + value len + value hash) is read to get
+// the len of the actual value. Stats are not changed.
+func (s *shard) meta(key []byte, h uint64) (entryMeta, error) {
+	slot := s.rwMutex.RLock(h)
+	entryIdx, exists := s.entryIndexes.Get(h)
+	if !exists {
+		s.rwMutex.RUnlock(slot)
+		return entryMeta{}, ErrEntryNotFound
+	}
+
+	flags, entryPosition := common.UnpackIntegers(entryIdx, entryIndexBytesSize)
+	if entryPosition&diskEntryFlag != 0 {
+		s.rwMutex.RUnlock(slot)
+		return s.metaFromDisk(key, entryPosition&^diskEntryFlag, flags)
+	}
+
+	blockIdx := entryPosition / s.ring.BlockSize()
+	entryPosition %= s.ring.BlockSize()
+	if blockIdx >= s.ring.Len() || entryPosition+entryHeadersSizeInBytes >= s.ring.BlockSize() {
+		s.rwMutex.RUnlock(slot)
+		return entryMeta{}, ErrEntryNotFound
+	}
+
+	headers := s.ring.Read(blockIdx, entryPosition, entryPosition+entryHeadersSizeInBytes)
+	m, keyLen := parseEntryHeaders(headers)
+	entryPosition += entryHeadersSizeInBytes
+
+	if entryPosition+keyLen+m.valueLen >= s.ring.BlockSize() ||
+		string(key) != string(s.ring.Read(blockIdx, entryPosition, entryPosition+keyLen)) {
+		s.rwMutex.RUnlock(slot)
+		return entryMeta{}, ErrEntryNotFound
+	}
+
+	entryPosition += keyLen
+	m.parseValue(s.ring.Read(blockIdx, entryPosition, entryPosition+m.valueLen), flags, s.hash)
+	s.rwMutex.RUnlock(slot)
+
+	if (s.clock.Now() - m.timestamp) > s.ttlInSeconds {
+		return entryMeta{}, ErrEntryNotFound
+	}
+
+	return m, nil
+}
+
+// metaFromDisk reads the header and the value of the entry from the disk tier
+func (s *shard) metaFromDisk(key []byte, location uint64, flags uint64) (entryMeta, error) {
+	var headers [entryHeadersSizeInBytes]byte
+	if err := s.disk.readAt(headers[:], location); err != nil {
+		return entryMeta{}, ErrEntryNotFound
+	}
+
+	m, keyLen := parseEntryHeaders(headers[:])
+	if (s.clock.Now()-m.timestamp) > s.ttlInSeconds || keyLen != uint64(len(key)) {
+		return entryMeta{}, ErrEntryNotFound
+	}
+
+	kv := make([]byte, keyLen+m.valueLen)
+	if err := s.disk.readAt(kv, location+entryHeadersSizeInBytes); err != nil {
+		return entryMeta{}, ErrEntryNotFound
+	}
+
+	if string(key) != string(kv[:keyLen]) {
+		return entryMeta{}, ErrEntryNotFound
+	}
+
+	m.parseValue(kv[keyLen:], flags, s.hash)
+
+	return m, nil
+}
+
+// parseValue reads the metadata, the len and the hash of the actual value from the stored value
+func (m *entryMeta) parseValue(value []byte, flags uint64, hash common.Hasher) {
+	if flags&entryHasMetadata != 0 {
+		metadata, rest, ok := splitMetadata(value)
+		if !ok {
+			return
+		}
+		m.metadata = append([]byte(nil), metadata...)
+		m.valueLen = uint64(len(rest))
+		value = rest
+	}
+
+	m.fragmented = flags&entryFragmented != 0
+	if !m.fragmented {
+		m.hash = hash.Hash(value)
+		return
+	}
+
+	if fv, ok := parseFragmentedValue(value); ok {
+		m.valueLen = fv.len
+		m.hash = fv.hash
+	}
+}
+
+// parseEntryHeaders returns the timestamp, the value len and the key len of the entry headers
+func parseEntryHeaders(headers []byte) (entryMeta, uint64) {
+	m := entryMeta{
+		timestamp: int64(common.UnmarshalUint64(headers[0:timestampSizeInBytes])),
+		valueLen:  (uint64(headers[10]) << byteSize) | uint64(headers[11]),
+	}
+	keyLen := (uint64(headers[8]) << byteSize) | uint64(headers[9])
+
+	return m, keyLen
+}
+
+// promote writes the entry read from the disk tier back to the ring buffer
+// keeping its created timestamp, unless it's changed in the meantime.
+func (s *shard) promote(k, v []byte, h, entryIdx uint64, timestamp int64) {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	if current, ok := s.entryIndexes.Get(h); !ok || current != entryIdx {
+		return
+	}
+
+	flags, _ := common.UnpackIntegers(entryIdx, entryIndexBytesSize)
+	if err := s.write(k, v, h, flags, timestamp); err != nil {
+		s.logger.Err("entry could not be promoted from the disk tier", err)
+	}
+}
+
+// expire queues the expired entry index to be deleted by the next writer,
+// readers don't take the write lock. It reports whether the entry is queued by this call,
+// so the entry read again before it's deleted isn't reported twice.
+func (s *shard) expire(h, entryIdx uint64) bool {
+	s.expiredMu.Lock()
+	defer s.expiredMu.Unlock()
+
+	if len(s.expired) >= maxExpiredEntries {
+		return false
+	}
+
+	for _, e := range s.expired {
+		if e.hash == h && e.entryIdx == entryIdx {
+			return false
+		}
+	}
+
+	s.expired = append(s.expired, indexedEntry{hash: h, entryIdx: entryIdx})
+	atomic.StoreInt32(&s.expiredCount, int32(len(s.expired)))
+
+	return true
+}
+
+// notify publishes the event of the key unless the entry is a fragment of a fragmented value
+func (s *shard) notify(typ EventType, key []byte, flags uint64) {
+	if flags&entryFragment == 0 {
+		s.events.publish(typ, key)
+	}
+}
+
+// entryKey returns the key of the encoded (ts, k, value) entry
+func entryKey(entry []byte) []byte {
+	keyLen := (uint64(entry[8]) << byteSize) | uint64(entry[9])
+	return entry[entryHeadersSizeInBytes : entryHeadersSizeInBytes+keyLen]
+}
+
+// deleteExpired deletes the entry indexes found expired by the readers
+// unless they are changed since then, write lock must be held.
+func (s *shard) deleteExpired() {
+	if atomic.LoadInt32(&s.expiredCount) == 0 {
+		return
+	}
+
+	s.expiredMu.Lock()
+	for _, e := range s.expired {
+		if current, ok := s.entryIndexes.Get(e.hash); ok && current == e.entryIdx {
+			s.entryIndexes.Delete(e.hash)
+			s.release(e.entryIdx)
+		}
+	}
+	s.expired = s.expired[:0]
+	atomic.StoreInt32(&s.expiredCount, 0)
+	s.expiredMu.Unlock()
+}
+
+// indexedLen returns the number of entry indexes but the expired ones queued by the readers,
+// they are deleted by the next writer. Read lock must be held.
+func (s *shard) indexedLen() int {
+	length := s.entryIndexes.Len()
+	if atomic.LoadInt32(&s.expiredCount) == 0 {
+		return length
+	}
+
+	s.expiredMu.Lock()
+	for _, e := range s.expired {
+		if current, ok := s.entryIndexes.Get(e.hash); ok && current == e.entryIdx {
+			length--
+		}
+	}
+	s.expiredMu.Unlock()
+
+	return length
+}
+
+// release releases the space of the removed entry index, the disk tier location
+// is released for the entries on the disk.
+func (s *shard) release(entryIdx uint64) {
+	_, entryPosition := common.UnpackIntegers(entryIdx, entryIndexBytesSize)
+	if entryPosition&diskEntryFlag != 0 {
+		s.disk.release(entryPosition &^ diskEntryFlag)
+		return
+	}
+
+	blockIdx := entryPosition / s.ring.BlockSize()
+	block := s.ring.Block(blockIdx)
+	offset := entryPosition % s.ring.BlockSize()
+	if offset+entryHeadersSizeInBytes > uint64(len(block)) {
+		return
+	}
+
+	keyLen := (uint64(block[offset+8]) << byteSize) | uint64(block[offset+9])
+	valLen := (uint64(block[offset+10]) << byteSize) | uint64(block[offset+11])
+	s.blockLive[blockIdx] -= entryHeadersSizeInBytes + keyLen + valLen
+}
+
+// forEachLive calls fn for the entries of the block which are still referenced by the index
+func (s *shard) forEachLive(blockIdx uint64, fn func(e movedEntry, entry []byte)) {
+	block := s.ring.Block(blockIdx)
+	blockPosition := blockIdx * s.ring.BlockSize()
+
+	for offset := uint64(0); offset+entryHeadersSizeInBytes <= uint64(len(block)); {
+		keyLen := (uint64(block[offset+8]) << byteSize) | uint64(block[offset+9])
+		valLen := (uint64(block[offset+10]) << byteSize) | uint64(block[offset+11])
+		entryLen := entryHeadersSizeInBytes + keyLen + valLen
+
+		key := block[offset+entryHeadersSizeInBytes : offset+entryHeadersSizeInBytes+keyLen]
+		h := s.hash.Hash(key)
+
+		if entryIdx, ok := s.entryIndexes.Get(h); ok {
+			flags, entryPosition := common.UnpackIntegers(entryIdx, entryIndexBytesSize)
+			if entryPosition == blockPosition+offset {
+				fn(movedEntry{
+					hash:     h,
+					length:   entryLen,
+					position: entryPosition,
+					flags:    flags,
+				}, block[offset:offset+entryLen])
+			}
+		}
+
+		offset += entryLen
+	}
+}
+
+// keep removes the live entry from its block to be re-appended by reinsert
+func (s *shard) keep(e movedEntry, entry []byte) {
+	s.entryIndexes.Delete(e.hash)
+
+	e.offset = uint64(len(s.reinsertBuf))
+	s.reinserted = append(s.reinserted, e)
+	s.reinsertBuf = append(s.reinsertBuf, entry...)
+}
+
+// pointsToWrittenFragments reports whether the entry is a metadata entry of the value
+// whose fragment is being written, write lock must be held.
+func (s *shard) pointsToWrittenFragments(e movedEntry, entry []byte) bool {
+	if !s.writingFragments || e.flags&entryFragmented == 0 {
+		return false
+	}
+
+	value := entry[uint64(len(entryKey(entry)))+entryHeadersSizeInBytes:]
+	if e.flags&entryHasMetadata != 0 {
+		var ok bool
+		if _, value, ok = splitMetadata(value); !ok {
+			return false
+		}
+	}
+
+	fv, ok := parseFragmentedValue(value)
+	return ok && fv.id == s.fragmentsID
+}
+
+// evictBlock processes the live entries of the block which is going to be overwritten, the ones
+// kept by the eviction policy and the metadata entries of the value whose fragments are being
+// written are re-appended after the write, the others are moved to the disk tier when it's enabled,
+// otherwise their indexes are removed.
+// Write lock must be held.
+func (s *shard) evictBlock(blockIdx uint64) {
+	s.spillBuf = s.spillBuf[:0]
+	s.spilled = s.spilled[:0]
+
+	s.forEachLive(blockIdx, func(e movedEntry, entry []byte) {
+		switch {
+		// re-appended entries would be overwritten right away with a single block
+		case s.ring.Blocks() > 1 && s.policy.Reinsert(e.hash):
+			s.keep(e, entry)
+			if s.statsEnabled {
+				atomic.AddUint64(&s.reinserts, 1)
+			}
+		case s.ring.Blocks() > 1 && s.pointsToWrittenFragments(e, entry):
+			s.keep(e, entry)
+		case s.disk == nil:
+			s.entryIndexes.Delete(e.hash)
+			s.countEviction()
+			s.notify(EventEvict, entryKey(entry), e.flags)
+		default:
+			e.offset = uint64(len(s.spillBuf))
+			s.spilled = append(s.spilled, e)
+			s.spillBuf = append(s.spillBuf, entry...)
+		}
+	})
+
+	// none of the entries in the block is referenced from now on
+	s.blockLive[blockIdx] = 0
+
+	if len(s.spilled) == 0 {
+		return
+	}
+
+	location, err := s.disk.append(s.spillBuf, int64(len(s.spilled)))
+	for _, e := range s.spilled {
+		if err != nil {
+			s.entryIndexes.Delete(e.hash)
+			s.countEviction()
+			s.notify(EventEvict, entryKey(s.spillBuf[e.offset:]), e.flags)
+			continue
+		}
+
+		s.entryIndexes.Put(e.hash, common.PackIntegers(
+			diskEntryFlag|(location+e.offset), e.flags, entryIndexBytesSize))
+	}
+
+	if err != nil {
+		s.logger.Err("entries could not be moved to the disk tier", err)
+	}
+}
+
+func (s *shard) countEviction() {
+	if s.statsEnabled {
+		atomic.AddUint64(&s.evictions, 1)
+	}
+}
+
+func (s *shard) countFragmentMiss() {
+	if s.statsEnabled {
+		atomic.AddUint64(&s.fragmentMisses, 1)
+	}
+}
+
+// compact rewrites the live entries of the block with the most dead bytes at the head
+// of the ring and releases the block, so it's written before the oldest block is overwritten.
+// Only the blocks where dead bytes ratio is at least minDeadRatio are compacted,
+// it returns false when there is no such block.
+func (s *shard) compact(minDeadRatio float64) bool {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	current := s.ring.Current()
+	var candidate, maxDead uint64
+	for _, blockIdx := range s.ring.Written() {
+		written := uint64(len(s.ring.Block(blockIdx)))
+		if blockIdx == current || written == 0 {
+			continue
+		}
+
+		dead := written - s.blockLive[blockIdx]
+		if float64(dead) >= minDeadRatio*float64(written) && dead > maxDead {
+			candidate, maxDead = blockIdx, dead
+		}
+	}
+
+	if maxDead == 0 {
+		return false
+	}
+
+	s.forEachLive(candidate, s.keep)
+	s.blockLive[candidate] = 0
+	s.ring.Release(candidate)
+
+	s.reinsert()
+
+	if s.statsEnabled {
+		atomic.AddUint64(&s.compactions, 1)
+	}
+
+	return true
+}
+
+// resize grows or shrinks the ring buffer to the given number of blocks, free blocks are
+// removed first while shrinking and then the oldest blocks are evicted like they are overwritten.
+// The block pointed by the write cursor is always kept.
+func (s *shard) resize(blocks uint64) {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	if current := s.ring.Blocks(); blocks > current {
+		s.grow(blocks - current)
+		return
+	}
+
+	for s.ring.Blocks() > blocks {
+		blockIdx, ok := s.ring.NextRetired()
+		if !ok {
+			break
+		}
+
+		if len(s.ring.Block(blockIdx)) > 0 {
+			s.evictBlock(blockIdx)
+		}
+		s.ring.Retire(blockIdx)
+
+		s.reinsert()
+	}
 }
 
 //del deletes an entry from shard
 //(please note that this doesn't delete the entry value,
 // it will be overwritten when the ring buffer is full )
 func (s *shard) del(h uint64) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	if s.migrated {
+		return errShardMigrated
+	}
+
 	if s.statsEnabled {
 		atomic.AddUint64(&s.delHits, 1)
 	}
 
-	s.rwMutex.Lock()
-	defer s.rwMutex.Unlock()
-	if _, ok := s.entryIndexes[h]; !ok {
+	entryIdx, ok := s.entryIndexes.Get(h)
+	if !ok {
 		if s.statsEnabled {
 			atomic.AddUint64(&s.delMisses, 1)
 		}
 		return ErrEntryNotFound
 	}
 
-	delete(s.entryIndexes, h)
+	s.entryIndexes.Delete(h)
+	s.release(entryIdx)
 	return nil
 }
 
+// remove deletes the entry index without updating the stats
+func (s *shard) remove(h uint64) bool {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	entryIdx, ok := s.entryIndexes.Get(h)
+	if !ok {
+		return false
+	}
+
+	s.entryIndexes.Delete(h)
+	s.release(entryIdx)
+	return true
+}
+
+// migrate moves up to n entries to the shards returned by target while resharding, entries keep
+// their created timestamps and flags and the entries on the disk keep their locations.
+// Expired entries are dropped. It returns the number of entries left in the shard.
+func (s *shard) migrate(n int, target func(h uint64) *shard) int {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	// the batch is collected first since the index can't be modified while ranging
+	s.migrating = s.migrating[:0]
+	s.entryIndexes.Range(func(h, entryIdx uint64) bool {
+		s.migrating = append(s.migrating, indexedEntry{hash: h, entryIdx: entryIdx})
+		return len(s.migrating) < n
+	})
+
+	now := s.clock.Now()
+	for _, e := range s.migrating {
+		h, entryIdx := e.hash, e.entryIdx
+		s.entryIndexes.Delete(h)
+
+		flags, entryPosition := common.UnpackIntegers(entryIdx, entryIndexBytesSize)
+		if entryPosition&diskEntryFlag != 0 {
+			// the disk tier is shared by the shards, so only the index is moved
+			if !target(h).adopt(h, entryIdx) {
+				s.release(entryIdx)
+			}
+			continue
+		}
+
+		s.release(entryIdx)
+
+		block := s.ring.Block(entryPosition / s.ring.BlockSize())
+		offset := entryPosition % s.ring.BlockSize()
+		if offset+entryHeadersSizeInBytes > uint64(len(block)) {
+			continue
+		}
+
+		timestamp := int64(common.UnmarshalUint64(block[offset : offset+timestampSizeInBytes]))
+		if now-timestamp > s.ttlInSeconds {
+			if s.statsEnabled {
+				atomic.AddUint64(&s.expirations, 1)
+			}
+			s.notify(EventExpire, entryKey(block[offset:]), flags)
+			continue
+		}
+
+		keyLen := (uint64(block[offset+8]) << byteSize) | uint64(block[offset+9])
+		valLen := (uint64(block[offset+10]) << byteSize) | uint64(block[offset+11])
+		keyPosition := offset + entryHeadersSizeInBytes
+		key := block[keyPosition : keyPosition+keyLen]
+		value := block[keyPosition+keyLen : keyPosition+keyLen+valLen]
+
+		if err := target(h).insert(key, value, h, flags, timestamp); err != nil {
+			s.logger.Err("entry could not migrated", err)
+		}
+	}
+
+	return s.entryIndexes.Len()
+}
+
+// retire marks the shard as migrated, the writers which hold the shard
+// from the previous layout find it out under the lock.
+func (s *shard) retire() {
+	s.rwMutex.Lock()
+	s.migrated = true
+	s.rwMutex.Unlock()
+}
+
+// insert writes the migrated entry unless the key is written to the shard in the meantime
+func (s *shard) insert(k, v []byte, h uint64, flags uint64, timestamp int64) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	if _, ok := s.entryIndexes.Get(h); ok {
+		return nil
+	}
+
+	return s.write(k, v, h, flags, timestamp)
+}
+
+// adopt takes over the index of the migrated entry on the disk
+// unless the key is written to the shard in the meantime
+func (s *shard) adopt(h, entryIdx uint64) bool {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	if _, ok := s.entryIndexes.Get(h); ok {
+		return false
+	}
+
+	s.entryIndexes.Put(h, entryIdx)
+	return true
+}
+
 //reset resets shard state and its stats
 func (s *shard) reset() {
 	s.rwMutex.Lock()
 
 	s.ring.Reset()
 
-	bm := s.entryIndexes
-	for k := range bm {
-		delete(bm, k)
+	s.entryIndexes.Reset()
+
+	if s.latency != nil {
+		s.latency.reset()
 	}
 
 	atomic.StoreUint64(&s.hits, 0)
@@ -250,15 +1174,53 @@ func (s *shard) reset() {
 	atomic.StoreUint64(&s.delHits, 0)
 	atomic.StoreUint64(&s.delMisses, 0)
 	atomic.StoreUint64(&s.collisions, 0)
+	atomic.StoreUint64(&s.diskHits, 0)
+	atomic.StoreUint64(&s.reinserts, 0)
+	atomic.StoreUint64(&s.admissionRejects, 0)
+	atomic.StoreUint64(&s.compactions, 0)
+	atomic.StoreUint64(&s.evictions, 0)
+	atomic.StoreUint64(&s.expirations, 0)
+	atomic.StoreUint64(&s.fragmentedSets, 0)
+	atomic.StoreUint64(&s.fragmentedGets, 0)
+	atomic.StoreUint64(&s.fragmentMisses, 0)
+	atomic.StoreUint64(&s.hashFailures, 0)
+
+	s.expiredMu.Lock()
+	s.expired = s.expired[:0]
+	atomic.StoreInt32(&s.expiredCount, 0)
+	s.expiredMu.Unlock()
+
+	for i := range s.blockLive {
+		s.blockLive[i] = 0
+	}
+
+	s.policy.Reset()
+	if s.admission != nil {
+		s.admission.Reset()
+	}
 
 	s.rwMutex.Unlock()
 }
 
+// close releases the ring buffer memory, shard must not be used after it's closed
+func (s *shard) close() error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	s.entryIndexes.Reset()
+
+	if s.budget != nil {
+		s.budget.release(int64(s.ring.Blocks()))
+	}
+
+	return s.ring.Close()
+}
+
 // len returns computes number of entries in shard
 func (s *shard) len() uint64 {
-	s.rwMutex.RLock()
-	length := uint64(len(s.entryIndexes))
-	s.rwMutex.RUnlock()
+	slot := s.rwMutex.RLock(0)
+	length := uint64(s.indexedLen())
+	s.rwMutex.RUnlock(slot)
 
 	return length
 }
@@ -268,6 +1230,16 @@ func (s *shard) loadStats(stats *CacheStats) {
 	//get
 	stats.Hits += atomic.LoadUint64(&s.hits)
 	stats.Misses += atomic.LoadUint64(&s.misses)
+	stats.DiskHits += atomic.LoadUint64(&s.diskHits)
+	stats.Reinserts += atomic.LoadUint64(&s.reinserts)
+	stats.AdmissionRejects += atomic.LoadUint64(&s.admissionRejects)
+	stats.Compactions += atomic.LoadUint64(&s.compactions)
+	stats.Evictions += atomic.LoadUint64(&s.evictions)
+	stats.Expirations += atomic.LoadUint64(&s.expirations)
+	stats.FragmentedSets += atomic.LoadUint64(&s.fragmentedSets)
+	stats.FragmentedGets += atomic.LoadUint64(&s.fragmentedGets)
+	stats.FragmentMisses += atomic.LoadUint64(&s.fragmentMisses)
+	stats.HashFailures += atomic.LoadUint64(&s.hashFailures)
 
 	stats.Collisions += atomic.LoadUint64(&s.collisions)
 
@@ -275,8 +1247,42 @@ func (s *shard) loadStats(stats *CacheStats) {
 	stats.DelHits += atomic.LoadUint64(&s.delHits)
 	stats.DelMisses += atomic.LoadUint64(&s.delMisses)
 
-	s.rwMutex.RLock()
-	stats.EntriesCount += uint64(len(s.entryIndexes))
+	slot := s.rwMutex.RLock(0)
+	stats.EntriesCount += uint64(s.indexedLen())
 	stats.CacheBytes += s.ring.Cap()
-	s.rwMutex.RUnlock()
+	stats.IndexBytes += s.entryIndexes.Bytes()
+	stats.OffHeapBytes += s.ring.OffHeapBytes()
+	stats.CapacityBytes += s.ring.Blocks() * s.ring.BlockSize()
+	if s.budget != nil {
+		stats.ShardBlocks = append(stats.ShardBlocks, s.ring.Blocks())
+	}
+	for _, blockIdx := range s.ring.Written() {
+		stats.LiveBytes += s.blockLive[blockIdx]
+		stats.DeadBytes += uint64(len(s.ring.Block(blockIdx))) - s.blockLive[blockIdx]
+	}
+	s.rwMutex.RUnlock(slot)
+}
+
+// shardStats returns the statistics of the shard
+func (s *shard) shardStats() ShardStats {
+	stats := ShardStats{
+		Hits:           atomic.LoadUint64(&s.hits),
+		Misses:         atomic.LoadUint64(&s.misses),
+		Collisions:     atomic.LoadUint64(&s.collisions),
+		Evictions:      atomic.LoadUint64(&s.evictions),
+		Expirations:    atomic.LoadUint64(&s.expirations),
+		FragmentedSets: atomic.LoadUint64(&s.fragmentedSets),
+		FragmentedGets: atomic.LoadUint64(&s.fragmentedGets),
+		FragmentMisses: atomic.LoadUint64(&s.fragmentMisses),
+		HashFailures:   atomic.LoadUint64(&s.hashFailures),
+	}
+
+	slot := s.rwMutex.RLock(0)
+	stats.EntriesCount = uint64(s.indexedLen())
+	stats.CacheBytes = s.ring.Cap()
+	stats.WriteCursor = s.ring.Pos()
+	stats.Wraps = s.ring.Wraps()
+	s.rwMutex.RUnlock(slot)
+
+	return stats
 }
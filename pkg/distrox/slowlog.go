@@ -0,0 +1,109 @@
+package distrox
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxSlowLogKeyLen is the number of the key bytes kept by the slow log
+const maxSlowLogKeyLen = 128
+
+// SlowOp is a cache operation which took longer than the slow log threshold
+type SlowOp struct {
+	// ID is the unique, increasing id of the entry
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	// Op is the operation (get, set, del, fragmented_get, fragmented_set)
+	Op string `json:"op"`
+	// Key is the key truncated to 128 bytes
+	Key       string `json:"key"`
+	ValueSize int    `json:"value_size"`
+	// Shard is the index of the shard of the key
+	Shard int `json:"shard"`
+	// Duration is the duration of the operation in nanoseconds
+	Duration time.Duration `json:"duration"`
+}
+
+// slowLog keeps the last maxLen operations slower than the threshold in a ring
+type slowLog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	entries []SlowOp
+	// next is the position of the next entry in the ring
+	next   int
+	nextID uint64
+}
+
+func newSlowLog(threshold time.Duration, maxLen int) *slowLog {
+	return &slowLog{
+		threshold: threshold,
+		entries:   make([]SlowOp, 0, maxLen),
+	}
+}
+
+func (l *slowLog) add(op SlowOp) {
+	if len(op.Key) > maxSlowLogKeyLen {
+		op.Key = fmt.Sprintf("%s... (%d more bytes)", op.Key[:maxSlowLogKeyLen], len(op.Key)-maxSlowLogKeyLen)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	op.ID = l.nextID
+	l.nextID++
+
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, op)
+		l.next = len(l.entries) % cap(l.entries)
+		return
+	}
+
+	l.entries[l.next] = op
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// get returns the last count entries, the newest first, all entries when count isn't positive
+func (l *slowLog) get(count int) []SlowOp {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if count <= 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+
+	ops := make([]SlowOp, count)
+	for i := range ops {
+		// the newest entry is the one before next
+		idx := (l.next - 1 - i + 2*len(l.entries)) % len(l.entries)
+		ops[i] = l.entries[idx]
+	}
+
+	return ops
+}
+
+func (l *slowLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = l.entries[:0]
+	l.next = 0
+}
+
+// SlowLog returns the last count operations slower than the slow log threshold, the newest first.
+// It returns all of them when count isn't positive and nil unless the slow log is enabled by WithSlowLog.
+func (c *Cache) SlowLog(count int) []SlowOp {
+	if c.slowLog == nil {
+		return nil
+	}
+
+	return c.slowLog.get(count)
+}
+
+// ResetSlowLog removes the operations of the slow log
+func (c *Cache) ResetSlowLog() {
+	if c.slowLog != nil {
+		c.slowLog.reset()
+	}
+}
@@ -15,8 +15,94 @@ type CacheStats struct {
 	// Collisions is a number of happened key-collisions
 	Collisions uint64 `json:"collisions"`
 
+	// Evictions is a number of entries removed since their ring buffer block is overwritten,
+	// the entries moved to the disk tier are not counted
+	Evictions uint64 `json:"evictions"`
+	// Expirations is a number of entries found expired
+	Expirations uint64 `json:"expirations"`
+
+	// FragmentedSets is a number of stored entries which don't fit into a block
+	FragmentedSets uint64 `json:"fragmented_sets"`
+	// FragmentedGets is a number of read entries which don't fit into a block
+	FragmentedGets uint64 `json:"fragmented_gets"`
+	// FragmentMisses is a number of fragmented entries read with a missing fragment
+	FragmentMisses uint64 `json:"fragment_misses"`
+	// HashFailures is a number of fragmented entries read with a value hash mismatch
+	HashFailures uint64 `json:"hash_failures"`
+
+	// Reinserts is a number of entries re-appended by the eviction policy instead of being evicted
+	Reinserts uint64 `json:"reinserts"`
+	// AdmissionRejects is a number of writes refused by the admission filter
+	AdmissionRejects uint64 `json:"admission_rejects"`
+	// Compactions is a number of ring buffer blocks released by the compaction
+	Compactions uint64 `json:"compactions"`
+
 	// Entries is the current number of entries in the cache.
 	EntriesCount uint64 `json:"entries_count"`
 	// CacheBytes is the current size of the cache in bytes.
 	CacheBytes uint64 `json:"cache_bytes"`
+	// IndexBytes is the current size of the entry indexes of all shards in bytes.
+	IndexBytes uint64 `json:"index_bytes"`
+	// CapacityBytes is the current size of the ring buffer blocks of all shards in bytes.
+	CapacityBytes uint64 `json:"capacity_bytes"`
+
+	// BudgetBlocks is the number of blocks of the global budget shared by the shards.
+	BudgetBlocks uint64 `json:"budget_blocks,omitempty"`
+	// Reclaims is a number of blocks reclaimed from the shards for the global budget
+	Reclaims uint64 `json:"reclaims,omitempty"`
+	// ShardBlocks is the number of blocks used by each shard with the global budget.
+	ShardBlocks []uint64 `json:"shard_blocks,omitempty"`
+	// OffHeapBytes is the part of the cache size allocated outside of the Go heap.
+	OffHeapBytes uint64 `json:"off_heap_bytes"`
+	// LiveBytes is the current size of the entries referenced by the index in the ring buffers.
+	LiveBytes uint64 `json:"live_bytes"`
+	// DeadBytes is the current size of the deleted and overwritten entries in the ring buffers.
+	DeadBytes uint64 `json:"dead_bytes"`
+
+	// DiskHits is a number of keys found in the disk tier
+	DiskHits uint64 `json:"disk_hits"`
+	// DiskBytes is the current size of the disk tier segments in bytes.
+	DiskBytes uint64 `json:"disk_bytes"`
+	// DiskSegments is the current number of the disk tier segment files.
+	DiskSegments uint64 `json:"disk_segments"`
+
+	// EventSubscribers is the current number of the keyspace event subscribers.
+	EventSubscribers uint64 `json:"event_subscribers"`
+	// DroppedSubscribers is a number of the event subscribers dropped since their buffer is full
+	DroppedSubscribers uint64 `json:"dropped_subscribers"`
+	// Watchers is the current number of the watchers of the keys waiting for their next event.
+	Watchers uint64 `json:"watchers"`
+}
+
+// ShardStats stores statistics of a shard
+type ShardStats struct {
+	// Hits is a number of successfully found keys
+	Hits uint64 `json:"hits"`
+	// Misses is a number of not found keys
+	Misses uint64 `json:"misses"`
+	// Collisions is a number of happened key-collisions
+	Collisions uint64 `json:"collisions"`
+
+	// Evictions is a number of entries removed since their ring buffer block is overwritten
+	Evictions uint64 `json:"evictions"`
+	// Expirations is a number of entries found expired
+	Expirations uint64 `json:"expirations"`
+
+	// FragmentedSets is a number of stored entries which don't fit into a block
+	FragmentedSets uint64 `json:"fragmented_sets"`
+	// FragmentedGets is a number of read entries which don't fit into a block
+	FragmentedGets uint64 `json:"fragmented_gets"`
+	// FragmentMisses is a number of fragmented entries read with a missing fragment
+	FragmentMisses uint64 `json:"fragment_misses"`
+	// HashFailures is a number of fragmented entries read with a value hash mismatch
+	HashFailures uint64 `json:"hash_failures"`
+
+	// EntriesCount is the current number of entries in the shard.
+	EntriesCount uint64 `json:"entries_count"`
+	// CacheBytes is the current size of the shard in bytes.
+	CacheBytes uint64 `json:"cache_bytes"`
+	// WriteCursor is the position of the next write in the ring buffer.
+	WriteCursor uint64 `json:"write_cursor"`
+	// Wraps is a number of times the oldest block of the ring buffer is overwritten
+	Wraps uint64 `json:"wraps"`
 }
@@ -0,0 +1,282 @@
+package distrox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/ziyasal/distroxy/internal/pkg/common"
+)
+
+// streamSeq makes the fragments ids of the streamed values unique
+var streamSeq uint64
+
+// SetReader saves the value read from r under the byte array key, see SetReaderWithMeta
+func (c *Cache) SetReader(key []byte, r io.Reader, size int64) error {
+	return c.SetReaderWithMeta(key, r, size, nil)
+}
+
+// SetReaderWithMeta saves the value read from r under the byte array key with the metadata. The fragments of
+// a big value are stored as they are read, so the value is never buffered as a whole. size is the len of
+// the value or -1 when it's unknown, the value must be smaller than MaxValueSizeInBytes, otherwise
+// an ErrEntryValueTooBig is returned as soon as it's exceeded while reading. r is read to the end even if
+// the key is not admitted, an ErrNotAdmitted is returned then.
+// The fragments of a streamed value are addressed by a unique id instead of the value hash.
+func (c *Cache) SetReaderWithMeta(key []byte, r io.Reader, size int64, metadata []byte) error {
+	_, err := c.setReader(key, r, size, metadata)
+	return err
+}
+
+// SetReaderWithMetaHash saves the value like SetReaderWithMeta and returns the hash of the stored value
+// (see EntryMeta.Hash), so it's known without reading the entry again after another writer might change it.
+func (c *Cache) SetReaderWithMetaHash(key []byte, r io.Reader, size int64, metadata []byte) (uint64, error) {
+	return c.setReader(key, r, size, metadata)
+}
+
+// setReader saves the value read from r and returns its hash
+func (c *Cache) setReader(key []byte, r io.Reader, size int64, metadata []byte) (uint64, error) {
+	if size >= c.MaxValueSizeInBytes {
+		return 0, ErrEntryValueTooBig
+	}
+
+	if len(metadata) > maxMetadataSizeInBytes {
+		return 0, ErrMetadataTooBig
+	}
+
+	valueBuf := c.bpool.Get()
+	defer c.bpool.Put(valueBuf)
+
+	// the value is stored as is when it fits into a block with its metadata
+	limit := defaultValueSizeInBytes - storedValueLen(nil, metadata) + 1
+	if n := limit - cap(valueBuf); n > 0 {
+		valueBuf = append(valueBuf[:cap(valueBuf)], make([]byte, n)...)
+	}
+
+	n, err := io.ReadFull(r, valueBuf[:limit])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if size >= 0 && int64(n) != size {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if int64(n) >= c.MaxValueSizeInBytes {
+			return 0, ErrEntryValueTooBig
+		}
+
+		// the value fits into a block, so it's not fragmented
+		if err := c.SetBinWithMeta(key, valueBuf[:n], metadata); err != nil {
+			return 0, err
+		}
+		return c.hash.Hash(valueBuf[:n]), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if !c.timed {
+		_, hash, err := c.setStream(key, io.MultiReader(bytes.NewReader(valueBuf[:n]), r), size, metadata)
+		return hash, err
+	}
+
+	start := time.Now()
+	valueLen, hash, err := c.setStream(key, io.MultiReader(bytes.NewReader(valueBuf[:n]), r), size, metadata)
+	c.observe(opFragmentedSet, key, int(valueLen), start)
+
+	return hash, err
+}
+
+// setStream stores the value read from r in fragments and returns the len and the hash of the value
+func (c *Cache) setStream(key []byte, r io.Reader, size int64, metadata []byte) (int64, uint64, error) {
+	if len(key) > defaultKeySizeInBytes {
+		return 0, 0, errors.New("too big key")
+	}
+
+	if c.hotKeys != nil {
+		c.hotKeys.sample(key, c.hash)
+	}
+
+	if !c.admit(key) {
+		// the value is consumed, so the writer doesn't fail writing the rest of it
+		n, err := io.Copy(ioutil.Discard, io.LimitReader(r, c.MaxValueSizeInBytes))
+		if err != nil {
+			return n, 0, err
+		}
+		return n, 0, ErrNotAdmitted
+	}
+
+	fragmentKey := c.bpool.Get()
+	defer c.bpool.Put(fragmentKey)
+
+	fragmentBuf := c.bpool.Get()
+	defer c.bpool.Put(fragmentBuf)
+	if n := fragmentSizeInBytes - cap(fragmentBuf); n > 0 {
+		fragmentBuf = append(fragmentBuf[:cap(fragmentBuf)], make([]byte, n)...)
+	}
+
+	fragmentKey = common.MarshalUint64(fragmentKey[:0], atomic.AddUint64(&streamSeq, 1))
+	fragmentKey = common.MarshalUint64(fragmentKey, uint64(time.Now().UnixNano()))
+	fragmentKey = append(fragmentKey, key...)
+	fv := fragmentedValue{id: c.hash.Hash(fragmentKey)}
+
+	var fragmentHashes []byte
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(r, fragmentBuf[:fragmentSizeInBytes])
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return int64(fv.len), 0, err
+		}
+
+		fv.len += uint64(n)
+		if int64(fv.len) >= c.MaxValueSizeInBytes {
+			return int64(fv.len), 0, ErrEntryValueTooBig
+		}
+
+		fragment := fragmentBuf[:n]
+		fragmentHashes = common.MarshalUint64(fragmentHashes, c.hash.Hash(fragment))
+
+		fragmentKey = fv.appendFragmentKey(fragmentKey[:0], i)
+		if err := c.setBin(fragmentKey, fragment, entryFragment); err != nil {
+			return int64(fv.len), 0, err
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	if size >= 0 && int64(fv.len) != size {
+		return int64(fv.len), 0, io.ErrUnexpectedEOF
+	}
+	fv.hash = c.hash.Hash(fragmentHashes)
+
+	if err := c.setFragmentedValue(key, fv, metadata); err != nil {
+		return int64(fv.len), 0, err
+	}
+
+	c.events.publish(EventSet, key)
+	return int64(fv.len), fv.hash, nil
+}
+
+// WriteTo writes the value for the byte array key to w and returns the number of bytes written.
+// The fragments of a fragmented value are written one by one as they are read, so the value
+// is never buffered as a whole, a missing or corrupted fragment is reported by the error only
+// after the fragments before it are written.
+func (c *Cache) WriteTo(key []byte, w io.Writer) (int64, error) {
+	return c.writeToTimed(key, w, nil)
+}
+
+// WriteToWithHash writes the value like WriteTo if it still has the hash (see EntryMeta.Hash), otherwise
+// it returns an ErrEntryChanged before anything is written to w, so the value served with its metadata
+// isn't replaced by a newer value.
+func (c *Cache) WriteToWithHash(key []byte, w io.Writer, hash uint64) (int64, error) {
+	return c.writeToTimed(key, w, &hash)
+}
+
+func (c *Cache) writeToTimed(key []byte, w io.Writer, hash *uint64) (int64, error) {
+	if !c.timed {
+		n, _, err := c.writeTo(key, w, hash)
+		return n, err
+	}
+
+	start := time.Now()
+	n, fragmented, err := c.writeTo(key, w, hash)
+
+	op := opGet
+	if fragmented {
+		op = opFragmentedGet
+	}
+	c.observe(op, key, int(n), start)
+
+	return n, err
+}
+
+// writeTo writes the value to w and reports whether it's fragmented,
+// the hash of the value is checked before it's written unless hash is nil
+func (c *Cache) writeTo(key []byte, w io.Writer, hash *uint64) (int64, bool, error) {
+	if c.hotKeys != nil {
+		c.hotKeys.sample(key, c.hash)
+	}
+
+	valueBuf := c.bpool.Get()
+	defer c.bpool.Put(valueBuf)
+
+	value, flags, err := c.getBin(valueBuf[:0], key)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if flags&entryHasMetadata != 0 {
+		var ok bool
+		if _, value, ok = splitMetadata(value); !ok {
+			return 0, false, errInvalidMetadata
+		}
+	}
+
+	if flags&entryFragmented == 0 {
+		if hash != nil && c.hash.Hash(value) != *hash {
+			return 0, false, ErrEntryChanged
+		}
+
+		n, err := w.Write(value)
+		return int64(n), false, err
+	}
+
+	// fragmented entry stats are counted by the shard of the metadata entry
+	s := c.shardSet().shard(c.hash.Hash(key))
+	if s.statsEnabled {
+		atomic.AddUint64(&s.fragmentedGets, 1)
+	}
+
+	fv, ok := parseFragmentedValue(value)
+	if !ok {
+		return 0, true, fmt.Errorf("invalid fragmented entry value len — want: %d got: %d",
+			fragmentedEntryKeyLen, len(value))
+	}
+
+	if hash != nil && fv.hash != *hash {
+		return 0, true, ErrEntryChanged
+	}
+
+	n, err := c.writeFragments(w, fv, valueBuf, s)
+	return n, true, err
+}
+
+// writeFragments writes the fragments of the value to w reading them into buf,
+// misses and hash failures are counted by s
+func (c *Cache) writeFragments(w io.Writer, fv fragmentedValue, buf []byte, s *shard) (int64, error) {
+	fragmentKey := c.bpool.Get()
+	defer c.bpool.Put(fragmentKey)
+
+	var fragmentHashes []byte
+	var written int64
+	for i := uint64(0); uint64(written) < fv.len; i++ {
+		fragmentKey = fv.appendFragmentKey(fragmentKey[:0], i)
+
+		fragment, _, err := c.getBin(buf[:0], fragmentKey)
+		if err != nil {
+			s.countFragmentMiss()
+			c.logger.Err("Fragment of the actual value could not found", err)
+			return written, err
+		}
+
+		if len(fragment) == 0 || uint64(written)+uint64(len(fragment)) > fv.len {
+			s.countFragmentMiss()
+			c.logger.Debug("fragment of the actual value could not found")
+			return written, ErrFragmentNotFound
+		}
+		buf = fragment
+
+		fragmentHashes = common.MarshalUint64(fragmentHashes, c.hash.Hash(fragment))
+		n, err := w.Write(fragment)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, c.verifyFragments(fv, fragmentHashes, s)
+}
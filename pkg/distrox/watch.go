@@ -0,0 +1,139 @@
+package distrox
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// watcherShards is the number of the watcher maps, so the publishers don't contend on a single lock
+const watcherShards = 64
+
+type watcherShard struct {
+	mu       sync.Mutex
+	watchers map[uint64][]*Watcher
+}
+
+// Watcher receives the next set, delete, expire or evict event of a key
+type Watcher struct {
+	key   []byte
+	hash  uint64
+	bus   *eventBus
+	event chan Event
+	// done is closed once the event is sent or the watcher is closed
+	done chan struct{}
+}
+
+// Event returns the channel receiving the event, it's closed after the event
+// or when the watcher is closed before it
+func (w *Watcher) Event() <-chan Event {
+	return w.event
+}
+
+// Close stops the watcher unless it's fired already
+func (w *Watcher) Close() {
+	s := w.bus.watcherShard(w.hash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	watchers := s.watchers[w.hash]
+	for i, other := range watchers {
+		if other == w {
+			s.remove(w.hash, watchers, i)
+			atomic.AddInt32(&w.bus.watcherCount, -1)
+			w.stop()
+			return
+		}
+	}
+}
+
+func (w *Watcher) stop() {
+	close(w.event)
+	close(w.done)
+}
+
+// remove removes the i-th watcher of the hash
+func (s *watcherShard) remove(h uint64, watchers []*Watcher, i int) {
+	last := len(watchers) - 1
+	watchers[i] = watchers[last]
+	watchers[last] = nil
+
+	if last == 0 {
+		delete(s.watchers, h)
+		return
+	}
+	s.watchers[h] = watchers[:last]
+}
+
+func (b *eventBus) watcherShard(h uint64) *watcherShard {
+	return &b.watchers[h%watcherShards]
+}
+
+func (b *eventBus) watch(key []byte) *Watcher {
+	h := b.hash.Hash(key)
+	w := &Watcher{
+		key:   append([]byte(nil), key...),
+		hash:  h,
+		bus:   b,
+		event: make(chan Event, 1),
+		done:  make(chan struct{}),
+	}
+
+	s := b.watcherShard(h)
+	s.mu.Lock()
+	s.watchers[h] = append(s.watchers[h], w)
+	atomic.AddInt32(&b.watcherCount, 1)
+	s.mu.Unlock()
+
+	return w
+}
+
+// fire sends the event to the watchers of the key and removes them, the buffer of a watcher
+// holds its only event, so it never blocks
+func (b *eventBus) fire(key []byte, event func() Event) {
+	h := b.hash.Hash(key)
+	s := b.watcherShard(h)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	watchers := s.watchers[h]
+	for i := len(watchers) - 1; i >= 0; i-- {
+		w := watchers[i]
+		if string(w.key) != string(key) {
+			continue
+		}
+
+		w.event <- event()
+		w.stop()
+		s.remove(h, watchers, i)
+		atomic.AddInt32(&b.watcherCount, -1)
+		watchers = s.watchers[h]
+	}
+}
+
+// NewWatcher returns the watcher of the next event of the key, it must be closed when
+// it's not used anymore unless it's fired. Unlike Watch, it doesn't need a goroutine.
+func (c *Cache) NewWatcher(key []byte) *Watcher {
+	return c.events.watch(key)
+}
+
+// Watch returns a channel receiving the next set, delete, expire or evict event of the key, it's closed
+// after the event or once ctx is done. A goroutine waits for ctx until the event unless ctx is never done.
+// Reset doesn't fire the watchers.
+func (c *Cache) Watch(ctx context.Context, key []byte) <-chan Event {
+	w := c.NewWatcher(key)
+
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				w.Close()
+			case <-w.done:
+			}
+		}()
+	}
+
+	return w.Event()
+}